@@ -1,25 +1,294 @@
 package format
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+
 	s "relationalDatabase/internal/storage"
 )
 
+// ErrCatalogChecksum is returned when the directory entries don't match the
+// checksum stored with them
+var ErrCatalogChecksum = errors.New("directory entries do not match their checksum")
+
+// Directory page layout, a checksum of the entries is followed by the
+// entries back to back and a zero name length marks the end of the list
+const (
+	directoryChecksumSize = 4 // Size of the checksum covering the entries
+	directoryPageIdSize   = 8 // Size of the schema page id of an entry
+	schemaLengthSize      = 4 // Size of the length prefix of a schema page
+	maxDirectoryNameBytes = 255
+)
+
 type DirectoryEntry struct {
 	TableNameLen byte
 	TableName    string
 	PageId       uint64
 }
 
+// Directory maps table names to their schemas. The entries live in the
+// directory page and each schema in a page of its own
 type Directory struct {
 	schemas  map[string]Schema
-	database s.DatabaseManager
+	entries  []DirectoryEntry
+	pageId   uint64 // Page holding the entries
+	capacity int    // Bytes of entries the page can hold
+	database *s.DatabaseManager
 }
 
-func (directory *Directory) initializeDirectory(database s.DatabaseManager) {
+// OpenDirectory loads the table directory of a database, creating the
+// directory page if the database doesn't have one yet
+func OpenDirectory(database *s.DatabaseManager) (*Directory, error) {
+	directory := &Directory{}
+	err := directory.initializeDirectory(database)
+	if err != nil {
+		return nil, err
+	}
+	return directory, nil
+}
+
+func (directory *Directory) initializeDirectory(database *s.DatabaseManager) error {
 	directory.database = database
-	data, err := database.GetPage(1)
+	directory.schemas = make(map[string]Schema)
+	directory.entries = []DirectoryEntry{}
+
+	pageId, err := database.ReadMetaField(s.MetaDirectoryHead)
+	if err != nil {
+		return err
+	}
+	if pageId == 0 {
+		pageId, err = directory.createDirectoryPage()
+		if err != nil {
+			return err
+		}
+	}
+	directory.pageId = pageId
+
+	data, err := database.GetPage(pageId)
+	if err != nil {
+		return err
+	}
+	directory.capacity = len(data)
+	entries, err := decodeEntries(data, pageId)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		schema, err := directory.readSchema(entry.PageId)
+		if err != nil {
+			return fmt.Errorf("failed to read schema of table %s: %w", entry.TableName, err)
+		}
+		directory.addEntry(entry, schema)
+	}
+	database.SetVacuumHook(vacuumRemapper{directory})
+	return nil
+}
+
+// decodeEntries reads the entries of directory page pageId. A garbled
+// entry can pass the page checksum, so the entries are checked against
+// their own checksum before anyone follows them to the schema pages
+func decodeEntries(data s.PageData, pageId uint64) ([]DirectoryEntry, error) {
+	offset := directoryChecksumSize
+	entries := []DirectoryEntry{}
+	for offset < len(data) && data[offset] != 0 {
+		nameLen := int(data[offset])
+		if offset+1+nameLen+directoryPageIdSize > len(data) {
+			return nil, fmt.Errorf("directory entry at offset %d runs past the end of page %d", offset, pageId)
+		}
+		entries = append(entries, DirectoryEntry{
+			TableNameLen: data[offset],
+			TableName:    string(data[offset+1 : offset+1+nameLen]),
+			PageId:       binary.LittleEndian.Uint64(data[offset+1+nameLen:]),
+		})
+		offset += 1 + nameLen + directoryPageIdSize
+	}
+
+	end := min(offset+1, len(data))
+	if crc32.ChecksumIEEE(data[directoryChecksumSize:end]) != binary.LittleEndian.Uint32(data) {
+		return nil, fmt.Errorf("%w on page %d", ErrCatalogChecksum, pageId)
+	}
+	return entries, nil
+}
+
+// createDirectoryPage allocates the directory page, writes an empty
+// directory to it and records it in the database metadata
+func (directory *Directory) createDirectoryPage() (uint64, error) {
+	pageId, err := directory.database.AllocatePage(s.PageTypeDirectory)
+	if err != nil {
+		return 0, err
+	}
+	data, err := directory.database.GetPage(pageId)
+	if err != nil {
+		return 0, err
+	}
+	directory.capacity = len(data)
+	empty, err := directory.encodeEntries([]DirectoryEntry{})
+	if err != nil {
+		return 0, err
+	}
+	_, err = directory.database.WriteAt(pageId, 0, empty)
+	if err != nil {
+		return 0, err
+	}
+	return pageId, directory.database.WriteMetaField(s.MetaDirectoryHead, pageId)
+}
+
+// CreateTable stores the schema of a new table in a page of its own and
+// adds the table to the directory. Returns the id of the schema page
+func (directory *Directory) CreateTable(name string, schema Schema) (uint64, error) {
+	if len(name) == 0 || len(name) > maxDirectoryNameBytes {
+		return 0, fmt.Errorf("table name must be between 1 and %d bytes, got %d", maxDirectoryNameBytes, len(name))
+	}
+	if _, ok := directory.schemas[name]; ok {
+		return 0, fmt.Errorf("table %s already exists", name)
+	}
+
+	pageId, err := directory.database.AllocatePage(s.PagetypeSchema)
+	if err != nil {
+		return 0, err
+	}
+	entry := DirectoryEntry{byte(len(name)), name, pageId}
+	directoryData, err := directory.encodeEntries(append(slices.Clone(directory.entries), entry))
+	if err != nil {
+		directory.database.FreePage(pageId)
+		return 0, err
+	}
+	schemaData := schema.GetBinary()
+	schemaData = append(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(schemaData))), schemaData...)
+
+	// the schema and the entry pointing at it commit together
+	txn := directory.database.Begin()
+	txn.Write(pageId, 0, schemaData)
+	txn.Write(directory.pageId, 0, directoryData)
+	_, err = txn.Commit()
+	if err != nil {
+		directory.database.FreePage(pageId)
+		return 0, err
+	}
+
+	directory.addEntry(entry, schema)
+	return pageId, nil
 }
 
-func (directory Directory) addEntry(DirectoryEntry) {
+// DropTable removes a table from the directory and frees its schema page.
+// Nothing changes if the schema page can't be freed, as during a read
+// transaction
+func (directory *Directory) DropTable(name string) error {
+	index := slices.IndexFunc(directory.entries, func(entry DirectoryEntry) bool {
+		return entry.TableName == name
+	})
+	if index == -1 {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+	entry := directory.entries[index]
+
+	entries := slices.Delete(slices.Clone(directory.entries), index, index+1)
+	directoryData, err := directory.encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	txn := directory.database.Begin()
+	txn.Write(directory.pageId, 0, directoryData)
+	txn.Free(entry.PageId)
+	_, err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	directory.entries = entries
+	delete(directory.schemas, name)
+	return nil
+}
+
+// Tables returns the names of the tables in the directory in creation order
+func (directory *Directory) Tables() []string {
+	names := []string{}
+	for _, entry := range directory.entries {
+		names = append(names, entry.TableName)
+	}
+	return names
+}
+
+// Schema returns the schema of a table
+func (directory *Directory) Schema(name string) (Schema, bool) {
+	schema, ok := directory.schemas[name]
+	return schema, ok
+}
+
+func (directory *Directory) addEntry(entry DirectoryEntry, schema Schema) {
+	directory.entries = append(directory.entries, entry)
+	directory.schemas[entry.TableName] = schema
+}
+
+// encodeEntries serializes the entries behind their checksum, followed by
+// the zero length that ends the list. The terminator is left out when the
+// page is exactly full
+func (directory *Directory) encodeEntries(entries []DirectoryEntry) ([]byte, error) {
+	response := make([]byte, directoryChecksumSize)
+	for _, entry := range entries {
+		response = append(response, entry.TableNameLen)
+		response = append(response, entry.TableName...)
+		response = binary.LittleEndian.AppendUint64(response, entry.PageId)
+	}
+	if len(response) > directory.capacity {
+		return nil, fmt.Errorf("directory page is full, %d bytes of entries do not fit in %d", len(response), directory.capacity)
+	}
+	if len(response) < directory.capacity {
+		response = append(response, 0)
+	}
+	binary.LittleEndian.PutUint32(response, crc32.ChecksumIEEE(response[directoryChecksumSize:]))
+	return response, nil
+}
+
+func (directory *Directory) readSchema(pageId uint64) (Schema, error) {
+	schema := Schema{}
+	data, err := directory.database.GetPage(pageId)
+	if err != nil {
+		return schema, err
+	}
+	if len(data) < schemaLengthSize {
+		return schema, fmt.Errorf("schema page %d is too small", pageId)
+	}
+	length := int(binary.LittleEndian.Uint32(data))
+	if length == 0 || schemaLengthSize+length > len(data) {
+		return schema, fmt.Errorf("schema page %d holds an invalid length %d", pageId, length)
+	}
+	schema.ReadBinary(data[schemaLengthSize : schemaLengthSize+length])
+	return schema, nil
+}
+
+// vacuumRemapper points the directory at the schema pages Vacuum moved
+type vacuumRemapper struct {
+	directory *Directory
+}
+
+// RemapPage rewrites the schema page ids in the directory page
+func (remapper vacuumRemapper) RemapPage(pageId uint64, pageType byte, data s.PageData, remap map[uint64]uint64) error {
+	if pageType != s.PageTypeDirectory {
+		return nil
+	}
+	entries, err := decodeEntries(data, pageId)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].PageId = remap[entries[i].PageId]
+	}
+	encoded, err := remapper.directory.encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	copy(data, encoded)
+	return nil
+}
 
+// Remapped moves the directory in memory to the new page ids
+func (remapper vacuumRemapper) Remapped(remap map[uint64]uint64) {
+	directory := remapper.directory
+	directory.pageId = remap[directory.pageId]
+	for i := range directory.entries {
+		directory.entries[i].PageId = remap[directory.entries[i].PageId]
+	}
 }
@@ -0,0 +1,210 @@
+package format
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+
+	s "relationalDatabase/internal/storage"
+)
+
+func newDirectory(t *testing.T) (*s.DatabaseManager, *Directory) {
+	DatabaseManager := &s.DatabaseManager{}
+	err := DatabaseManager.Initialize(1000000, 10)
+	if err != nil {
+		t.Fatal("Failed to initialize database:", err)
+	}
+	directory, err := OpenDirectory(DatabaseManager)
+	if err != nil {
+		t.Fatal("Failed to open directory:", err)
+	}
+	return DatabaseManager, directory
+}
+
+func TestDirectory(t *testing.T) {
+	os.Remove("wal.log")
+	os.Remove("data.db")
+	DatabaseManager, directory := newDirectory(t)
+
+	users := Schema{}
+	users.SetColumns([]Column{
+		newColumn("id", TYPE_INT, 0),
+		newColumn("name", TYPE_VARCHAR, 32),
+	})
+	orders := Schema{}
+	orders.SetColumns([]Column{newColumn("amount", TYPE_INT, 0)})
+
+	usersPage, err := directory.CreateTable("users", users)
+	if err != nil {
+		t.Fatal("Failed to create users table:", err)
+	}
+	_, err = directory.CreateTable("orders", orders)
+	if err != nil {
+		t.Fatal("Failed to create orders table:", err)
+	}
+	_, err = directory.CreateTable("users", orders)
+	if err == nil {
+		t.Error("Expected error creating a table that already exists")
+	}
+
+	// the directory is rebuilt from disk after a restart
+	DatabaseManager.Shutdown()
+	DatabaseManager, directory = newDirectory(t)
+	if !slices.Equal(directory.Tables(), []string{"users", "orders"}) {
+		t.Fatal("Expected users and orders after reopening, got", directory.Tables())
+	}
+	schema, ok := directory.Schema("users")
+	if !ok || schema.String() != users.String() {
+		t.Error("Users schema mismatch after reopening, got", schema.String())
+	}
+
+	err = directory.DropTable("users")
+	if err != nil {
+		t.Fatal("Failed to drop users table:", err)
+	}
+	err = directory.DropTable("users")
+	if err == nil {
+		t.Error("Expected error dropping a table that does not exist")
+	}
+	DatabaseManager.Shutdown()
+	DatabaseManager, directory = newDirectory(t)
+	defer DatabaseManager.Shutdown()
+	if !slices.Equal(directory.Tables(), []string{"orders"}) {
+		t.Fatal("Expected only orders after dropping users, got", directory.Tables())
+	}
+
+	// the freed schema page is reused by the next table
+	pageId, err := directory.CreateTable("customers", users)
+	if err != nil || pageId != usersPage {
+		t.Error("Expected the freed schema page", usersPage, "to be reused, got", pageId, err)
+	}
+}
+
+func TestCatalogChecksum(t *testing.T) {
+	os.Remove("wal.log")
+	os.Remove("data.db")
+	DatabaseManager, directory := newDirectory(t)
+	schema := Schema{}
+	schema.SetColumns([]Column{newColumn("id", TYPE_INT, 0)})
+	_, err := directory.CreateTable("users", schema)
+	if err != nil {
+		t.Fatal("Failed to create users table:", err)
+	}
+
+	// point the entry at another page through an ordinary logged write,
+	// the page checksum stays valid
+	idOffset := directoryChecksumSize + 1 + len("users")
+	_, err = DatabaseManager.WriteAt(directory.pageId, uint32(idOffset), []byte{7})
+	if err != nil {
+		t.Fatal("Failed to write directory page:", err)
+	}
+	DatabaseManager.Shutdown()
+
+	DatabaseManager = &s.DatabaseManager{}
+	err = DatabaseManager.Initialize(1000000, 10)
+	if err != nil {
+		t.Fatal("Failed to initialize database:", err)
+	}
+	defer DatabaseManager.Shutdown()
+	_, err = OpenDirectory(DatabaseManager)
+	if !errors.Is(err, ErrCatalogChecksum) {
+		t.Error("Expected ErrCatalogChecksum for a garbled entry, got", err)
+	}
+}
+
+func TestVacuumDirectory(t *testing.T) {
+	os.Remove("wal.log")
+	os.Remove("data.db")
+	DatabaseManager, directory := newDirectory(t)
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("id", TYPE_INT, 0),
+		newColumn("name", TYPE_VARCHAR, 16),
+	})
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, err := directory.CreateTable(name, schema)
+		if err != nil {
+			t.Fatal("Failed to create table", name, ":", err)
+		}
+	}
+	for _, name := range []string{"a", "c"} {
+		err := directory.DropTable(name)
+		if err != nil {
+			t.Fatal("Failed to drop table", name, ":", err)
+		}
+	}
+
+	err := DatabaseManager.Vacuum()
+	if err != nil {
+		t.Fatal("Vacuum failed:", err)
+	}
+	health := DatabaseManager.Health()
+	if health.Error != "" || health.FreePages != 0 {
+		t.Error("Expected no free pages after vacuuming, got", health.FreePages, health.Error)
+	}
+
+	// the open directory follows its moved pages
+	_, err = directory.CreateTable("e", schema)
+	if err != nil {
+		t.Fatal("Failed to create a table after vacuuming:", err)
+	}
+	err = directory.DropTable("b")
+	if err != nil {
+		t.Fatal("Failed to drop a table after vacuuming:", err)
+	}
+	DatabaseManager.Shutdown()
+
+	DatabaseManager, directory = newDirectory(t)
+	defer DatabaseManager.Shutdown()
+	if !slices.Equal(directory.Tables(), []string{"d", "e"}) {
+		t.Fatal("Expected d and e after reopening, got", directory.Tables())
+	}
+	for _, name := range directory.Tables() {
+		read, ok := directory.Schema(name)
+		if !ok || read.String() != schema.String() {
+			t.Error("Schema of table", name, "mismatch after vacuuming, got", read.String())
+		}
+	}
+}
+
+func TestDropTableDuringRead(t *testing.T) {
+	os.Remove("wal.log")
+	os.Remove("data.db")
+	DatabaseManager, directory := newDirectory(t)
+	defer DatabaseManager.Shutdown()
+	schema := Schema{}
+	schema.SetColumns([]Column{newColumn("id", TYPE_INT, 0)})
+	pageId, err := directory.CreateTable("users", schema)
+	if err != nil {
+		t.Fatal("Failed to create users table:", err)
+	}
+
+	// the schema page can't be freed while a read transaction needs the
+	// WAL, the table stays in place
+	readTxn := DatabaseManager.BeginRead()
+	err = directory.DropTable("users")
+	if err == nil {
+		t.Error("Expected error dropping a table during a read transaction")
+	}
+	if !slices.Equal(directory.Tables(), []string{"users"}) {
+		t.Error("Expected users to remain after the failed drop, got", directory.Tables())
+	}
+	readTxn.End()
+
+	reopened, err := OpenDirectory(DatabaseManager)
+	if err != nil {
+		t.Fatal("Failed to open directory:", err)
+	}
+	if !slices.Equal(reopened.Tables(), []string{"users"}) {
+		t.Fatal("Expected users on disk after the failed drop, got", reopened.Tables())
+	}
+	err = directory.DropTable("users")
+	if err != nil {
+		t.Fatal("Failed to drop users table:", err)
+	}
+	reused, err := directory.CreateTable("orders", schema)
+	if err != nil || reused != pageId {
+		t.Error("Expected the schema page", pageId, "to be freed and reused, got", reused, err)
+	}
+}
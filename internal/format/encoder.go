@@ -0,0 +1,86 @@
+package format
+
+import "fmt"
+
+// RowEncoder serializes rows under a schema. Tables use the encoder
+// selected in their schema, so alternative layouts can be plugged in.
+// Rows passed to Encode have been validated against the schema
+type RowEncoder interface {
+	Encode(row Row, schema Schema) ([]byte, error)
+	Decode(data []byte, schema Schema) (Row, error)
+}
+
+const (
+	ENCODER_FIXED_WIDTH = iota
+)
+
+// encoders maps the encoder id stored in a schema to its implementation
+var encoders = map[byte]RowEncoder{
+	ENCODER_FIXED_WIDTH: FixedWidthEncoder{},
+}
+
+// RegisterEncoder makes an encoder available under the given id
+func RegisterEncoder(id byte, encoder RowEncoder) error {
+	if _, ok := encoders[id]; ok {
+		return fmt.Errorf("encoder %d is already registered", id)
+	}
+	encoders[id] = encoder
+	return nil
+}
+
+// FixedWidthEncoder writes the null bitmap followed by every column at its
+// fixed offset, the default row layout
+type FixedWidthEncoder struct{}
+
+// Encode writes null values as zeroes so later columns stay at their offsets
+func (FixedWidthEncoder) Encode(row Row, schema Schema) ([]byte, error) {
+	if len(row.Columns) != len(schema.columns) {
+		return nil, fmt.Errorf("row has %d columns but schema expects %d", len(row.Columns), len(schema.columns))
+	}
+	return row.encode()
+}
+
+// Decode reads a row, rows too short for the null bitmap are rejected
+func (FixedWidthEncoder) Decode(data []byte, schema Schema) (Row, error) {
+	if len(data) < schema.bitmapSize {
+		return Row{}, &RowLengthError{schema.rowSize, len(data)}
+	}
+	row := Row{}
+	err := row.readBytes(data, schema)
+	return row, err
+}
+
+// SetEncoder selects the registered encoder used for the schema's rows
+func (schema *Schema) SetEncoder(id byte) error {
+	if _, ok := encoders[id]; !ok {
+		return fmt.Errorf("encoder %d is not registered", id)
+	}
+	schema.encoder = id
+	return nil
+}
+
+// Encode validates a row and serializes it with the schema's encoder
+func (schema *Schema) Encode(row Row) ([]byte, error) {
+	encoder, ok := encoders[schema.encoder]
+	if !ok {
+		return nil, fmt.Errorf("encoder %d is not registered", schema.encoder)
+	}
+	err := schema.ValidateRow(row)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.Encode(row, *schema)
+}
+
+// Decode reads a row with the schema's encoder, after checking its length
+func (schema *Schema) Decode(data []byte) (Row, error) {
+	encoder, ok := encoders[schema.encoder]
+	if !ok {
+		return Row{}, fmt.Errorf("encoder %d is not registered", schema.encoder)
+	}
+	err := schema.CheckRowLength(data)
+	if err != nil {
+		return Row{}, err
+	}
+	return encoder.Decode(data, *schema)
+}
@@ -0,0 +1,98 @@
+package format
+
+import (
+	"slices"
+	"testing"
+)
+
+// reversedEncoder stores the fixed width layout back to front
+type reversedEncoder struct{}
+
+func (reversedEncoder) Encode(row Row, schema Schema) ([]byte, error) {
+	data, err := FixedWidthEncoder{}.Encode(row, schema)
+	slices.Reverse(data)
+	return data, err
+}
+
+func (reversedEncoder) Decode(data []byte, schema Schema) (Row, error) {
+	data = slices.Clone(data)
+	slices.Reverse(data)
+	return FixedWidthEncoder{}.Decode(data, schema)
+}
+
+func TestCustomEncoder(t *testing.T) {
+	const EncoderReversed = 200
+	err := RegisterEncoder(EncoderReversed, reversedEncoder{})
+	if err != nil {
+		t.Fatal("Failed to register encoder :", err)
+	}
+	err = RegisterEncoder(EncoderReversed, reversedEncoder{})
+	if err == nil {
+		t.Error("Expected error registering an id twice")
+	}
+
+	schema := Schema{}
+	schema.SetColumns([]Column{newColumn("first", TYPE_INT, 0), newColumn("second", TYPE_INT, 0)})
+	err = schema.SetEncoder(EncoderReversed)
+	if err != nil {
+		t.Fatal("Failed to set encoder :", err)
+	}
+
+	row := schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, int32(258)}})
+	data, err := schema.Encode(row)
+	if err != nil {
+		t.Fatal("Failed to encode row :", err)
+	}
+	if data[len(data)-1] != 0 || data[0] != 0 || data[2] != 1 {
+		t.Error("Expected the reversed layout, got", data)
+	}
+
+	// the encoder choice is stored with the schema
+	stored := Schema{}
+	stored.ReadBinary(schema.GetBinary())
+	readRow, err := stored.Decode(data)
+	if err != nil {
+		t.Fatal("Failed to decode row :", err)
+	}
+	if readRow.Columns[0].Data != int32(1) || readRow.Columns[1].Data != int32(258) {
+		t.Error("Row did not round trip through the encoder, got", readRow.Columns)
+	}
+
+	err = schema.SetEncoder(EncoderReversed + 1)
+	if err == nil {
+		t.Error("Expected error selecting an unregistered encoder")
+	}
+}
+
+func TestEncodeInvalidRow(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{newColumn("first", TYPE_INT, 0), newColumn("second", TYPE_INT, 0)})
+
+	_, err := schema.Encode(schema.NewRow([]Item{{TYPE_INT, int32(1)}}))
+	if err == nil {
+		t.Error("Expected error encoding a row with a missing column")
+	}
+	_, err = schema.Encode(schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, "text"}}))
+	if err == nil {
+		t.Error("Expected error encoding a value of the wrong type")
+	}
+	// the encoder refuses the same rows when called directly
+	_, err = FixedWidthEncoder{}.Encode(Row{Columns: []Item{{TYPE_INT, int32(1)}}}, schema)
+	if err == nil {
+		t.Error("Expected the encoder to refuse a row with a missing column")
+	}
+	_, err = FixedWidthEncoder{}.Encode(Row{Columns: []Item{{TYPE_INT, int32(1)}, {TYPE_INT, "text"}}}, schema)
+	if err == nil {
+		t.Error("Expected the encoder to refuse a value of the wrong type")
+	}
+
+	// data too short for the row is rejected instead of read out of bounds
+	_, err = schema.Decode([]byte{})
+	if err == nil {
+		t.Error("Expected error decoding an empty row")
+	}
+	_, err = FixedWidthEncoder{}.Decode([]byte{}, schema)
+	if err == nil {
+		t.Error("Expected the encoder to refuse an empty row")
+	}
+}
@@ -1,8 +1,12 @@
 package format
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type Row struct {
-	Bitmap  [32]byte
-	Mapsize int
+	Bitmap  []byte // null flags, one bit per column in schema order
 	Columns []Item
 }
 
@@ -11,28 +15,133 @@ type Item struct {
 	Data     any
 }
 
+// getBytes serializes the row in the layout rows are stored in, see encode
 func (row *Row) getBytes() []byte {
-	response := row.Bitmap[:row.Mapsize]
-	for _, column := range row.Columns {
-		value, _ := TYPE_MAP[column.DataType].getBinary(column.Data)
+	response, _ := row.encode()
+	return response
+}
+
+// encode serializes the row in the fixed width layout. A column is null
+// when its data is nil or its bit is set, null columns are flagged in the
+// bitmap and zero filled so later columns keep their offsets
+func (row *Row) encode() ([]byte, error) {
+	bitmap := row.nullBitmap()
+	response := append([]byte{}, bitmap...)
+	for i, column := range row.Columns {
+		datatype, err := typeInfo(column.DataType)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %w", i, err)
+		}
+		if isNull(bitmap, i) {
+			width := int(datatype.defaultSize)
+			if !datatype.fixed {
+				width = lengthPrefixSize
+			}
+			response = append(response, make([]byte, width)...)
+			continue
+		}
+		value, ok := datatype.getBinary(column.Data)
+		if !ok {
+			return nil, fmt.Errorf("column %d value %v is not a valid %s", i, column.Data, datatype.name)
+		}
 		response = append(response, value...)
 	}
-	return response
+	return response, nil
 }
 
-func (row *Row) readBytes(data []byte, schema Schema) {
+// nullBitmap returns a copy of the row's bitmap with the bit of every nil
+// column set, sized for all of the row's columns
+func (row *Row) nullBitmap() []byte {
+	bitmap := make([]byte, max(len(row.Bitmap), (len(row.Columns)+7)/8))
+	copy(bitmap, row.Bitmap)
+	for i, column := range row.Columns {
+		if column.Data == nil {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	return bitmap
+}
+
+// readBytes decodes a row written by getBytes under the given schema. Rows
+// shorter than the schema's row size were written before trailing columns
+// were added, so those columns are filled with their default values.
+// Variable size columns take only the bytes their length prefix says they
+// hold, null columns decode as nil. A length prefix running past the column
+// or the row is an error
+func (row *Row) readBytes(data []byte, schema Schema) error {
 	bytesRead := 0
-	copy(row.Bitmap[:], data[:schema.bitmapSize])
+	row.Bitmap = append([]byte{}, data[:schema.bitmapSize]...)
 	bytesRead += schema.bitmapSize
 	columns := []Item{}
-	for _, column := range schema.columns {
-
+	for i, column := range schema.columns {
 		datatype := TYPE_MAP[column.datatype]
+		width := int(column.length)
+		if !datatype.fixed {
+			width = lengthPrefixSize
+		}
+		if isNull(row.Bitmap, i) {
+			columns = append(columns, Item{column.datatype, nil})
+			bytesRead += width
+			continue
+		}
+		if bytesRead+width > len(data) {
+			columns = append(columns, Item{column.datatype, column.defaultValue})
+			continue
+		}
+
+		if !datatype.fixed {
+			var err error
+			width, err = variableWidth(data, bytesRead, column)
+			if err != nil {
+				return err
+			}
+		}
 		value := datatype.readBinary(data[bytesRead:])
 		columns = append(columns, Item{column.datatype, value})
-		bytesRead += int(column.length)
+		bytesRead += width
 	}
 
 	row.Columns = columns
+	return nil
+}
+
+// variableWidth returns the bytes taken by the variable size column stored
+// at offset, length prefix included, checking the prefix against the
+// column's maximum length and the end of the row
+func variableWidth(data []byte, offset int, column Column) (int, error) {
+	length := int(binary.LittleEndian.Uint16(data[offset:]))
+	if length > int(column.length)-lengthPrefixSize {
+		return 0, fmt.Errorf("column %s holds %d bytes but its maximum is %d", column.name, length, int(column.length)-lengthPrefixSize)
+	}
+	if offset+lengthPrefixSize+length > len(data) {
+		return 0, fmt.Errorf("column %s holds %d bytes past the end of the %d byte row", column.name, length, len(data))
+	}
+	return lengthPrefixSize + length, nil
+}
 
+// CompareKey orders two rows by the given columns in turn, using the
+// comparator of each column's type. Null sorts before any value
+func (row *Row) CompareKey(other Row, columns []int) (int, error) {
+	for _, index := range columns {
+		if index < 0 || index >= len(row.Columns) || index >= len(other.Columns) {
+			return 0, fmt.Errorf("key column %d out of range", index)
+		}
+		item := row.Columns[index]
+		if item.DataType != other.Columns[index].DataType {
+			return 0, fmt.Errorf("key column %d holds different types", index)
+		}
+		result, err := Compare(item.DataType, item.Data, other.Columns[index].Data)
+		if err != nil || result != 0 {
+			return result, err
+		}
+	}
+	return 0, nil
+}
+
+// isNull reports whether the null flag for a column is set in the bitmap
+func isNull(bitmap []byte, index int) bool {
+	if index/8 >= len(bitmap) {
+		return false
+	}
+	return bitmap[index/8]&(1<<(index%8)) != 0
 }
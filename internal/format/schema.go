@@ -2,7 +2,9 @@ package format
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
+	"strings"
 )
 
 type Column struct {
@@ -11,6 +13,16 @@ type Column struct {
 	nullable bool
 	length   int32 // length of column in bytes
 	offset   int   // offset in bytes from start of rowdata including null bitmap
+	// value read for rows written before the column was added
+	defaultValue any
+}
+
+// ColumnLayout describes where a region of a serialized row lives
+type ColumnLayout struct {
+	Name   string // column name, empty for the null bitmap
+	Type   string // type name from TYPE_MAP, "bitmap" for the null bitmap
+	Offset int    // offset in bytes from the start of the row
+	Length int    // width in bytes
 }
 
 type Schema struct {
@@ -18,6 +30,10 @@ type Schema struct {
 	bitmapSize  int
 	rowSize     int
 	columns     []Column
+	// application defined version, compared at open to decide on migrations
+	version uint32
+	// id of the registered RowEncoder used for rows of this schema
+	encoder byte
 }
 
 func (column *Column) SetDataType(dataType byte, length int32) {
@@ -27,6 +43,21 @@ func (column *Column) SetDataType(dataType byte, length int32) {
 	} else {
 		column.length = TYPE_MAP[dataType].defaultSize
 	}
+	// variable size columns are as wide as their longest value
+	if !TYPE_MAP[dataType].fixed {
+		column.length += lengthPrefixSize
+	}
+}
+
+// SetDefault sets the value substituted for this column when reading rows
+// that were written before the column was added to the schema
+func (column *Column) SetDefault(value any) error {
+	_, ok := TYPE_MAP[column.datatype].getBinary(value)
+	if !ok {
+		return fmt.Errorf("default value %v does not match type %s", value, TYPE_MAP[column.datatype].name)
+	}
+	column.defaultValue = value
+	return nil
 }
 
 func (column *Column) GetBinary() []byte {
@@ -44,6 +75,14 @@ func (column *Column) GetBinary() []byte {
 		response = binary.LittleEndian.AppendUint16(response, uint16(column.length))
 	}
 
+	if column.defaultValue != nil {
+		value, _ := TYPE_MAP[column.datatype].getBinary(column.defaultValue)
+		response = append(response, 1)
+		response = append(response, value...)
+	} else {
+		response = append(response, 0)
+	}
+
 	return response
 }
 
@@ -55,10 +94,10 @@ func (column *Column) ReadBinary(data []byte) int {
 	column.name = string(data[bytesRead : bytesRead+int(nameLen)])
 	bytesRead += int(nameLen)
 
-	column.datatype = data[nameLen]
+	column.datatype = data[bytesRead]
 	bytesRead++
 
-	column.nullable = data[nameLen+1] == 1
+	column.nullable = data[bytesRead] == 1
 	bytesRead++
 
 	if TYPE_MAP[column.datatype].allowUserLength {
@@ -68,13 +107,31 @@ func (column *Column) ReadBinary(data []byte) int {
 		column.length = TYPE_MAP[column.datatype].defaultSize
 	}
 
+	hasDefault := data[bytesRead] == 1
+	bytesRead++
+	if hasDefault {
+		column.defaultValue = TYPE_MAP[column.datatype].readBinary(data[bytesRead:])
+		value, _ := TYPE_MAP[column.datatype].getBinary(column.defaultValue)
+		bytesRead += len(value)
+	}
+
 	return bytesRead
 }
 
+// SetVersion sets the application defined schema version stored with the schema
+func (schema *Schema) SetVersion(version uint32) {
+	schema.version = version
+}
+
+// Version returns the stored schema version, 0 if none was set
+func (schema *Schema) Version() uint32 {
+	return schema.version
+}
+
 func (schema *Schema) SetColumns(columns []Column) {
 	schema.columns = columns
 	schema.columnCount = byte(len(columns))
-	schema.bitmapSize = int(math.Ceil(float64(len(schema.columns) / 8)))
+	schema.bitmapSize = (len(schema.columns) + 7) / 8
 	schema.rowSize = schema.bitmapSize
 	for i, column := range schema.columns {
 		schema.columns[i].offset = schema.rowSize
@@ -82,12 +139,375 @@ func (schema *Schema) SetColumns(columns []Column) {
 	}
 }
 
+// NewRow returns a row holding the given items with a null bitmap
+// sized for the schema
+func (schema *Schema) NewRow(items []Item) Row {
+	return Row{Bitmap: make([]byte, schema.bitmapSize), Columns: items}
+}
+
+// Layout returns the null bitmap followed by every column with the
+// offsets and widths computed in SetColumns
+func (schema *Schema) Layout() []ColumnLayout {
+	response := []ColumnLayout{{"", "bitmap", 0, schema.bitmapSize}}
+	for _, column := range schema.columns {
+		response = append(response, ColumnLayout{column.name, TYPE_MAP[column.datatype].name, column.offset, int(column.length)})
+	}
+	return response
+}
+
+// DropColumn returns a copy of the schema without the named column,
+// with offsets, bitmap size and row size recomputed for the new layout
+func (schema *Schema) DropColumn(name string) (Schema, error) {
+	columns := []Column{}
+	found := false
+	for _, column := range schema.columns {
+		if column.name == name {
+			found = true
+			continue
+		}
+		columns = append(columns, column)
+	}
+	if !found {
+		return Schema{}, fmt.Errorf("column %s not found in schema", name)
+	}
+
+	response := Schema{version: schema.version, encoder: schema.encoder}
+	response.SetColumns(columns)
+	return response, nil
+}
+
+// AddColumn returns a copy of the schema with the column appended.
+// Rows written under the old layout are read with the column's default
+func (schema *Schema) AddColumn(newColumn Column) (Schema, error) {
+	if len(schema.columns) >= math.MaxUint8 {
+		return Schema{}, fmt.Errorf("schema already has the maximum of %d columns", math.MaxUint8)
+	}
+	for _, column := range schema.columns {
+		if column.name == newColumn.name {
+			return Schema{}, fmt.Errorf("column %s already exists in schema", newColumn.name)
+		}
+	}
+
+	columns := append([]Column{}, schema.columns...)
+	columns = append(columns, newColumn)
+
+	response := Schema{version: schema.version, encoder: schema.encoder}
+	response.SetColumns(columns)
+	return response, nil
+}
+
+// MigrateRow rewrites a row stored under oldSchema into this schema's layout,
+// growing the null bitmap as needed. Columns are matched by name, columns
+// missing from the old schema take their default or null. Errors if a
+// column changed type or a new non nullable column has no default
+func (schema *Schema) MigrateRow(oldRow []byte, oldSchema Schema) ([]byte, error) {
+	err := oldSchema.CheckRowLength(oldRow)
+	if err != nil {
+		return nil, err
+	}
+	old, err := oldSchema.Decode(oldRow)
+	if err != nil {
+		return nil, err
+	}
+
+	row := schema.NewRow(make([]Item, len(schema.columns)))
+	for i, column := range schema.columns {
+		item := Item{column.datatype, column.defaultValue}
+		for j, oldColumn := range oldSchema.columns {
+			if oldColumn.name != column.name {
+				continue
+			}
+			if oldColumn.datatype != column.datatype {
+				return nil, fmt.Errorf("column %s changed type from %s to %s", column.name, TYPE_MAP[oldColumn.datatype].name, TYPE_MAP[column.datatype].name)
+			}
+			item.Data = old.Columns[j].Data
+			if isNull(old.Bitmap, j) {
+				item.Data = nil
+			}
+		}
+		if item.Data == nil {
+			if !column.nullable {
+				return nil, fmt.Errorf("column %s is not nullable and has no value", column.name)
+			}
+			row.Bitmap[i/8] |= 1 << (i % 8)
+		}
+		row.Columns[i] = item
+	}
+	return schema.Encode(row)
+}
+
+// ValidateRow checks a row against the schema before it is stored and
+// returns an error describing the first violation found
+func (schema *Schema) ValidateRow(row Row) error {
+	if len(row.Columns) != len(schema.columns) {
+		return fmt.Errorf("row has %d columns but schema expects %d", len(row.Columns), len(schema.columns))
+	}
+	for i, column := range schema.columns {
+		item := row.Columns[i]
+		if item.DataType != column.datatype {
+			datatype, err := typeInfo(item.DataType)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column.name, err)
+			}
+			return fmt.Errorf("column %s expects type %s but got %s", column.name, TYPE_MAP[column.datatype].name, datatype.name)
+		}
+		if item.Data == nil {
+			if !column.nullable {
+				return fmt.Errorf("column %s is not nullable", column.name)
+			}
+			continue
+		}
+		value, ok := TYPE_MAP[column.datatype].getBinary(item.Data)
+		if !ok {
+			return fmt.Errorf("column %s value %v is not a valid %s", column.name, item.Data, TYPE_MAP[column.datatype].name)
+		}
+		if len(value) > int(column.length) {
+			return fmt.Errorf("column %s value is %d bytes but column length is %d", column.name, len(value), column.length)
+		}
+	}
+	return nil
+}
+
+// ReadColumn decodes a single column from serialized row data using its
+// precomputed offset, without decoding the rest of the row. Null values
+// decode as nil and columns missing from short rows decode as their default
+func (schema *Schema) ReadColumn(data []byte, columnIndex int) (any, error) {
+	if columnIndex < 0 || columnIndex >= len(schema.columns) {
+		return nil, fmt.Errorf("column index %d out of range for %d columns", columnIndex, len(schema.columns))
+	}
+	if len(data) < schema.bitmapSize {
+		return nil, fmt.Errorf("row data of %d bytes is shorter than the null bitmap", len(data))
+	}
+	if isNull(data[:schema.bitmapSize], columnIndex) {
+		return nil, nil
+	}
+	// offsets past a variable size column depend on the row
+	for _, column := range schema.columns[:columnIndex] {
+		if !TYPE_MAP[column.datatype].fixed {
+			row := Row{}
+			err := row.readBytes(data, *schema)
+			if err != nil {
+				return nil, err
+			}
+			return row.Columns[columnIndex].Data, nil
+		}
+	}
+	// a variable size column only needs its length prefix in the row
+	column := schema.columns[columnIndex]
+	datatype := TYPE_MAP[column.datatype]
+	width := int(column.length)
+	if !datatype.fixed {
+		width = lengthPrefixSize
+	}
+	if column.offset+width > len(data) {
+		return column.defaultValue, nil
+	}
+	if !datatype.fixed {
+		_, err := variableWidth(data, column.offset, column)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return datatype.readBinary(data[column.offset:]), nil
+}
+
+// RowLengthError reports a stored row whose length doesn't fit the schema,
+// usually because it was written under a different schema
+type RowLengthError struct {
+	Expected int // row size of the schema
+	Actual   int // length of the stored row
+}
+
+func (err *RowLengthError) Error() string {
+	return fmt.Sprintf("row is %d bytes but schema expects %d", err.Actual, err.Expected)
+}
+
+// CheckRowLength returns a RowLengthError if stored row data can't have been
+// written under this schema. Rows that end at a column boundary are accepted
+// when every missing column has a default, as written before AddColumn.
+// Only the fixed width encoder has a known length, other encoders pass.
+// Rows with variable size columns only need to fit within the row size
+func (schema *Schema) CheckRowLength(data []byte) error {
+	if schema.encoder != ENCODER_FIXED_WIDTH || len(data) == schema.rowSize {
+		return nil
+	}
+	if schema.hasVariableColumns() {
+		if len(data) < schema.bitmapSize || len(data) > schema.rowSize {
+			return &RowLengthError{schema.rowSize, len(data)}
+		}
+		return nil
+	}
+	if len(data) < schema.rowSize {
+		for i, column := range schema.columns {
+			if column.offset != len(data) {
+				continue
+			}
+			for _, missing := range schema.columns[i:] {
+				if missing.defaultValue == nil {
+					return &RowLengthError{schema.rowSize, len(data)}
+				}
+			}
+			return nil
+		}
+	}
+	return &RowLengthError{schema.rowSize, len(data)}
+}
+
+// hasVariableColumns reports whether any column holds a variable size type
+func (schema *Schema) hasVariableColumns() bool {
+	for _, column := range schema.columns {
+		if !TYPE_MAP[column.datatype].fixed {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanRows decodes stored rows in order and passes each to visit. A row
+// that fails CheckRowLength is passed with its error instead of being
+// decoded, so one bad row doesn't stop the scan. Returning false from
+// visit ends the scan
+func (schema *Schema) ScanRows(rows [][]byte, visit func(index int, row Row, err error) bool) {
+	for i, data := range rows {
+		err := schema.CheckRowLength(data)
+		if err != nil {
+			if !visit(i, Row{}, err) {
+				return
+			}
+			continue
+		}
+		row, err := schema.Decode(data)
+		if !visit(i, row, err) {
+			return
+		}
+	}
+}
+
+// ColumnCursor iterates over the values of one column across stored rows,
+// decoding only that column of each row
+type ColumnCursor struct {
+	schema   *Schema
+	rows     [][]byte
+	column   int // index of the projected column
+	position int // index of the next row
+	value    any
+	err      error
+}
+
+// Project returns a cursor over the named column of the stored rows, for
+// aggregations that don't need the rest of each row
+func (schema *Schema) Project(rows [][]byte, columnName string) (*ColumnCursor, error) {
+	for i, column := range schema.columns {
+		if column.name == columnName {
+			return &ColumnCursor{schema: schema, rows: rows, column: i}, nil
+		}
+	}
+	return nil, fmt.Errorf("column %s not found in schema", columnName)
+}
+
+// Next decodes the column of the next row and reports whether there was one.
+// The cursor stops at the first row that doesn't fit the schema, see Err
+func (cursor *ColumnCursor) Next() bool {
+	if cursor.err != nil || cursor.position >= len(cursor.rows) {
+		return false
+	}
+	data := cursor.rows[cursor.position]
+	cursor.err = cursor.schema.CheckRowLength(data)
+	if cursor.err == nil {
+		cursor.value, cursor.err = cursor.schema.ReadColumn(data, cursor.column)
+	}
+	if cursor.err != nil {
+		cursor.err = fmt.Errorf("row %d: %w", cursor.position, cursor.err)
+		return false
+	}
+	cursor.position++
+	return true
+}
+
+// Value returns the value decoded by the last call to Next, nil for null
+func (cursor *ColumnCursor) Value() any {
+	return cursor.value
+}
+
+// Err returns the error that stopped the cursor, nil if it ran out of rows
+func (cursor *ColumnCursor) Err() error {
+	return cursor.err
+}
+
+// RowSize returns the number of bytes the row takes once serialized,
+// as opposed to rowSize which is the maximum for the schema. Null columns
+// take their zero filled width
+func (schema *Schema) RowSize(row Row) (int, error) {
+	if len(row.Columns) != len(schema.columns) {
+		return 0, fmt.Errorf("row has %d columns but schema expects %d", len(row.Columns), len(schema.columns))
+	}
+	size := schema.bitmapSize
+	for i, item := range row.Columns {
+		datatype, err := typeInfo(item.DataType)
+		if err != nil {
+			return 0, fmt.Errorf("column %s: %w", schema.columns[i].name, err)
+		}
+		if item.Data == nil || isNull(row.Bitmap, i) {
+			width := int(schema.columns[i].length)
+			if !datatype.fixed {
+				width = lengthPrefixSize
+			}
+			size += width
+			continue
+		}
+		value, ok := datatype.getBinary(item.Data)
+		if !ok {
+			return 0, fmt.Errorf("column %s value %v is not a valid %s", schema.columns[i].name, item.Data, datatype.name)
+		}
+		size += len(value)
+	}
+	return size, nil
+}
+
+// String renders the column definitions the way they would appear in a
+// CREATE TABLE statement, for logs and debugging
+func (schema *Schema) String() string {
+	definitions := []string{}
+	for _, column := range schema.columns {
+		definitions = append(definitions, column.String())
+	}
+	return "(\n\t" + strings.Join(definitions, ",\n\t") + "\n)"
+}
+
+// DDL renders the schema as a CREATE TABLE statement for the given table
+func (schema *Schema) DDL(tableName string) string {
+	return fmt.Sprintf("CREATE TABLE %s %s", tableName, schema.String())
+}
+
+// String renders a single column definition with its type, user defined
+// length, nullability and default
+func (column *Column) String() string {
+	datatype := TYPE_MAP[column.datatype]
+	response := column.name + " " + datatype.name
+	if datatype.allowUserLength {
+		length := column.length
+		if !datatype.fixed {
+			length -= lengthPrefixSize
+		}
+		response += fmt.Sprintf("(%d)", length/datatype.defaultSize)
+	}
+	if !column.nullable {
+		response += " NOT NULL"
+	}
+	if column.defaultValue != nil {
+		response += fmt.Sprintf(" DEFAULT %v", column.defaultValue)
+	}
+	return response
+}
+
 func (schema *Schema) GetBinary() []byte {
 	response := []byte{}
 	response = append(response, schema.columnCount)
 	for _, column := range schema.columns {
 		response = append(response, column.GetBinary()...)
 	}
+	response = binary.LittleEndian.AppendUint32(response, schema.version)
+	response = append(response, schema.encoder)
 
 	return response
 }
@@ -104,5 +524,16 @@ func (schema *Schema) ReadBinary(data []byte) {
 		columns = append(columns, column)
 	}
 
+	// schemas written before versioning end after the columns
+	schema.version = 0
+	if len(data) >= bytesRead+4 {
+		schema.version = binary.LittleEndian.Uint32(data[bytesRead:])
+		bytesRead += 4
+	}
+	schema.encoder = ENCODER_FIXED_WIDTH
+	if len(data) > bytesRead {
+		schema.encoder = data[bytesRead]
+	}
+
 	schema.SetColumns(columns)
 }
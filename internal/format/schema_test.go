@@ -0,0 +1,688 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newColumn(name string, dataType byte, length int32) Column {
+	column := Column{name: name}
+	column.SetDataType(dataType, length)
+	return column
+}
+
+func TestDropColumn(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("first", TYPE_INT, 0),
+		newColumn("second", TYPE_INT, 0),
+		newColumn("third", TYPE_INT, 0),
+	})
+
+	newSchema, err := schema.DropColumn("second")
+	if err != nil {
+		t.Fatal("Failed to drop column :", err)
+	}
+
+	if newSchema.columnCount != 2 || len(newSchema.columns) != 2 {
+		t.Fatal("Expected 2 columns after drop, got", newSchema.columnCount)
+	}
+	if newSchema.columns[1].name != "third" {
+		t.Fatal("Expected third column to follow first, got", newSchema.columns[1].name)
+	}
+	if newSchema.columns[1].offset != schema.columns[1].offset {
+		t.Error("Expected third column at offset", schema.columns[1].offset, "but got", newSchema.columns[1].offset)
+	}
+	if newSchema.rowSize != schema.rowSize-int(schema.columns[1].length) {
+		t.Error("Row size not recomputed, got", newSchema.rowSize)
+	}
+
+	// the original schema must be left untouched
+	if schema.columns[2].offset != schema.columns[1].offset+int(schema.columns[1].length) {
+		t.Error("Original schema offsets were modified")
+	}
+
+	_, err = schema.DropColumn("missing")
+	if err == nil {
+		t.Error("Expected error dropping a missing column")
+	}
+}
+
+func TestAddColumnDefault(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("first", TYPE_INT, 0),
+		newColumn("second", TYPE_INT, 0),
+	})
+
+	row := schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, int32(2)}})
+	data := row.getBytes()
+
+	column := newColumn("third", TYPE_INT, 0)
+	err := column.SetDefault(int32(7))
+	if err != nil {
+		t.Fatal("Failed to set default :", err)
+	}
+	newSchema, err := schema.AddColumn(column)
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+	if newSchema.columns[2].offset != schema.rowSize {
+		t.Error("Expected new column at offset", schema.rowSize, "but got", newSchema.columns[2].offset)
+	}
+
+	// read the old layout row under the new schema
+	readRow := Row{}
+	readRow.readBytes(data, newSchema)
+	if len(readRow.Columns) != 3 {
+		t.Fatal("Expected 3 columns, got", len(readRow.Columns))
+	}
+	if readRow.Columns[0].Data != int32(1) || readRow.Columns[1].Data != int32(2) {
+		t.Error("Existing column values changed", readRow.Columns)
+	}
+	if readRow.Columns[2].Data != int32(7) {
+		t.Error("Expected default 7 for new column, got", readRow.Columns[2].Data)
+	}
+
+	// the default must survive serialization
+	readSchema := Schema{}
+	readSchema.ReadBinary(newSchema.GetBinary())
+	if readSchema.columns[2].name != "third" || readSchema.columns[2].defaultValue != int32(7) {
+		t.Error("Default lost in schema serialization", readSchema.columns[2])
+	}
+
+	_, err = newSchema.AddColumn(column)
+	if err == nil {
+		t.Error("Expected error adding a duplicate column")
+	}
+}
+
+func TestValidateRow(t *testing.T) {
+	nullable := newColumn("nullable", TYPE_INT, 0)
+	nullable.nullable = true
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("required", TYPE_INT, 0),
+		nullable,
+	})
+
+	valid := Row{Columns: []Item{{TYPE_INT, int32(1)}, {TYPE_INT, nil}}}
+	err := schema.ValidateRow(valid)
+	if err != nil {
+		t.Error("Expected valid row to pass, got", err)
+	}
+
+	wrongType := Row{Columns: []Item{{TYPE_INT, "text"}, {TYPE_INT, int32(2)}}}
+	err = schema.ValidateRow(wrongType)
+	if err == nil {
+		t.Error("Expected error for wrong value type")
+	}
+
+	missingColumn := Row{Columns: []Item{{TYPE_INT, int32(1)}}}
+	err = schema.ValidateRow(missingColumn)
+	if err == nil {
+		t.Error("Expected error for missing column")
+	}
+
+	nullRequired := Row{Columns: []Item{{TYPE_INT, nil}, {TYPE_INT, int32(2)}}}
+	err = schema.ValidateRow(nullRequired)
+	if err == nil {
+		t.Error("Expected error for null in a not null column")
+	}
+
+	// a type id outside TYPE_MAP is rejected rather than looked up
+	unknownType := Row{Columns: []Item{{TYPE_INT, int32(1)}, {200, int32(2)}}}
+	err = schema.ValidateRow(unknownType)
+	if err == nil || !strings.Contains(err.Error(), "unknown type id 200") {
+		t.Error("Expected an unknown type id error, got", err)
+	}
+	_, err = schema.RowSize(unknownType)
+	if err == nil {
+		t.Error("Expected error sizing a row with an unknown type")
+	}
+	_, err = unknownType.encode()
+	if err == nil {
+		t.Error("Expected error encoding a row with an unknown type")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("first", TYPE_INT, 0),
+		newColumn("second", TYPE_INT, 0),
+		newColumn("third", TYPE_INT, 0),
+	})
+
+	layout := schema.Layout()
+	if len(layout) != 4 {
+		t.Fatal("Expected bitmap and 3 columns in layout, got", len(layout))
+	}
+	if layout[0].Type != "bitmap" || layout[0].Offset != 0 || layout[0].Length != schema.bitmapSize {
+		t.Error("Unexpected bitmap layout", layout[0])
+	}
+
+	// columns start after the bitmap and are contiguous
+	end := layout[0].Length
+	for i, column := range layout[1:] {
+		if column.Name != schema.columns[i].name || column.Type != "int" {
+			t.Error("Unexpected column in layout", column)
+		}
+		if column.Offset != end {
+			t.Error("Column", column.Name, "expected at offset", end, "but got", column.Offset)
+		}
+		end = column.Offset + column.Length
+	}
+	if end != schema.rowSize {
+		t.Error("Layout ends at", end, "but row size is", schema.rowSize)
+	}
+}
+
+func TestRowSize(t *testing.T) {
+	nullable := newColumn("nullable", TYPE_INT, 0)
+	nullable.nullable = true
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("first", TYPE_INT, 0),
+		newColumn("second", TYPE_INT, 0),
+		nullable,
+	})
+
+	rows := []Row{
+		schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, int32(2)}, {TYPE_INT, int32(3)}}),
+		schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, int32(2)}, {TYPE_INT, nil}}),
+	}
+	for _, row := range rows {
+		size, err := schema.RowSize(row)
+		if err != nil {
+			t.Fatal("Failed to estimate row size :", err)
+		}
+		if size != len(row.getBytes()) {
+			t.Error("Estimated", size, "bytes but row serialized to", len(row.getBytes()))
+		}
+	}
+
+	_, err := schema.RowSize(Row{Columns: []Item{{TYPE_INT, "text"}, {TYPE_INT, int32(2)}, {TYPE_INT, nil}}})
+	if err == nil {
+		t.Error("Expected error for a value of the wrong type")
+	}
+}
+
+func wideSchema(count int) (Schema, []byte) {
+	columns := []Column{}
+	items := []Item{}
+	for i := 0; i < count; i++ {
+		columns = append(columns, newColumn(fmt.Sprint("column", i), TYPE_INT, 0))
+		items = append(items, Item{TYPE_INT, int32(i)})
+	}
+	schema := Schema{}
+	schema.SetColumns(columns)
+	row := schema.NewRow(items)
+	return schema, row.getBytes()
+}
+
+func TestReadColumn(t *testing.T) {
+	schema, data := wideSchema(20)
+
+	for i := range schema.columns {
+		value, err := schema.ReadColumn(data, i)
+		if err != nil {
+			t.Fatal("Failed to read column", i, ":", err)
+		}
+		if value != int32(i) {
+			t.Error("Expected", i, "for column", i, "but got", value)
+		}
+	}
+
+	// a set null flag decodes as nil without reading the value
+	data[0] |= 1 << 3
+	value, err := schema.ReadColumn(data, 3)
+	if err != nil || value != nil {
+		t.Error("Expected nil for a null column, got", value, err)
+	}
+
+	_, err = schema.ReadColumn(data, 20)
+	if err == nil {
+		t.Error("Expected error for a column index out of range")
+	}
+}
+
+func BenchmarkReadColumn(b *testing.B) {
+	schema, data := wideSchema(64)
+	for b.Loop() {
+		schema.ReadColumn(data, 40)
+	}
+}
+
+func BenchmarkReadFullRow(b *testing.B) {
+	schema, data := wideSchema(64)
+	for b.Loop() {
+		row := Row{}
+		row.readBytes(data, schema)
+		_ = row.Columns[40].Data
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("first", TYPE_INT, 0),
+		newColumn("second", TYPE_INT, 0),
+	})
+	schema.SetVersion(7)
+
+	stored := Schema{}
+	stored.ReadBinary(schema.GetBinary())
+	if stored.Version() != 7 {
+		t.Error("Expected version 7 after reading back, got", stored.Version())
+	}
+	if stored.columnCount != 2 || stored.rowSize != schema.rowSize {
+		t.Error("Columns not read back alongside the version")
+	}
+
+	// layout changes keep the version for the application to bump
+	added, err := stored.AddColumn(newColumn("third", TYPE_INT, 0))
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+	if added.Version() != 7 {
+		t.Error("Expected version to carry over to the new schema, got", added.Version())
+	}
+
+	// schemas stored before versioning read as version 0
+	data := schema.GetBinary()
+	legacy := Schema{}
+	legacy.ReadBinary(data[:len(data)-5])
+	if legacy.Version() != 0 || legacy.columnCount != 2 {
+		t.Error("Expected an unversioned schema to read as version 0, got", legacy.Version())
+	}
+}
+
+func TestNullBitmap(t *testing.T) {
+	schema, _ := wideSchema(20)
+	if schema.bitmapSize != 3 {
+		t.Fatal("Expected a 3 byte bitmap for 20 columns, got", schema.bitmapSize)
+	}
+	exact, _ := wideSchema(16)
+	if exact.bitmapSize != 2 {
+		t.Fatal("Expected a 2 byte bitmap for 16 columns, got", exact.bitmapSize)
+	}
+
+	items := []Item{}
+	for i := 0; i < 20; i++ {
+		items = append(items, Item{TYPE_INT, int32(i)})
+	}
+	row := schema.NewRow(items)
+	nulls := map[int]bool{0: true, 9: true, 17: true, 19: true}
+	for index := range nulls {
+		row.Columns[index].Data = nil
+	}
+
+	// null columns are flagged in the bitmap and zero filled
+	data := row.getBytes()
+	if len(data) != schema.rowSize {
+		t.Fatal("Expected", schema.rowSize, "bytes but got", len(data))
+	}
+	readRow := Row{}
+	readRow.readBytes(data, schema)
+	if len(readRow.Bitmap) != schema.bitmapSize {
+		t.Fatal("Expected a", schema.bitmapSize, "byte bitmap but got", len(readRow.Bitmap))
+	}
+	for i := 0; i < 20; i++ {
+		if isNull(readRow.Bitmap, i) != nulls[i] {
+			t.Error("Null flag for column", i, "did not round trip")
+		}
+		if nulls[i] && readRow.Columns[i].Data != nil {
+			t.Error("Expected null for column", i, "but got", readRow.Columns[i].Data)
+		}
+		if !nulls[i] && readRow.Columns[i].Data != int32(i) {
+			t.Error("Expected", i, "for column", i, "but got", readRow.Columns[i].Data)
+		}
+	}
+
+	// serializing must not write into the row's bitmap
+	if string(row.getBytes()) != string(data) || len(row.Bitmap) != schema.bitmapSize || row.Bitmap[0] != 0 {
+		t.Error("Serializing changed the row's bitmap")
+	}
+}
+
+func TestSchemaString(t *testing.T) {
+	nullable := newColumn("nickname", TYPE_INT, 0)
+	nullable.nullable = true
+	withDefault := newColumn("score", TYPE_INT, 0)
+	err := withDefault.SetDefault(int32(10))
+	if err != nil {
+		t.Fatal("Failed to set default :", err)
+	}
+	schema := Schema{}
+	schema.SetColumns([]Column{newColumn("id", TYPE_INT, 0), nullable, withDefault})
+
+	expected := "CREATE TABLE users (\n\tid int NOT NULL,\n\tnickname int,\n\tscore int NOT NULL DEFAULT 10\n)"
+	if schema.DDL("users") != expected {
+		t.Error("Expected\n", expected, "\nbut got\n", schema.DDL("users"))
+	}
+	for _, column := range schema.columns {
+		if !strings.Contains(schema.String(), column.name+" "+TYPE_MAP[column.datatype].name) {
+			t.Error("Expected column", column.name, "with its type in", schema.String())
+		}
+	}
+}
+
+func TestScanRowLengthMismatch(t *testing.T) {
+	columns := []Column{
+		newColumn("first", TYPE_INT, 0),
+		newColumn("second", TYPE_INT, 0),
+		newColumn("third", TYPE_INT, 0),
+	}
+	oldSchema := Schema{}
+	oldSchema.SetColumns(columns)
+	newSchema, err := oldSchema.AddColumn(newColumn("fourth", TYPE_INT, 0))
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+
+	oldRow := oldSchema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, int32(2)}, {TYPE_INT, int32(3)}})
+	newRow := newSchema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_INT, int32(2)}, {TYPE_INT, int32(3)}, {TYPE_INT, int32(4)}})
+	rows := [][]byte{newRow.getBytes(), oldRow.getBytes(), newRow.getBytes()}
+
+	visited := 0
+	newSchema.ScanRows(rows, func(index int, row Row, err error) bool {
+		visited++
+		if index == 1 {
+			lengthErr := &RowLengthError{}
+			if !errors.As(err, &lengthErr) {
+				t.Fatal("Expected a row length error for the old row, got", err)
+			}
+			if lengthErr.Expected != newSchema.rowSize || lengthErr.Actual != oldSchema.rowSize {
+				t.Error("Expected", newSchema.rowSize, "and", oldSchema.rowSize, "in the error, got", lengthErr)
+			}
+			return true
+		}
+		if err != nil {
+			t.Fatal("Unexpected error for row", index, ":", err)
+		}
+		if row.Columns[3].Data != int32(4) {
+			t.Error("Expected 4 in the fourth column, got", row.Columns[3].Data)
+		}
+		return true
+	})
+	if visited != 3 {
+		t.Error("Expected the scan to continue past the bad row, visited", visited)
+	}
+
+	// a default for the added column makes the old row valid
+	defaulted := newColumn("fourth", TYPE_INT, 0)
+	err = defaulted.SetDefault(int32(0))
+	if err != nil {
+		t.Fatal("Failed to set default :", err)
+	}
+	migrated, err := oldSchema.AddColumn(defaulted)
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+	if err := migrated.CheckRowLength(oldRow.getBytes()); err != nil {
+		t.Error("Expected an old row to be valid with a default, got", err)
+	}
+	if err := migrated.CheckRowLength(oldRow.getBytes()[:5]); err == nil {
+		t.Error("Expected a truncated row to be reported")
+	}
+}
+
+func TestVarchar(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("id", TYPE_INT, 0),
+		newColumn("name", TYPE_VARCHAR, 20),
+		newColumn("age", TYPE_INT, 0),
+	})
+	row := schema.NewRow([]Item{{TYPE_INT, int32(7)}, {TYPE_VARCHAR, "héllo"}, {TYPE_INT, int32(42)}})
+	err := schema.ValidateRow(row)
+	if err != nil {
+		t.Fatal("Expected row to be valid:", err)
+	}
+
+	data := row.getBytes()
+	if len(data) != schema.bitmapSize+4+2+len("héllo")+4 {
+		t.Fatal("Expected varchar to take only its length, got a row of", len(data), "bytes")
+	}
+	err = schema.CheckRowLength(data)
+	if err != nil {
+		t.Fatal("Expected a short varchar row to fit the schema:", err)
+	}
+
+	decoded := Row{}
+	decoded.readBytes(data, schema)
+	if decoded.Columns[0].Data != int32(7) || decoded.Columns[1].Data != "héllo" || decoded.Columns[2].Data != int32(42) {
+		t.Fatal("Round trip mismatch, got", decoded.Columns)
+	}
+	value, err := schema.ReadColumn(data, 2)
+	if err != nil || value != int32(42) {
+		t.Error("Expected column after the varchar to read 42, got", value, err)
+	}
+	// a value shorter than the column's maximum still reads back
+	value, err = schema.ReadColumn(data, 1)
+	if err != nil || value != "héllo" {
+		t.Error("Expected the short varchar to read back, got", value, err)
+	}
+	cursor, err := schema.Project([][]byte{data}, "name")
+	if err != nil {
+		t.Fatal("Failed to project name:", err)
+	}
+	if !cursor.Next() || cursor.Value() != "héllo" {
+		t.Error("Expected to project the short varchar, got", cursor.Value(), cursor.Err())
+	}
+
+	// a corrupt length prefix is an error rather than a truncated value
+	prefix := schema.columns[1].offset
+	for _, length := range []uint16{21, 19} {
+		corrupt := bytes.Clone(data)
+		binary.LittleEndian.PutUint16(corrupt[prefix:], length)
+		_, err = schema.Decode(corrupt)
+		if err == nil {
+			t.Error("Expected error decoding a varchar length of", length)
+		}
+		_, err = schema.ReadColumn(corrupt, 1)
+		if err == nil {
+			t.Error("Expected error reading a varchar length of", length)
+		}
+		_, err = schema.ReadColumn(corrupt, 2)
+		if err == nil {
+			t.Error("Expected error reading past a varchar length of", length)
+		}
+	}
+
+	if schema.columns[1].String() != "name varchar(20) NOT NULL" {
+		t.Error("Unexpected column definition", schema.columns[1].String())
+	}
+	row.Columns[1].Data = strings.Repeat("x", 21)
+	err = schema.ValidateRow(row)
+	if err == nil {
+		t.Error("Expected error for a value longer than the column")
+	}
+}
+
+func projectRows(count int) (Schema, [][]byte) {
+	schema, _ := wideSchema(16)
+	rows := [][]byte{}
+	for i := range count {
+		items := []Item{}
+		for j := range 16 {
+			items = append(items, Item{TYPE_INT, int32(i * j)})
+		}
+		row := schema.NewRow(items)
+		rows = append(rows, row.getBytes())
+	}
+	return schema, rows
+}
+
+func TestProject(t *testing.T) {
+	schema, rows := projectRows(100)
+	cursor, err := schema.Project(rows, "column5")
+	if err != nil {
+		t.Fatal("Failed to project column:", err)
+	}
+	count := 0
+	for cursor.Next() {
+		full := Row{}
+		full.readBytes(rows[count], schema)
+		if cursor.Value() != full.Columns[5].Data {
+			t.Error("Row", count, "projected", cursor.Value(), "but the full row holds", full.Columns[5].Data)
+		}
+		count++
+	}
+	if cursor.Err() != nil || count != len(rows) {
+		t.Fatal("Expected", len(rows), "values, got", count, cursor.Err())
+	}
+
+	// a row that doesn't fit the schema stops the cursor with an error
+	rows[3] = rows[3][:len(rows[3])-1]
+	cursor, _ = schema.Project(rows, "column5")
+	count = 0
+	for cursor.Next() {
+		count++
+	}
+	var lengthErr *RowLengthError
+	if count != 3 || !errors.As(cursor.Err(), &lengthErr) {
+		t.Error("Expected the cursor to stop at row 3 with a length error, got", count, cursor.Err())
+	}
+
+	_, err = schema.Project(rows, "missing")
+	if err == nil {
+		t.Error("Expected error projecting a missing column")
+	}
+}
+
+func BenchmarkProjectSum(b *testing.B) {
+	schema, rows := projectRows(1000)
+	for b.Loop() {
+		sum := int32(0)
+		cursor, _ := schema.Project(rows, "column12")
+		for cursor.Next() {
+			sum += cursor.Value().(int32)
+		}
+	}
+}
+
+func BenchmarkFullRowSum(b *testing.B) {
+	schema, rows := projectRows(1000)
+	for b.Loop() {
+		sum := int32(0)
+		schema.ScanRows(rows, func(index int, row Row, err error) bool {
+			sum += row.Columns[12].Data.(int32)
+			return true
+		})
+	}
+}
+
+func TestMigrateRow(t *testing.T) {
+	schema, data := wideSchema(8)
+	schema.columns[3].nullable = true
+	data[0] |= 1 << 3
+
+	extra := newColumn("extra", TYPE_INT, 0)
+	err := extra.SetDefault(int32(99))
+	if err != nil {
+		t.Fatal("Failed to set default :", err)
+	}
+	note := newColumn("note", TYPE_INT, 0)
+	note.nullable = true
+	newSchema, err := schema.AddColumn(extra)
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+	newSchema, err = newSchema.AddColumn(note)
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+	if newSchema.bitmapSize != schema.bitmapSize+1 {
+		t.Fatal("Expected the bitmap to grow by a byte, got", newSchema.bitmapSize)
+	}
+
+	migrated, err := newSchema.MigrateRow(data, schema)
+	if err != nil {
+		t.Fatal("Failed to migrate row :", err)
+	}
+	if migrated[0] != 1<<3 || migrated[1] != 1<<1 {
+		t.Error("Expected null flags for column 3 and note, got bitmap", migrated[:2])
+	}
+	for i := range 10 {
+		value, err := newSchema.ReadColumn(migrated, i)
+		if err != nil {
+			t.Fatal("Failed to read column", i, ":", err)
+		}
+		var expected any = int32(i)
+		switch i {
+		case 3, 9:
+			expected = nil
+		case 8:
+			expected = int32(99)
+		}
+		if value != expected {
+			t.Error("Expected", expected, "for column", i, "but got", value)
+		}
+	}
+
+	// a column changing type or a required column without a value can't migrate
+	changed := newColumn("column2", TYPE_VARCHAR, 4)
+	dropped, _ := schema.DropColumn("column2")
+	changedSchema, _ := dropped.AddColumn(changed)
+	_, err = changedSchema.MigrateRow(data, schema)
+	if err == nil {
+		t.Error("Expected error migrating a column that changed type")
+	}
+	required, _ := schema.AddColumn(newColumn("required", TYPE_INT, 0))
+	_, err = required.MigrateRow(data, schema)
+	if err == nil {
+		t.Error("Expected error migrating into a required column without a default")
+	}
+}
+
+func TestBitmapSize(t *testing.T) {
+	for _, test := range []struct{ columns, size int }{{1, 1}, {3, 1}, {8, 1}, {9, 2}, {16, 2}, {17, 3}} {
+		schema, _ := wideSchema(test.columns)
+		if schema.bitmapSize != test.size {
+			t.Error("Expected a bitmap of", test.size, "bytes for", test.columns, "columns, got", schema.bitmapSize)
+		}
+	}
+}
+
+func TestNullColumn(t *testing.T) {
+	nickname := newColumn("nickname", TYPE_INT, 0)
+	nickname.nullable = true
+	schema := Schema{}
+	schema.SetColumns([]Column{nickname, newColumn("age", TYPE_INT, 0)})
+	row := schema.NewRow([]Item{{TYPE_INT, nil}, {TYPE_INT, int32(42)}})
+	err := schema.ValidateRow(row)
+	if err != nil {
+		t.Fatal("Expected row to be valid:", err)
+	}
+
+	data := row.getBytes()
+	expected := []byte{0b01, 0, 0, 0, 0, 42, 0, 0, 0}
+	if !bytes.Equal(data, expected) {
+		t.Fatal("Expected the null flag and a zero filled nickname", expected, "but got", data)
+	}
+	decoded := Row{}
+	decoded.readBytes(data, schema)
+	if !isNull(decoded.Bitmap, 0) || decoded.Columns[0].Data != nil || decoded.Columns[1].Data != int32(42) {
+		t.Fatal("Round trip mismatch, got", decoded.Bitmap, decoded.Columns)
+	}
+
+	// the encoder rows are stored with writes the same layout
+	encoded, err := schema.Encode(row)
+	if err != nil || !bytes.Equal(encoded, expected) {
+		t.Fatal("Expected the encoder to write", expected, "got", encoded, err)
+	}
+	decoded, err = schema.Decode(encoded)
+	if err != nil || decoded.Columns[0].Data != nil || decoded.Columns[1].Data != int32(42) {
+		t.Fatal("Encoder round trip mismatch, got", decoded.Columns, err)
+	}
+	value, err := schema.ReadColumn(encoded, 1)
+	if err != nil || value != int32(42) {
+		t.Error("Expected 42 after the null column, got", value, err)
+	}
+}
@@ -0,0 +1,95 @@
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// rowVersionSize is the size of the schema version tag before a versioned row
+const rowVersionSize = 4
+
+// SchemaVersions holds every schema a table's rows may have been written
+// with. New rows are tagged with the current version, so old rows stay
+// readable under their own schema while a migration rewrites them gradually
+type SchemaVersions struct {
+	schemas map[uint32]Schema
+	current uint32
+}
+
+// NewSchemaVersions starts a version history with the schema as current
+func NewSchemaVersions(schema Schema) *SchemaVersions {
+	return &SchemaVersions{map[uint32]Schema{schema.version: schema}, schema.version}
+}
+
+// AddVersion makes the schema current. Its version must be higher than
+// every version already held
+func (versions *SchemaVersions) AddVersion(schema Schema) error {
+	if schema.version <= versions.current {
+		return fmt.Errorf("schema version %d is not newer than current version %d", schema.version, versions.current)
+	}
+	versions.schemas[schema.version] = schema
+	versions.current = schema.version
+	return nil
+}
+
+// Current returns the schema new rows are written with
+func (versions *SchemaVersions) Current() Schema {
+	return versions.schemas[versions.current]
+}
+
+// Schema returns the schema of a version
+func (versions *SchemaVersions) Schema(version uint32) (Schema, bool) {
+	schema, ok := versions.schemas[version]
+	return schema, ok
+}
+
+// Encode serializes a row with the current schema, tagged with its version
+func (versions *SchemaVersions) Encode(row Row) ([]byte, error) {
+	current := versions.Current()
+	data, err := current.Encode(row)
+	if err != nil {
+		return nil, err
+	}
+	response := binary.LittleEndian.AppendUint32(make([]byte, 0, rowVersionSize+len(data)), versions.current)
+	return append(response, data...), nil
+}
+
+// Decode reads a versioned row under the schema it was written with and
+// returns it in the layout of the current schema
+func (versions *SchemaVersions) Decode(data []byte) (Row, error) {
+	if len(data) < rowVersionSize {
+		return Row{}, fmt.Errorf("row of %d bytes is too short for its version tag", len(data))
+	}
+	version := binary.LittleEndian.Uint32(data)
+	schema, ok := versions.schemas[version]
+	if !ok {
+		return Row{}, fmt.Errorf("row was written with unknown schema version %d", version)
+	}
+	data = data[rowVersionSize:]
+	current := versions.Current()
+	if version != versions.current {
+		var err error
+		data, err = current.MigrateRow(data, schema)
+		if err != nil {
+			return Row{}, fmt.Errorf("failed to migrate row from version %d: %w", version, err)
+		}
+	}
+	err := current.CheckRowLength(data)
+	if err != nil {
+		return Row{}, err
+	}
+	return current.Decode(data)
+}
+
+// ScanRows decodes stored versioned rows in order, each under the schema
+// it was written with, and passes them to visit in the current layout.
+// A row that can't be decoded is passed with its error. Returning false
+// from visit ends the scan
+func (versions *SchemaVersions) ScanRows(rows [][]byte, visit func(index int, row Row, err error) bool) {
+	for i, data := range rows {
+		row, err := versions.Decode(data)
+		if !visit(i, row, err) {
+			return
+		}
+	}
+}
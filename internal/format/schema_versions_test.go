@@ -0,0 +1,65 @@
+package format
+
+import "testing"
+
+func TestSchemaVersions(t *testing.T) {
+	old := Schema{}
+	old.SetColumns([]Column{newColumn("id", TYPE_INT, 0), newColumn("name", TYPE_VARCHAR, 16)})
+	old.SetVersion(1)
+	versions := NewSchemaVersions(old)
+
+	rows := [][]byte{}
+	for i, name := range []string{"ada", "grace"} {
+		data, err := versions.Encode(old.NewRow([]Item{{TYPE_INT, int32(i)}, {TYPE_VARCHAR, name}}))
+		if err != nil {
+			t.Fatal("Failed to encode row :", err)
+		}
+		rows = append(rows, data)
+	}
+
+	score := newColumn("score", TYPE_INT, 0)
+	score.SetDefault(int32(50))
+	current, err := old.AddColumn(score)
+	if err != nil {
+		t.Fatal("Failed to add column :", err)
+	}
+	err = versions.AddVersion(current)
+	if err == nil {
+		t.Fatal("Expected error adding a schema without a newer version")
+	}
+	current.SetVersion(2)
+	err = versions.AddVersion(current)
+	if err != nil {
+		t.Fatal("Failed to add schema version :", err)
+	}
+	data, err := versions.Encode(current.NewRow([]Item{{TYPE_INT, int32(2)}, {TYPE_VARCHAR, "linus"}, {TYPE_INT, int32(80)}}))
+	if err != nil {
+		t.Fatal("Failed to encode row :", err)
+	}
+	rows = append(rows, data)
+
+	// rows of both versions come out in the current layout
+	expected := [][]any{{int32(0), "ada", int32(50)}, {int32(1), "grace", int32(50)}, {int32(2), "linus", int32(80)}}
+	visited := 0
+	versions.ScanRows(rows, func(index int, row Row, err error) bool {
+		visited++
+		if err != nil {
+			t.Fatal("Failed to decode row", index, ":", err)
+		}
+		for i, value := range expected[index] {
+			if row.Columns[i].Data != value {
+				t.Error("Expected", value, "for column", i, "of row", index, "but got", row.Columns[i].Data)
+			}
+		}
+		return true
+	})
+	if visited != 3 {
+		t.Error("Expected 3 rows scanned, got", visited)
+	}
+
+	rows[0][0] = 9
+	_, err = versions.Decode(rows[0])
+	if err == nil {
+		t.Error("Expected error for a row of an unknown version")
+	}
+}
@@ -1,9 +1,31 @@
 package format
 
-import "encoding/binary"
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 const (
 	TYPE_INT = iota
+	TYPE_VARCHAR
+	TYPE_DOUBLE
+	TYPE_BOOL
+	TYPE_TIMESTAMP
+)
+
+// lengthPrefixSize is the size of the length written before variable size values
+const lengthPrefixSize = 2
+
+// Timestamps are stored as nanoseconds since the epoch, so only times
+// UnixNano can represent, roughly the years 1678 to 2262, are valid
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
 )
 
 // keep sequence same as the constants above
@@ -23,6 +45,94 @@ var TYPE_MAP = []TypeInfo{
 		func(data []byte) any {
 			return int32(binary.LittleEndian.Uint32(data))
 		},
+		func(a, b any) int {
+			return cmp.Compare(a.(int32), b.(int32))
+		},
+	},
+	{
+		"varchar",
+		false,
+		true,
+		1,
+		func(data any) ([]byte, bool) {
+			value, ok := data.(string)
+			if !ok || len(value) > math.MaxUint16 || !utf8.ValidString(value) {
+				return []byte{}, false
+			}
+			response := binary.LittleEndian.AppendUint16([]byte{}, uint16(len(value)))
+			return append(response, value...), true
+		},
+		func(data []byte) any {
+			length := int(binary.LittleEndian.Uint16(data))
+			data = data[lengthPrefixSize:]
+			if length > len(data) {
+				length = len(data)
+			}
+			return string(data[:length])
+		},
+		func(a, b any) int {
+			return strings.Compare(a.(string), b.(string))
+		},
+	},
+	{
+		"double",
+		true,
+		false,
+		8,
+		func(data any) ([]byte, bool) {
+			value, ok := data.(float64)
+			if !ok {
+				return []byte{}, false
+			}
+			return binary.LittleEndian.AppendUint64([]byte{}, math.Float64bits(value)), true
+		},
+		func(data []byte) any {
+			return math.Float64frombits(binary.LittleEndian.Uint64(data))
+		},
+		func(a, b any) int {
+			return cmp.Compare(a.(float64), b.(float64))
+		},
+	},
+	{
+		"bool",
+		true,
+		false,
+		1,
+		func(data any) ([]byte, bool) {
+			value, ok := data.(bool)
+			if !ok {
+				return []byte{}, false
+			}
+			if value {
+				return []byte{1}, true
+			}
+			return []byte{0}, true
+		},
+		func(data []byte) any {
+			return data[0] != 0
+		},
+		func(a, b any) int {
+			return cmp.Compare(boolRank(a.(bool)), boolRank(b.(bool)))
+		},
+	},
+	{
+		"timestamp",
+		true,
+		false,
+		8,
+		func(data any) ([]byte, bool) {
+			value, ok := data.(time.Time)
+			if !ok || value.Before(minTimestamp) || value.After(maxTimestamp) {
+				return []byte{}, false
+			}
+			return binary.LittleEndian.AppendUint64([]byte{}, uint64(value.UnixNano())), true
+		},
+		func(data []byte) any {
+			return time.Unix(0, int64(binary.LittleEndian.Uint64(data))).UTC()
+		},
+		func(a, b any) int {
+			return a.(time.Time).Compare(b.(time.Time))
+		},
 	},
 }
 
@@ -33,4 +143,55 @@ type TypeInfo struct {
 	defaultSize     int32 // in bytes
 	getBinary       func(any) ([]byte, bool)
 	readBinary      func([]byte) any
+	compare         func(a, b any) int // orders two non null values, like cmp.Compare
+}
+
+// RegisterType adds a fixed size type to TYPE_MAP and returns its id.
+// The compare function orders values of the type wherever rows are
+// compared, such as index keys
+func RegisterType(name string, size int32, getBinary func(any) ([]byte, bool), readBinary func([]byte) any, compare func(a, b any) int) (byte, error) {
+	if len(TYPE_MAP) > math.MaxUint8 {
+		return 0, fmt.Errorf("type map already holds the maximum of %d types", math.MaxUint8+1)
+	}
+	for _, datatype := range TYPE_MAP {
+		if datatype.name == name {
+			return 0, fmt.Errorf("type %s is already registered", name)
+		}
+	}
+	if getBinary == nil || readBinary == nil || compare == nil {
+		return 0, fmt.Errorf("type %s needs encode, decode and compare functions", name)
+	}
+	TYPE_MAP = append(TYPE_MAP, TypeInfo{name, true, false, size, getBinary, readBinary, compare})
+	return byte(len(TYPE_MAP) - 1), nil
+}
+
+// typeInfo looks up a type by id, ids from rows aren't trusted to be in TYPE_MAP
+func typeInfo(dataType byte) (TypeInfo, error) {
+	if int(dataType) >= len(TYPE_MAP) {
+		return TypeInfo{}, fmt.Errorf("unknown type id %d", dataType)
+	}
+	return TYPE_MAP[dataType], nil
+}
+
+// Compare orders two values of the given type. Null sorts before any value
+func Compare(dataType byte, a any, b any) (int, error) {
+	datatype, err := typeInfo(dataType)
+	if err != nil {
+		return 0, err
+	}
+	if a == nil || b == nil {
+		return cmp.Compare(boolRank(a != nil), boolRank(b != nil)), nil
+	}
+	if datatype.compare == nil {
+		return 0, fmt.Errorf("type %s has no comparator", datatype.name)
+	}
+	return datatype.compare(a, b), nil
+}
+
+// boolRank maps false to 0 and true to 1 for ordering
+func boolRank(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,192 @@
+package format
+
+import (
+	"cmp"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+)
+
+// priorityType registers a type ordered from high to low, unlike its bytes
+func priorityType(t *testing.T) byte {
+	for id, datatype := range TYPE_MAP {
+		if datatype.name == "priority" {
+			return byte(id)
+		}
+	}
+	id, err := RegisterType("priority", 2,
+		func(data any) ([]byte, bool) {
+			value, ok := data.(uint16)
+			return binary.LittleEndian.AppendUint16([]byte{}, value), ok
+		},
+		func(data []byte) any {
+			return binary.LittleEndian.Uint16(data)
+		},
+		func(a, b any) int {
+			return cmp.Compare(b.(uint16), a.(uint16))
+		},
+	)
+	if err != nil {
+		t.Fatal("Failed to register type:", err)
+	}
+	return id
+}
+
+func TestCustomTypeKey(t *testing.T) {
+	priority := priorityType(t)
+	_, err := RegisterType("priority", 2, TYPE_MAP[priority].getBinary, TYPE_MAP[priority].readBinary, TYPE_MAP[priority].compare)
+	if err == nil {
+		t.Error("Expected error registering a type name twice")
+	}
+
+	priorityColumn := newColumn("priority", priority, 0)
+	priorityColumn.nullable = true
+	schema := Schema{}
+	schema.SetColumns([]Column{priorityColumn, newColumn("id", TYPE_INT, 0)})
+
+	rows := []Row{}
+	for i, value := range []any{uint16(1), uint16(9), nil, uint16(5), uint16(9)} {
+		row := schema.NewRow([]Item{{priority, value}, {TYPE_INT, int32(i)}})
+		if value != nil {
+			// the key is decoded by the custom type
+			data := row.getBytes()
+			row = Row{}
+			row.readBytes(data, schema)
+		}
+		rows = append(rows, row)
+	}
+
+	// order by the custom key, then by id
+	slices.SortFunc(rows, func(a, b Row) int {
+		result, err := a.CompareKey(b, []int{0, 1})
+		if err != nil {
+			t.Fatal("Failed to compare keys:", err)
+		}
+		return result
+	})
+	ids := []int32{}
+	for _, row := range rows {
+		ids = append(ids, row.Columns[1].Data.(int32))
+	}
+	if !slices.Equal(ids, []int32{2, 1, 4, 3, 0}) {
+		t.Error("Expected null first then priorities from high to low, got ids", ids)
+	}
+
+	_, err = rows[0].CompareKey(rows[1], []int{2})
+	if err == nil {
+		t.Error("Expected error for a key column out of range")
+	}
+}
+
+func TestDouble(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("id", TYPE_INT, 0),
+		newColumn("reading", TYPE_DOUBLE, 0),
+	})
+	if schema.rowSize != schema.bitmapSize+4+8 {
+		t.Fatal("Expected double to take 8 bytes, got a row size of", schema.rowSize)
+	}
+
+	row := schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_DOUBLE, -273.15}})
+	err := schema.ValidateRow(row)
+	if err != nil {
+		t.Fatal("Expected row to be valid:", err)
+	}
+	decoded := Row{}
+	decoded.readBytes(row.getBytes(), schema)
+	if decoded.Columns[1].Data != -273.15 {
+		t.Fatal("Round trip mismatch, got", decoded.Columns[1].Data)
+	}
+
+	row.Columns[1].Data = float32(1.5)
+	err = schema.ValidateRow(row)
+	if err == nil {
+		t.Error("Expected error for a float32 value in a double column")
+	}
+}
+
+func TestBool(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("active", TYPE_BOOL, 0),
+		newColumn("id", TYPE_INT, 0),
+		newColumn("admin", TYPE_BOOL, 0),
+	})
+	if schema.rowSize != schema.bitmapSize+1+4+1 {
+		t.Fatal("Expected bool to take 1 byte, got a row size of", schema.rowSize)
+	}
+
+	row := schema.NewRow([]Item{{TYPE_BOOL, true}, {TYPE_INT, int32(3)}, {TYPE_BOOL, false}})
+	err := schema.ValidateRow(row)
+	if err != nil {
+		t.Fatal("Expected row to be valid:", err)
+	}
+	decoded := Row{}
+	decoded.readBytes(row.getBytes(), schema)
+	if decoded.Columns[0].Data != true || decoded.Columns[1].Data != int32(3) || decoded.Columns[2].Data != false {
+		t.Fatal("Round trip mismatch, got", decoded.Columns)
+	}
+
+	row.Columns[0].Data = 1
+	err = schema.ValidateRow(row)
+	if err == nil {
+		t.Error("Expected error for an int value in a bool column")
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	schema := Schema{}
+	schema.SetColumns([]Column{
+		newColumn("id", TYPE_INT, 0),
+		newColumn("created", TYPE_TIMESTAMP, 0),
+	})
+	if schema.rowSize != schema.bitmapSize+4+8 {
+		t.Fatal("Expected timestamp to take 8 bytes, got a row size of", schema.rowSize)
+	}
+
+	created := time.Date(2024, time.February, 29, 23, 59, 58, 123456789, time.FixedZone("UTC+5", 5*60*60))
+	row := schema.NewRow([]Item{{TYPE_INT, int32(1)}, {TYPE_TIMESTAMP, created}})
+	err := schema.ValidateRow(row)
+	if err != nil {
+		t.Fatal("Expected row to be valid:", err)
+	}
+	decoded := Row{}
+	decoded.readBytes(row.getBytes(), schema)
+	value, ok := decoded.Columns[1].Data.(time.Time)
+	if !ok || !value.Equal(created.Truncate(time.Nanosecond)) || value.Location() != time.UTC {
+		t.Fatal("Round trip mismatch, got", decoded.Columns[1].Data)
+	}
+
+	row.Columns[1].Data = created.UnixNano()
+	err = schema.ValidateRow(row)
+	if err == nil {
+		t.Error("Expected error for an int64 value in a timestamp column")
+	}
+
+	// times UnixNano can't represent are rejected instead of wrapping
+	for _, outside := range []time.Time{{}, time.Date(2300, time.January, 1, 0, 0, 0, 0, time.UTC)} {
+		row.Columns[1].Data = outside
+		err = schema.ValidateRow(row)
+		if err == nil {
+			t.Error("Expected error for a timestamp outside the stored range", outside)
+		}
+		_, err = schema.Encode(row)
+		if err == nil {
+			t.Error("Expected error encoding a timestamp outside the stored range", outside)
+		}
+	}
+	// the edges of the range still round trip
+	for _, edge := range []time.Time{minTimestamp, maxTimestamp} {
+		row.Columns[1].Data = edge
+		encoded, err := schema.Encode(row)
+		if err != nil {
+			t.Fatal("Failed to encode timestamp", edge, ":", err)
+		}
+		decoded, err = schema.Decode(encoded)
+		if err != nil || !decoded.Columns[1].Data.(time.Time).Equal(edge) {
+			t.Error("Round trip mismatch for", edge, "got", decoded.Columns[1].Data, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CurrentLSN returns the id the next transaction will be given. Changes
+// made after this call are covered by an incremental backup since it
+func (DatabaseManager *DatabaseManager) CurrentLSN() uint64 {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.wal.nextTransactionId
+}
+
+// Backup writes a full copy of the database, including changes still in
+// the WAL, to a new data file at dest. It returns the LSN the backup covers
+// up to, which is also stored in the copy for RestoreIncremental
+func (DatabaseManager *DatabaseManager) Backup(dest string) (uint64, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+
+	lsn := DatabaseManager.wal.nextTransactionId
+	count, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	for pageId := uint64(0); pageId < count; pageId++ {
+		page, err := DatabaseManager.backupPage(pageId)
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		_, err = file.WriteAt(page, int64(pageId)*DatabaseManager.allocator.PageSize)
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+
+	backup := PageAllocator{}
+	err = backup.InitializeStorage(fileStorage{file}, DatabaseManager.allocator.PageSize)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	err = backup.WriteMetaField(MetaBackupLSN, lsn)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	return lsn, backup.CloseFile()
+}
+
+// BackupIncremental writes the pages changed by transactions from sinceLSN
+// on to dest, together with the metadata page and the free pages, so that
+// RestoreIncremental can apply them onto a backup taken at sinceLSN.
+// Changes made before the database was opened are not tracked, so an
+// older sinceLSN needs a new full backup instead
+func (DatabaseManager *DatabaseManager) BackupIncremental(dest string, sinceLSN uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+
+	if sinceLSN < DatabaseManager.trackedSince {
+		return fmt.Errorf("changes before %d are not tracked, take a full backup", DatabaseManager.trackedSince)
+	}
+	if sinceLSN > DatabaseManager.wal.nextTransactionId {
+		return fmt.Errorf("transaction %d has not been written yet, the database is at %d", sinceLSN, DatabaseManager.wal.nextTransactionId)
+	}
+	count, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+
+	pageIds := []uint64{0}
+	for pageId := uint64(1); pageId < count; pageId++ {
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageId)
+		if err != nil {
+			return err
+		}
+		lastChange, ok := DatabaseManager.modified[pageId]
+		if header.PageType == PagetypeFreepage || (ok && lastChange >= sinceLSN) {
+			pageIds = append(pageIds, pageId)
+		}
+	}
+
+	data := binary.LittleEndian.AppendUint64([]byte{}, sinceLSN)
+	data = binary.LittleEndian.AppendUint64(data, DatabaseManager.wal.nextTransactionId)
+	data = binary.LittleEndian.AppendUint64(data, uint64(DatabaseManager.allocator.PageSize))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(pageIds)))
+	for _, pageId := range pageIds {
+		page, err := DatabaseManager.backupPage(pageId)
+		if err != nil {
+			return err
+		}
+		data = binary.LittleEndian.AppendUint64(data, pageId)
+		data = append(data, page...)
+	}
+	return os.WriteFile(dest, data, 0666)
+}
+
+// backupPage returns the full bytes of a page as they would be after a
+// checkpoint. The metadata page and free pages never go through the WAL so
+// they are copied from disk
+func (DatabaseManager *DatabaseManager) backupPage(pageId uint64) ([]byte, error) {
+	page, err := DatabaseManager.allocator.RawPage(pageId)
+	if err != nil {
+		return nil, err
+	}
+	if pageId == 0 || page[PageHeaderTypeOffset] == PagetypeFreepage {
+		return page, nil
+	}
+
+	var data PageData
+	entry, ok := DatabaseManager.database[pageId]
+	if ok {
+		data = entry.data
+	} else {
+		data, err = DatabaseManager.loadPageFromDisc(pageId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header := PageHeader{PageVersion: page[PageHeaderVersionOffset], PageType: page[PageHeaderTypeOffset]}
+	checksum := DatabaseManager.allocator.pageChecksum(header, data)
+	binary.LittleEndian.PutUint32(page[PageHeaderChecksumOffset:], checksum)
+	encoded, err := DatabaseManager.allocator.encodePage(pageId, data)
+	if err != nil {
+		return nil, err
+	}
+	copy(page[PageHeaderSize:], encoded)
+	return page, nil
+}
+
+// RestoreIncremental applies an incremental backup onto a backup file.
+// Increments must be applied in order, one starting after the LSN the
+// backup covers is rejected
+func RestoreIncremental(backupPath string, incrementPath string) error {
+	increment, err := os.Open(incrementPath)
+	if err != nil {
+		return err
+	}
+	defer increment.Close()
+	header := make([]uint64, 4)
+	err = binary.Read(increment, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	since, until, pageSize, count := header[0], header[1], header[2], header[3]
+
+	backup := PageAllocator{}
+	err = backup.Initialize(backupPath, 0)
+	if err != nil {
+		return err
+	}
+	defer backup.CloseFile()
+	if uint64(backup.PageSize) != pageSize {
+		return fmt.Errorf("increment page size %d does not match backup page size %d", pageSize, backup.PageSize)
+	}
+	covered, err := backup.ReadMetaField(MetaBackupLSN)
+	if err != nil {
+		return err
+	}
+	if since > covered {
+		return fmt.Errorf("increment starts at %d but backup only covers up to %d", since, covered)
+	}
+	if until < covered {
+		return fmt.Errorf("increment ends at %d but backup already covers up to %d", until, covered)
+	}
+
+	page := make([]byte, pageSize)
+	for range count {
+		var pageId uint64
+		err = binary.Read(increment, binary.LittleEndian, &pageId)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(increment, page)
+		if err != nil {
+			return err
+		}
+		_, err = backup.Database.WriteAt(page, int64(pageId)*int64(pageSize))
+		if err != nil {
+			return err
+		}
+	}
+	// the metadata page was replaced by the source's, record the new coverage
+	return backup.WriteMetaField(MetaBackupLSN, until)
+}
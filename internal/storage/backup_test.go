@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func newDatabaseAt(t *testing.T, logFile string, dataFile string) *DatabaseManager {
+	DatabaseManager := &DatabaseManager{}
+	err := DatabaseManager.Initialize(1000000, 32000)
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	err = DatabaseManager.allocator.Initialize(dataFile, 0)
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	err = DatabaseManager.openWal(logFile)
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	return DatabaseManager
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	for _, file := range []string{"backup.db", "backup.log", "backup.inc", "backup2.inc"} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	pageIds := []uint64{}
+	for i := 0; i < 10; i++ {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		_, err = DatabaseManager.WriteAt(id, 0, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	lsn, err := DatabaseManager.Backup("backup.db")
+	if err != nil {
+		t.Fatal("Failed to back up database :", err)
+	}
+
+	// change a few pages, one after a checkpoint, and allocate a new one
+	_, err = DatabaseManager.WriteAt(pageIds[2], 5, []byte{9, 9})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIds[2], ":", err)
+	}
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	err = DatabaseManager.SetCheckpointThreshold(1000000)
+	if err != nil {
+		t.Fatal("Failed to reset checkpoint threshold :", err)
+	}
+	_, err = DatabaseManager.WriteAt(pageIds[7], 0, []byte{42})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIds[7], ":", err)
+	}
+	added, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(added, 0, []byte{11})
+	if err != nil {
+		t.Fatal("Write failed for page", added, ":", err)
+	}
+
+	err = DatabaseManager.BackupIncremental("backup.inc", lsn)
+	if err != nil {
+		t.Fatal("Failed to take incremental backup :", err)
+	}
+
+	// only the metadata page and the changed pages are stored
+	increment, err := os.ReadFile("backup.inc")
+	if err != nil {
+		t.Fatal("Failed to read increment :", err)
+	}
+	if count := binary.LittleEndian.Uint64(increment[24:]); count != 4 {
+		t.Error("Expected 4 pages in the increment, got", count)
+	}
+
+	err = RestoreIncremental("backup.db", "backup.inc")
+	if err != nil {
+		t.Fatal("Failed to restore increment :", err)
+	}
+
+	// the restored backup matches the source
+	expected, err := DatabaseManager.Fingerprint()
+	if err != nil {
+		t.Fatal("Failed to fingerprint database :", err)
+	}
+	restored := newDatabaseAt(t, "backup.log", "backup.db")
+	defer restored.Shutdown()
+	fingerprint, err := restored.Fingerprint()
+	if err != nil {
+		t.Fatal("Failed to fingerprint backup :", err)
+	}
+	if fingerprint != expected {
+		t.Error("Restored backup does not match the database")
+	}
+	data, err := restored.GetPage(pageIds[2])
+	if err != nil || data[5] != 9 || data[0] != 3 {
+		t.Error("Expected restored page", pageIds[2], "to hold both writes, got", data[0], data[5], err)
+	}
+
+	// increments must be applied in order
+	next := DatabaseManager.CurrentLSN()
+	_, err = DatabaseManager.WriteAt(pageIds[0], 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIds[0], ":", err)
+	}
+	err = DatabaseManager.BackupIncremental("backup2.inc", next+1)
+	if err != nil {
+		t.Fatal("Failed to take incremental backup :", err)
+	}
+	err = RestoreIncremental("backup.db", "backup2.inc")
+	if err == nil {
+		t.Error("Expected error restoring an increment that skips transactions")
+	}
+}
+
+func TestIncrementalBackupAfterReopen(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	for _, file := range []string{"backup.db", "backup.log", "backup.inc"} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	for i := range 5 {
+		_, err = DatabaseManager.WriteAt(id, 0, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+	lsn, err := DatabaseManager.Backup("backup.db")
+	if err != nil {
+		t.Fatal("Failed to back up database :", err)
+	}
+
+	// the checkpoint empties the WAL, the ids it held must not be reused
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+	if DatabaseManager.CurrentLSN() != lsn {
+		t.Fatal("Expected transaction ids to continue from", lsn, "got", DatabaseManager.CurrentLSN())
+	}
+	transactionId, err := DatabaseManager.WriteAt(id, 0, []byte{42})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	if transactionId < lsn {
+		t.Error("Expected transaction id", transactionId, "to be at least", lsn)
+	}
+
+	err = DatabaseManager.BackupIncremental("backup.inc", DatabaseManager.CurrentLSN()+1)
+	if err == nil {
+		t.Error("Expected error taking an increment from a transaction not written yet")
+	}
+	err = DatabaseManager.BackupIncremental("backup.inc", lsn)
+	if err != nil {
+		t.Fatal("Failed to take incremental backup :", err)
+	}
+	err = RestoreIncremental("backup.db", "backup.inc")
+	if err != nil {
+		t.Fatal("Failed to restore increment :", err)
+	}
+	restored := newDatabaseAt(t, "backup.log", "backup.db")
+	defer restored.Shutdown()
+	data, err := restored.GetPage(id)
+	if err != nil || data[0] != 42 {
+		t.Error("Expected the restored backup to hold the write made after reopening, got", data[0], err)
+	}
+}
@@ -0,0 +1,220 @@
+package storage
+
+// CachePolicy decides which cached page is evicted when the cache is full.
+// The manager reports every page entering, hit in and leaving the cache,
+// the policy only tracks page ids and never sees page data
+type CachePolicy interface {
+	// Insert tracks a page loaded by an ordinary read
+	Insert(pageId uint64)
+	// InsertCold tracks a page that should be the next to go, used for
+	// one-off reads that must not displace the hot set
+	InsertCold(pageId uint64)
+	// Touch records a cache hit on a page
+	Touch(pageId uint64)
+	// Remove stops tracking a page dropped outside of eviction
+	Remove(pageId uint64)
+	// Victim returns the page Evict would choose, without changing any state
+	Victim() (uint64, bool)
+	// Evict stops tracking the page Victim returns and returns it
+	Evict() (uint64, bool)
+}
+
+// lruNode is a page in the LRU list, next points towards the most recently
+// used end and prev towards the least recently used end
+type lruNode struct {
+	pageId uint64
+	next   *lruNode
+	prev   *lruNode
+}
+
+// LRUPolicy evicts the least recently used page
+type LRUPolicy struct {
+	nodes map[uint64]*lruNode
+	head  *lruNode // Most recently used page
+	tail  *lruNode // Least recently used page, evicted first
+}
+
+// NewLRUPolicy creates an empty LRU policy
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{nodes: make(map[uint64]*lruNode)}
+}
+
+// Insert places the page at the most recently used end
+func (lru *LRUPolicy) Insert(pageId uint64) {
+	node := &lruNode{pageId, nil, lru.head}
+	if lru.head != nil {
+		lru.head.next = node
+	} else {
+		lru.tail = node
+	}
+	lru.head = node
+	lru.nodes[pageId] = node
+}
+
+// InsertCold places the page at the least recently used end
+func (lru *LRUPolicy) InsertCold(pageId uint64) {
+	node := &lruNode{pageId, lru.tail, nil}
+	if lru.tail != nil {
+		lru.tail.prev = node
+	} else {
+		lru.head = node
+	}
+	lru.tail = node
+	lru.nodes[pageId] = node
+}
+
+// Touch moves the page to the most recently used end
+func (lru *LRUPolicy) Touch(pageId uint64) {
+	node, ok := lru.nodes[pageId]
+	if !ok || lru.head == node {
+		return
+	}
+	lru.unlink(node)
+	node.prev = lru.head
+	node.next = nil
+	lru.head.next = node
+	lru.head = node
+}
+
+// Remove drops the page from the list
+func (lru *LRUPolicy) Remove(pageId uint64) {
+	node, ok := lru.nodes[pageId]
+	if !ok {
+		return
+	}
+	lru.unlink(node)
+	delete(lru.nodes, pageId)
+}
+
+// Victim returns the least recently used page
+func (lru *LRUPolicy) Victim() (uint64, bool) {
+	if lru.tail == nil {
+		return 0, false
+	}
+	return lru.tail.pageId, true
+}
+
+// Evict drops the least recently used page and returns it
+func (lru *LRUPolicy) Evict() (uint64, bool) {
+	pageId, ok := lru.Victim()
+	if ok {
+		lru.Remove(pageId)
+	}
+	return pageId, ok
+}
+
+func (lru *LRUPolicy) unlink(node *lruNode) {
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		lru.head = node.prev
+	}
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		lru.tail = node.next
+	}
+}
+
+// clockNode is a page on the clock, next is the page the hand moves to after it
+type clockNode struct {
+	pageId     uint64
+	next       *clockNode
+	prev       *clockNode
+	referenced bool // Set by a hit, cleared when the hand passes the page
+}
+
+// ClockPolicy is the CLOCK, or second chance, approximation of LRU. Pages
+// sit on a circle and a hit only sets a reference bit. The hand evicts the
+// first page without the bit and clears the bit of every page it passes, so
+// a page hit since the hand last came by survives a sweep. Unlike LRU, a
+// scan of pages read once can't push out pages that keep getting hits
+type ClockPolicy struct {
+	nodes map[uint64]*clockNode
+	hand  *clockNode // Next page the hand looks at
+}
+
+// NewClockPolicy creates an empty CLOCK policy
+func NewClockPolicy() *ClockPolicy {
+	return &ClockPolicy{nodes: make(map[uint64]*clockNode)}
+}
+
+// Insert places the page just behind the hand, so it is looked at last
+func (clock *ClockPolicy) Insert(pageId uint64) {
+	node := &clockNode{pageId: pageId}
+	if clock.hand == nil {
+		node.next = node
+		node.prev = node
+		clock.hand = node
+	} else {
+		node.next = clock.hand
+		node.prev = clock.hand.prev
+		clock.hand.prev.next = node
+		clock.hand.prev = node
+	}
+	clock.nodes[pageId] = node
+}
+
+// InsertCold places the page under the hand, so it is looked at first
+func (clock *ClockPolicy) InsertCold(pageId uint64) {
+	clock.Insert(pageId)
+	clock.hand = clock.nodes[pageId]
+}
+
+// Touch gives the page a second chance
+func (clock *ClockPolicy) Touch(pageId uint64) {
+	node, ok := clock.nodes[pageId]
+	if ok {
+		node.referenced = true
+	}
+}
+
+// Remove takes the page off the clock
+func (clock *ClockPolicy) Remove(pageId uint64) {
+	node, ok := clock.nodes[pageId]
+	if !ok {
+		return
+	}
+	delete(clock.nodes, pageId)
+	if node.next == node {
+		clock.hand = nil
+		return
+	}
+	if clock.hand == node {
+		clock.hand = node.next
+	}
+	node.prev.next = node.next
+	node.next.prev = node.prev
+}
+
+// Victim returns the first page from the hand without the reference bit.
+// If every page has it, the sweep clears them all and comes back to the
+// page under the hand
+func (clock *ClockPolicy) Victim() (uint64, bool) {
+	if clock.hand == nil {
+		return 0, false
+	}
+	node := clock.hand
+	for range len(clock.nodes) {
+		if !node.referenced {
+			return node.pageId, true
+		}
+		node = node.next
+	}
+	return clock.hand.pageId, true
+}
+
+// Evict sweeps the hand to the first page without the reference bit,
+// clearing the bits it passes, and drops that page
+func (clock *ClockPolicy) Evict() (uint64, bool) {
+	if clock.hand == nil {
+		return 0, false
+	}
+	for clock.hand.referenced {
+		clock.hand.referenced = false
+		clock.hand = clock.hand.next
+	}
+	pageId := clock.hand.pageId
+	clock.Remove(pageId)
+	return pageId, true
+}
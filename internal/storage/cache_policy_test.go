@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func TestClockPolicy(t *testing.T) {
+	clock := NewClockPolicy()
+	for pageId := range uint64(3) {
+		clock.Insert(pageId + 1)
+	}
+	clock.Touch(1)
+	victim, ok := clock.Victim()
+	if !ok || victim != 2 {
+		t.Fatal("Expected page 2 as the victim after page 1 got a hit, got", victim, ok)
+	}
+	evicted, _ := clock.Evict()
+	if evicted != victim {
+		t.Fatal("Expected Evict to drop the victim", victim, "got", evicted)
+	}
+
+	// the sweep cleared the bit of page 1, it goes once the hand comes back
+	clock.InsertCold(4)
+	clock.Remove(4)
+	clock.Touch(3)
+	evicted, _ = clock.Evict()
+	if evicted != 1 {
+		t.Error("Expected page 1 to lose its second chance, got", evicted)
+	}
+	evicted, _ = clock.Evict()
+	if evicted != 3 {
+		t.Error("Expected page 3 once every bit is cleared, got", evicted)
+	}
+	_, ok = clock.Evict()
+	if ok {
+		t.Error("Expected nothing to evict from an empty clock")
+	}
+}
+
+// hotHitRate alternates between reading a hot set of pages, each twice in
+// a row, and scanning the next pages of a sequential scan much larger than
+// the cache. Returns the share of first reads of a hot page served from the
+// cache once the cache has warmed up
+func hotHitRate(t *testing.T, policy CachePolicy) float64 {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := &DatabaseManager{}
+	err := DatabaseManager.InitializeWithPolicy(1000000, 10, policy)
+	if err != nil {
+		t.Fatal("Failed to initialize database:", err)
+	}
+	defer DatabaseManager.Shutdown()
+	err = DatabaseManager.allocator.Initialize("test.db", 0)
+	if err != nil {
+		t.Fatal("Failed to initialize allocator:", err)
+	}
+	DatabaseManager.wal.checksum = DatabaseManager.allocator.checksum
+	err = DatabaseManager.wal.Initialize("test.log")
+	if err != nil {
+		t.Fatal("Failed to initialize wal:", err)
+	}
+
+	const rounds, scanPerRound = 30, 7
+	pageIds, err := DatabaseManager.allocator.AllocatePageBatch(PagetypeUserdata, 4+rounds*scanPerRound)
+	if err != nil {
+		t.Fatal("Failed to allocate pages:", err)
+	}
+	hot, scan := pageIds[:4], pageIds[4:]
+	hits, reads := 0, 0
+	for round := range rounds {
+		for _, pageId := range hot {
+			_, cached := DatabaseManager.database[pageId]
+			if round >= 3 {
+				reads++
+				if cached {
+					hits++
+				}
+			}
+			for range 2 {
+				_, err = DatabaseManager.GetPage(pageId)
+				if err != nil {
+					t.Fatal("Failed to read hot page:", err)
+				}
+			}
+		}
+		for _, pageId := range scan[round*scanPerRound : (round+1)*scanPerRound] {
+			_, err = DatabaseManager.GetPage(pageId)
+			if err != nil {
+				t.Fatal("Failed to read scanned page:", err)
+			}
+		}
+	}
+	return float64(hits) / float64(reads)
+}
+
+func TestClockRetainsHotPages(t *testing.T) {
+	lru := hotHitRate(t, NewLRUPolicy())
+	clock := hotHitRate(t, NewClockPolicy())
+	t.Log("hot page hit rate, LRU:", lru, "clock:", clock)
+	if clock < lru+0.5 {
+		t.Error("Expected clock to keep the hot pages through the scan, hit rate", clock, "against", lru, "for LRU")
+	}
+}
@@ -1,6 +1,12 @@
 package storage
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
 
 //CHECKPOINT_SIZE_THRESHOLD = 10000
 //CACHE_CAPACITY_PAGES      = 32000
@@ -9,11 +15,12 @@ import "fmt"
 // caching, and transaction handling. It implements ACID compliance through
 // write-ahead logging and checkpointing.
 type DatabaseManager struct {
+	// lock serializes access to the cache, WAL and allocator
+	lock sync.Mutex
 	// database maps page IDs to their cache entries
 	database map[uint64]*CacheEntry
-	// head and tail maintain an LRU cache of pages
-	head *CacheEntry
-	tail *CacheEntry
+	// policy chooses which cached page is evicted when the cache is full
+	policy CachePolicy
 	// wal handles write-ahead logging for durability
 	wal WriteAheadLog
 	// allocator manages page allocation and deallocation
@@ -24,13 +31,45 @@ type DatabaseManager struct {
 	cacheCapacityPages int
 	// checkpointSizeThreshold triggers checkpoint when WAL reaches this size
 	checkpointSizeThreshold uint64
+	// stats counts transactions and checkpoints for EngineStats
+	stats engineCounters
+	// activeReads counts open read transactions, checkpoints wait for zero
+	activeReads int
+	// onEvict is called with the id of every page dropped from the cache
+	onEvict func(pageId uint64)
+	// unlogged holds pages changed without a WAL record and not yet on disk
+	unlogged map[uint64]bool
+	// logger receives engine events, nil when logging is disabled
+	logger Logger
+	// dirtyWatermark is the share of the cache that may hold uncheckpointed
+	// pages before evicting one of them forces a checkpoint, 0 disables it
+	dirtyWatermark float64
+	// limiter paces page IO done with the lock released, nil for no limit
+	limiter *RateLimiter
+	// checkpointing is set while a checkpoint runs, flushing holds the
+	// pages it is writing so reads don't see half written pages
+	checkpointing bool
+	flushing      map[uint64]PageData
+	// modified maps pages to the last transaction id that changed them,
+	// complete for transactions from trackedSince on
+	modified     map[uint64]uint64
+	trackedSince uint64
+	// maintenance counts EnterMaintenance calls not yet exited, checkpoints
+	// and writing out evicted pages wait while it is above zero
+	maintenance int
+	// evictionBatch is the number of pages evicted at once when the cache is full
+	evictionBatch int
+	// pinned counts the pins held on cached pages, pinned pages are not
+	// tracked by the cache policy so they can't be evicted
+	pinned map[uint64]int
+	// vacuumHook remaps page ids stored by higher layers when Vacuum moves pages
+	vacuumHook VacuumHook
 }
 
-// CacheEntry represents a page in the LRU cache
+// CacheEntry represents a page in the cache
 type CacheEntry struct {
-	data PageData
-	next *CacheEntry
-	prev *CacheEntry
+	data  PageData
+	dirty bool // Set while data may differ from the page in the data file
 }
 
 // PageDelta represents a change to be made to a page
@@ -40,33 +79,335 @@ type PageDelta struct {
 	newData []byte // New data to write
 }
 
+// NewPageDelta creates a change writing data to a page at offset, for
+// callers outside the package building changes for WritePages
+func NewPageDelta(pageId uint64, offset uint32, data []byte) PageDelta {
+	return PageDelta{pageId, offset, data}
+}
+
 // Initialize sets up the database manager with specified cache and checkpoint parameters
 func (databaseManager *DatabaseManager) Initialize(checkpointTresholdInBytes uint64, cacheCapacityInPages int) error {
+	return databaseManager.InitializeWithPolicy(checkpointTresholdInBytes, cacheCapacityInPages, NewLRUPolicy())
+}
+
+// InitializeWithPolicy sets up the database manager like Initialize, with
+// policy choosing the pages evicted from the cache. The policy must be empty
+func (databaseManager *DatabaseManager) InitializeWithPolicy(checkpointTresholdInBytes uint64, cacheCapacityInPages int, policy CachePolicy) error {
 	databaseManager.database = make(map[uint64]*CacheEntry)
-	err := databaseManager.wal.Initialize("wal.log")
+	databaseManager.policy = policy
+	databaseManager.pinned = make(map[uint64]int)
+	databaseManager.unlogged = make(map[uint64]bool)
+	err := databaseManager.allocator.Initialize("data.db", 0)
+	if err != nil {
+		return err
+	}
+	err = databaseManager.openWal("wal.log")
 	if err != nil {
 		return err
 	}
-	err = databaseManager.allocator.Initialize("data.db")
 	databaseManager.cacheCapacityPages = cacheCapacityInPages
 	databaseManager.checkpointSizeThreshold = checkpointTresholdInBytes
-	return err
+	return nil
+}
+
+// openWal opens the WAL and recovers its transactions, bringing the data
+// file in line with the pages they write. Transaction ids continue from the
+// one saved by the last checkpoint, as the transactions it dropped are no
+// longer in the log to count from
+func (DatabaseManager *DatabaseManager) openWal(fileName string) error {
+	// the data file holds the checksum algorithm the WAL is verified with
+	DatabaseManager.wal.checksum = DatabaseManager.allocator.checksum
+	err := DatabaseManager.wal.Initialize(fileName)
+	if err != nil {
+		return err
+	}
+	next, err := DatabaseManager.allocator.ReadMetaField(MetaNextTransactionId)
+	if err != nil {
+		return err
+	}
+	DatabaseManager.wal.nextTransactionId = max(DatabaseManager.wal.nextTransactionId, next)
+	DatabaseManager.wal.coalesce()
+	// changes still in the WAL are known from it, older ones are not tracked
+	DatabaseManager.modified = make(map[uint64]uint64)
+	DatabaseManager.trackedSince = DatabaseManager.wal.nextTransactionId
+	if len(DatabaseManager.wal.ordered) > 0 {
+		DatabaseManager.trackedSince = DatabaseManager.wal.ordered[0].Header.transactionId
+	}
+	return DatabaseManager.checkWalPages()
+}
+
+// checkWalPages makes sure every page the WAL writes to exists in the data
+// file. A crash can lose the metadata update of an allocation whose writes
+// were logged, the missing pages are recreated and any pages between them
+// and the old end of the file are put on the free list. The page types
+// logged with the writes are written to the page headers again
+func (DatabaseManager *DatabaseManager) checkWalPages() error {
+	total, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	missing := []uint64{}
+	for pageId := range DatabaseManager.wal.Cache {
+		if pageId >= total {
+			missing = append(missing, pageId)
+		}
+	}
+	slices.Sort(missing)
+	for _, pageId := range missing {
+		pageType := DatabaseManager.loggedType(pageId)
+		err = DatabaseManager.allocator.AllocateSpecific(pageId, pageType)
+		if err != nil {
+			return fmt.Errorf("wal writes to page %d past the end of the data file: %w", pageId, err)
+		}
+		DatabaseManager.logEvent(EventPageAllocated, "page", pageId, "type", pageType)
+	}
+	// type changes logged by a transaction may not have reached the page
+	// headers before a crash
+	for _, transaction := range DatabaseManager.wal.ordered {
+		err = DatabaseManager.writeLoggedTypes(transaction)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loggedType is the type the latest typed WAL record gives a page, or
+// PagetypeUserdata if only records from before types were logged touch it
+func (DatabaseManager *DatabaseManager) loggedType(pageId uint64) byte {
+	transactions := DatabaseManager.wal.Cache[pageId]
+	for i := len(transactions) - 1; i >= 0; i-- {
+		if !transactions[i].Header.typed {
+			continue
+		}
+		for j := len(transactions[i].Body) - 1; j >= 0; j-- {
+			if transactions[i].Body[j].PageId == pageId {
+				return transactions[i].Body[j].NewType
+			}
+		}
+	}
+	return PagetypeUserdata
+}
+
+// SetCheckpointThreshold changes the WAL size that triggers a checkpoint.
+// If the WAL already exceeds the new threshold a checkpoint runs immediately
+func (DatabaseManager *DatabaseManager) SetCheckpointThreshold(thresholdInBytes uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.checkpointSizeThreshold = thresholdInBytes
+	return DatabaseManager.checkpointTrigger()
 }
 
 // AllocatePage allocates a new page of the specified type
 func (DatabaseManager *DatabaseManager) AllocatePage(pageType byte) (uint64, error) {
-	return DatabaseManager.allocator.AllocatePage(pageType)
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	id, err := DatabaseManager.allocator.AllocatePage(pageType)
+	if err != nil {
+		return id, err
+	}
+	DatabaseManager.modified[id] = DatabaseManager.wal.nextTransactionId
+	DatabaseManager.logEvent(EventPageAllocated, "page", id, "type", pageType)
+	return id, nil
+}
+
+// FreePage returns a page to the free list, checkpointing first if it has
+// changes not yet on disk
+func (DatabaseManager *DatabaseManager) FreePage(pageId uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	err := DatabaseManager.checkFreeable([]uint64{pageId})
+	if err != nil {
+		return err
+	}
+	return DatabaseManager.freePages([]uint64{pageId})
+}
+
+// ReadMetaField reads a named field from the metadata page
+func (DatabaseManager *DatabaseManager) ReadMetaField(key MetaField) (uint64, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.allocator.ReadMetaField(key)
+}
+
+// WriteMetaField writes a named field to the metadata page. Metadata
+// doesn't go through the WAL, the write is on disk when this returns
+func (DatabaseManager *DatabaseManager) WriteMetaField(key MetaField, value uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.allocator.WriteMetaField(key, value)
+}
+
+// SetMaxFileSize caps the size of the data file in bytes, 0 for no limit
+func (DatabaseManager *DatabaseManager) SetMaxFileSize(size int64) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.allocator.SetMaxFileSize(size)
+}
+
+// Shrink truncates the free pages at the end of the data file and returns
+// the bytes reclaimed
+func (DatabaseManager *DatabaseManager) Shrink() (int64, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	reclaimed, err := DatabaseManager.allocator.Shrink()
+	if err != nil {
+		return reclaimed, err
+	}
+	// free pages are only cached if something read them, drop the ones cut off
+	total, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return reclaimed, err
+	}
+	for pageId := range DatabaseManager.database {
+		if pageId >= total {
+			DatabaseManager.uncachePage(pageId)
+		}
+	}
+	return reclaimed, nil
+}
+
+// SetWalPreallocation makes the WAL grow in chunks of the given size, 0 to disable
+func (DatabaseManager *DatabaseManager) SetWalPreallocation(chunkSize uint64) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.wal.SetPreallocation(chunkSize)
+}
+
+// SetGroupCommit makes writes return only once their transaction is synced
+// to disk, sharing one fsync between writes committed within maxDelay of
+// each other, see WriteAheadLog.SetGroupCommit. Writers wait for the sync
+// without holding the manager lock, so concurrent writes join one batch
+func (DatabaseManager *DatabaseManager) SetGroupCommit(maxBatch int, maxDelay time.Duration) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.wal.SetGroupCommit(maxBatch, maxDelay)
+}
+
+// SetDirtyWatermark makes evicting an uncheckpointed page run a checkpoint
+// first once that many pages make up at least ratio of the cache capacity.
+// This bounds how much of the WAL reads have to replay. A ratio of 0 disables it
+func (DatabaseManager *DatabaseManager) SetDirtyWatermark(ratio float64) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.dirtyWatermark = ratio
+}
+
+// SetIORateLimit caps how many pages of data are read from or written to
+// the database file per second by cache misses, read transactions and
+// checkpoints. Operations exceeding it wait with the lock released, which
+// keeps a large scan or checkpoint from starving others. Checkpoints that
+// must hold the lock throughout aren't paced. A rate of 0 removes the limit
+func (DatabaseManager *DatabaseManager) SetIORateLimit(pagesPerSecond float64) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.limiter = nil
+	if pagesPerSecond > 0 {
+		DatabaseManager.limiter = NewRateLimiter(pagesPerSecond)
+	}
+}
+
+// SetEvictionBatch makes a full cache evict size pages at once instead of
+// one per miss, leaving it size-1 pages below capacity. This spreads the
+// cost of finding pages to evict over bursts of inserts
+func (DatabaseManager *DatabaseManager) SetEvictionBatch(size int) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.evictionBatch = size
+}
+
+// SetHeaderChecksum sets whether page checksums cover the page header.
+// The setting is stored in the database and kept when it is reopened
+func (DatabaseManager *DatabaseManager) SetHeaderChecksum(enabled bool) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if DatabaseManager.checkpointing {
+		return fmt.Errorf("cannot change checksum coverage during a checkpoint")
+	}
+	return DatabaseManager.allocator.SetHeaderChecksum(enabled)
+}
+
+// SetChecksumAlgorithm switches the algorithm page and WAL checksums are
+// computed with. The WAL is checkpointed first so every record in it uses
+// the new algorithm. The choice is stored in the database and used when it
+// is reopened
+func (DatabaseManager *DatabaseManager) SetChecksumAlgorithm(algorithm ChecksumAlgorithm) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing || DatabaseManager.maintenance > 0 {
+		return fmt.Errorf("cannot change the checksum algorithm during a read transaction, checkpoint or maintenance")
+	}
+	if !algorithm.valid() {
+		return fmt.Errorf("unknown checksum algorithm %d", algorithm)
+	}
+	if DatabaseManager.wal.fileSize != 0 {
+		err := DatabaseManager.flushCheckpoint()
+		if err != nil {
+			return err
+		}
+	}
+	err := DatabaseManager.allocator.SetChecksumAlgorithm(algorithm)
+	if err != nil {
+		return err
+	}
+	DatabaseManager.wal.checksum = algorithm
+	return nil
+}
+
+// SetOnEvict registers a hook called after a page is evicted from the cache,
+// so layers holding state derived from the page can drop it.
+// The hook runs with the manager locked and must not call back into it
+func (DatabaseManager *DatabaseManager) SetOnEvict(hook func(pageId uint64)) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.onEvict = hook
 }
 
 // GetPage retrieves a page from cache or disk, applying any pending WAL changes
 func (DatabaseManager *DatabaseManager) GetPage(pageId uint64) (PageData, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	entry, ok := DatabaseManager.database[pageId]
+	if !ok && DatabaseManager.limiter != nil {
+		// the page may have been cached while the lock was released
+		DatabaseManager.throttleUnlocked(1)
+		entry, ok = DatabaseManager.database[pageId]
+	}
+	DatabaseManager.stats.recordCacheAccess(ok)
+	if ok {
+		DatabaseManager.policy.Touch(pageId)
+		return entry.data, nil
+	}
+	data, err := DatabaseManager.loadPageFromDisc(pageId)
+	if err != nil {
+		return data, err
+	}
+	err = DatabaseManager.addCacheData(data, pageId)
+
+	return data, err
+}
+
+// GetPageNoPromote retrieves a page without promoting it in the cache.
+// A cache hit isn't reported to the cache policy and a miss inserts the page
+// as the next to be evicted, so one-off reads don't evict the hot set
+func (DatabaseManager *DatabaseManager) GetPageNoPromote(pageId uint64) (PageData, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
 	entry, ok := DatabaseManager.database[pageId]
+	if !ok && DatabaseManager.limiter != nil {
+		// the page may have been cached while the lock was released
+		DatabaseManager.throttleUnlocked(1)
+		entry, ok = DatabaseManager.database[pageId]
+	}
+	DatabaseManager.stats.recordCacheAccess(ok)
 	if ok {
-		DatabaseManager.makeHead(pageId)
 		return entry.data, nil
 	}
 	data, err := DatabaseManager.loadPageFromDisc(pageId)
-	DatabaseManager.addCacheData(data, pageId)
+	if err != nil {
+		return data, err
+	}
+	err = DatabaseManager.addCacheTail(data, pageId)
 
 	return data, err
 }
@@ -74,112 +415,577 @@ func (DatabaseManager *DatabaseManager) GetPage(pageId uint64) (PageData, error)
 // WritePages applies a set of changes to pages, ensuring ACID compliance
 // through WAL logging and checkpointing
 func (DatabaseManager *DatabaseManager) WritePages(changes []PageDelta) (uint64, error) {
-	// Check if we need to perform a checkpoint
+	return DatabaseManager.commitLogged(func() (uint64, *walSync, error) {
+		return DatabaseManager.writePages(changes)
+	})
+}
+
+// commitLogged runs write with the lock held, after a checkpoint if one is
+// due, and returns the value it returns. The sync of the transaction write
+// logged is waited for once the lock is released, so writers arriving
+// meanwhile can join its group commit batch
+func (DatabaseManager *DatabaseManager) commitLogged(write func() (uint64, *walSync, error)) (uint64, error) {
+	DatabaseManager.lock.Lock()
+	// the checkpoint releases the lock while it writes pages, it runs
+	// before write reads any state
 	err := DatabaseManager.checkpointTrigger()
 	if err != nil {
+		DatabaseManager.lock.Unlock()
 		return 0, err
 	}
+	response, synced, err := write()
+	DatabaseManager.lock.Unlock()
+	syncErr := synced.wait()
+	if err != nil {
+		return response, err
+	}
+	return response, syncErr
+}
+
+// writePages implements WritePages with the lock held. It doesn't
+// checkpoint or wait for the WAL sync, callers go through commitLogged
+func (DatabaseManager *DatabaseManager) writePages(changes []PageDelta) (uint64, *walSync, error) {
+	return DatabaseManager.writeTypedPages(changes, nil)
+}
+
+// writeTypedPages is writePages also changing the type of the pages in
+// types. The types are logged with the changes and written to the page
+// headers once the transaction is in the WAL, recovery writes them again
+// if a crash came in between
+func (DatabaseManager *DatabaseManager) writeTypedPages(changes []PageDelta, types map[uint64]byte) (uint64, *walSync, error) {
+	// Reject the batch before anything is mutated
+	err := DatabaseManager.validateDeltas(changes)
+	if err != nil {
+		return 0, nil, err
+	}
 
 	// Create a new transaction
 	transaction := Transaction{}
 	transaction.MakeTransaction()
 	transaction.Header.pageCount = uint32(len(changes))
+	transaction.Header.typed = true
+
+	// Pin every page until the deltas are applied, loading a later page
+	// must not evict an earlier one
+	pinned := []uint64{}
+	defer func() {
+		for _, pageId := range pinned {
+			DatabaseManager.unpin(pageId)
+		}
+	}()
 
 	// Process each page change
 	for _, pageDelta := range changes {
 		// Load the page from cache or disk
-		entry, ok := DatabaseManager.database[pageDelta.pageId]
-		var data PageData
-		if !ok {
-			var err error
-			discData, err := DatabaseManager.loadPageFromDisc(pageDelta.pageId)
-			DatabaseManager.addCacheData(discData, pageDelta.pageId)
-			data = discData
-			if err != nil {
-				return 0, err
-			}
-		} else {
-			DatabaseManager.makeHead(pageDelta.pageId)
-			data = entry.data
+		data, err := DatabaseManager.pin(pageDelta.pageId)
+		if err != nil {
+			return 0, nil, err
 		}
+		pinned = append(pinned, pageDelta.pageId)
 
 		// Create WAL entry for the change
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageDelta.pageId)
+		if err != nil {
+			return 0, nil, err
+		}
 		body := PageEntry{}
 		body.PageId = pageDelta.pageId
 		body.Offset = pageDelta.offset
 		body.Length = uint32(len(pageDelta.newData))
+		body.OldType = header.PageType
+		body.NewType = header.PageType
+		pageType, ok := types[pageDelta.pageId]
+		if ok {
+			body.NewType = pageType
+		}
 		body.NewData = pageDelta.newData
 
 		// Validate the change is within page bounds
 		end := int(pageDelta.offset) + len(pageDelta.newData)
 		if end > len(data) {
-			return 0, fmt.Errorf("delta out of bounds on page %d", pageDelta.pageId)
+			return 0, nil, fmt.Errorf("delta out of bounds on page %d", pageDelta.pageId)
 		}
-		body.OldData = data[pageDelta.offset : body.Length+pageDelta.offset]
+		// Copy the old bytes, applying the delta below overwrites the page
+		body.OldData = append([]byte{}, data[pageDelta.offset:body.Length+pageDelta.offset]...)
 		transaction.Body = append(transaction.Body, body)
 	}
 
 	// Apply changes to pages
 	for _, pageDelta := range changes {
-		DatabaseManager.applyDelta(pageDelta)
+		err = DatabaseManager.applyDelta(pageDelta)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
 
 	// Log the transaction to WAL
-	err, transactionId := DatabaseManager.wal.AppendTransaction(transaction)
+	walSize := DatabaseManager.wal.fileSize
+	err, transactionId, synced := DatabaseManager.wal.appendGrouped(transaction)
+	if err != nil {
+		return transactionId, nil, err
+	}
+	DatabaseManager.stats.recordTransaction(DatabaseManager.wal.fileSize - walSize)
+	for _, pageDelta := range changes {
+		DatabaseManager.modified[pageDelta.pageId] = transactionId
+	}
+	err = DatabaseManager.writeLoggedTypes(&transaction)
+	if err != nil {
+		return transactionId, synced, err
+	}
+	DatabaseManager.logEvent(EventTransactionCommitted, "transaction", transactionId, "pages", len(changes), "bytes", DatabaseManager.wal.fileSize-walSize)
+
+	return transactionId, synced, nil
+}
+
+// RollbackTransaction undoes a transaction still in the WAL by writing its
+// old data back as a new transaction, so the undo is durable too. It fails
+// if a later transaction wrote any of the same bytes, since restoring them
+// would lose the newer data
+func (DatabaseManager *DatabaseManager) RollbackTransaction(transactionId uint64) error {
+	_, err := DatabaseManager.commitLogged(func() (uint64, *walSync, error) {
+		return DatabaseManager.rollbackTransaction(transactionId)
+	})
+	return err
+}
+
+// rollbackTransaction implements RollbackTransaction with the lock held
+func (DatabaseManager *DatabaseManager) rollbackTransaction(transactionId uint64) (uint64, *walSync, error) {
+	var target *Transaction
+	later := []*Transaction{}
+	for _, transaction := range DatabaseManager.wal.ordered {
+		if transaction.Header.transactionId == transactionId {
+			target = transaction
+		} else if target != nil {
+			later = append(later, transaction)
+		}
+	}
+	if target == nil {
+		return 0, nil, fmt.Errorf("transaction %d is not in the WAL", transactionId)
+	}
+
+	for _, transaction := range later {
+		for _, newer := range transaction.Body {
+			for _, body := range target.Body {
+				if newer.PageId == body.PageId && newer.Offset < body.Offset+body.Length && body.Offset < newer.Offset+newer.Length {
+					return 0, nil, fmt.Errorf("transaction %d overwrote page %d after transaction %d", transaction.Header.transactionId, body.PageId, transactionId)
+				}
+			}
+		}
+	}
+
+	// undo in reverse so overlapping deltas within the transaction unwind,
+	// page types are restored too when the record logged them
+	changes := []PageDelta{}
+	types := make(map[uint64]byte)
+	for i := len(target.Body) - 1; i >= 0; i-- {
+		body := target.Body[i]
+		changes = append(changes, PageDelta{body.PageId, body.Offset, body.OldData})
+		if target.Header.typed {
+			types[body.PageId] = body.OldType
+		}
+	}
+	return DatabaseManager.writeTypedPages(changes, types)
+}
+
+// writeLoggedTypes writes the page types a logged transaction changed to
+// the page headers
+func (DatabaseManager *DatabaseManager) writeLoggedTypes(transaction *Transaction) error {
+	if !transaction.Header.typed {
+		return nil
+	}
+	for _, body := range transaction.Body {
+		if body.NewType == body.OldType {
+			continue
+		}
+		header, err := DatabaseManager.allocator.ReadPageHeader(body.PageId)
+		if err != nil {
+			return err
+		}
+		if header.PageType == body.NewType {
+			continue
+		}
+		err = DatabaseManager.allocator.WritePageHeader(body.PageId, PageHeaderTypeOffset, body.NewType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrPageNotAllocated is returned when a change targets a page past the
+// end of the data file
+var ErrPageNotAllocated = errors.New("page is not allocated")
 
-	return transactionId, err
+// ValidateDeltas checks every delta in a batch without applying any of them
+// or touching the cache. It returns the first problem found along with the
+// index of the delta, so a batch can be checked before it is committed
+func (DatabaseManager *DatabaseManager) ValidateDeltas(changes []PageDelta) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.validateDeltas(changes)
+}
+
+// validateDeltas implements ValidateDeltas with the lock held
+func (DatabaseManager *DatabaseManager) validateDeltas(changes []PageDelta) error {
+	count, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	for i, pageDelta := range changes {
+		if pageDelta.pageId == 0 {
+			return fmt.Errorf("delta %d: page 0 holds the database metadata", i)
+		}
+		if pageDelta.pageId >= count {
+			return fmt.Errorf("delta %d: %w: page %d is past the last page %d", i, ErrPageNotAllocated, pageDelta.pageId, count-1)
+		}
+		end := int64(pageDelta.offset) + int64(len(pageDelta.newData))
+		if end > DatabaseManager.allocator.PageSize-PageHeaderSize {
+			return fmt.Errorf("delta %d: delta out of bounds on page %d", i, pageDelta.pageId)
+		}
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageDelta.pageId)
+		if err != nil {
+			return fmt.Errorf("delta %d: %w", i, err)
+		}
+		if header.PageType == PagetypeFreepage {
+			return fmt.Errorf("delta %d: page %d is free", i, pageDelta.pageId)
+		}
+	}
+	return nil
+}
+
+// SwapPages exchanges the contents of two pages in a single transaction so
+// that references to either page id stay valid. Differing page types are
+// logged in the same transaction and swapped in the headers once it is.
+// The metadata page and free pages can't be swapped
+func (DatabaseManager *DatabaseManager) SwapPages(a uint64, b uint64) (uint64, error) {
+	return DatabaseManager.commitLogged(func() (uint64, *walSync, error) {
+		return DatabaseManager.swapPages(a, b)
+	})
+}
+
+// swapPages implements SwapPages with the lock held
+func (DatabaseManager *DatabaseManager) swapPages(a uint64, b uint64) (uint64, *walSync, error) {
+	if a == b {
+		return 0, nil, fmt.Errorf("cannot swap page %d with itself", a)
+	}
+	if a == 0 || b == 0 {
+		return 0, nil, fmt.Errorf("cannot swap page 0, it holds the database metadata")
+	}
+	headerA, err := DatabaseManager.allocator.ReadPageHeader(a)
+	if err != nil {
+		return 0, nil, err
+	}
+	headerB, err := DatabaseManager.allocator.ReadPageHeader(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if headerA.PageType == PagetypeFreepage || headerB.PageType == PagetypeFreepage {
+		return 0, nil, fmt.Errorf("cannot swap pages %d and %d, free pages belong to the free list", a, b)
+	}
+
+	// copy each page, loading the second may evict the first
+	dataA, err := DatabaseManager.cachePage(a)
+	if err != nil {
+		return 0, nil, err
+	}
+	copyA := append([]byte{}, dataA[:]...)
+	dataB, err := DatabaseManager.cachePage(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	copyB := append([]byte{}, dataB[:]...)
+
+	// the types are swapped in the same transaction as the data
+	types := map[uint64]byte{a: headerB.PageType, b: headerA.PageType}
+	return DatabaseManager.writeTypedPages([]PageDelta{{a, 0, copyB}, {b, 0, copyA}}, types)
+}
+
+// WritePagesUnlogged applies changes to cached pages without writing a WAL
+// record. The pages reach the data file at the next checkpoint or when they
+// are evicted, so a crash before then loses the changes. It is meant for
+// scratch data where durability doesn't matter, and pages written this way
+// should not also be written through WritePages or read through a ReadTxn
+func (DatabaseManager *DatabaseManager) WritePagesUnlogged(changes []PageDelta) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+
+	// Validate every change before applying any of them
+	for _, pageDelta := range changes {
+		data, err := DatabaseManager.cachePage(pageDelta.pageId)
+		if err != nil {
+			return err
+		}
+		end := int(pageDelta.offset) + len(pageDelta.newData)
+		if end > len(data) {
+			return fmt.Errorf("delta out of bounds on page %d", pageDelta.pageId)
+		}
+	}
+
+	for _, pageDelta := range changes {
+		err := DatabaseManager.applyDelta(pageDelta)
+		if err != nil {
+			return err
+		}
+		DatabaseManager.unlogged[pageDelta.pageId] = true
+		DatabaseManager.modified[pageDelta.pageId] = DatabaseManager.wal.nextTransactionId
+	}
+	return nil
+}
+
+// WriteAt writes data to a single page region as one transaction.
+// It is a convenience over WritePages with the same bounds checking
+func (DatabaseManager *DatabaseManager) WriteAt(pageId uint64, offset uint32, data []byte) (uint64, error) {
+	return DatabaseManager.WritePages([]PageDelta{{pageId, offset, data}})
+}
+
+// Sync flushes the WAL and the data file to disk without a checkpoint.
+// Both files are synced and the first error is returned
+func (DatabaseManager *DatabaseManager) Sync() error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	walErr := DatabaseManager.wal.sync()
+	err := DatabaseManager.allocator.Database.Sync()
+	if walErr != nil {
+		return walErr
+	}
+	return err
+}
+
+// Materialize writes the current version of every page with changes in the
+// WAL, or written unlogged, to the data file and syncs it, keeping the WAL.
+// Replaying the log over the written pages gives the same pages, so the
+// data file can be checked against the logical state without a checkpoint.
+// Read transactions read the data file as their base, so it refuses to run
+// while any are open
+func (DatabaseManager *DatabaseManager) Materialize() error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing {
+		return fmt.Errorf("cannot materialize pages during a read transaction or checkpoint")
+	}
+	for pageId := range DatabaseManager.wal.Cache {
+		var data PageData
+		entry, ok := DatabaseManager.database[pageId]
+		if ok {
+			if !entry.dirty {
+				continue
+			}
+			data = entry.data
+		} else {
+			var err error
+			data, err = DatabaseManager.loadPageFromDisc(pageId)
+			if err != nil {
+				return err
+			}
+		}
+		err := DatabaseManager.allocator.WritePageData(pageId, data)
+		if err != nil {
+			return err
+		}
+		if ok {
+			entry.dirty = false
+		}
+	}
+	for pageId := range DatabaseManager.unlogged {
+		entry := DatabaseManager.database[pageId]
+		err := DatabaseManager.allocator.WritePageData(pageId, entry.data)
+		if err != nil {
+			return err
+		}
+		delete(DatabaseManager.unlogged, pageId)
+		entry.dirty = false
+	}
+	return DatabaseManager.allocator.Database.Sync()
+}
+
+// RecoveryEstimate scans the WAL on disk and reports how many transactions
+// and bytes would be replayed on the next open, without applying them
+func (DatabaseManager *DatabaseManager) RecoveryEstimate() (int, uint64, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.wal.scanValid()
 }
 
 func (DatabaseManager *DatabaseManager) Shutdown() {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
 	DatabaseManager.wal.closeFile()
 	DatabaseManager.allocator.CloseFile()
 }
 
 // loadPageFromDisc loads a page from disk and applies any pending WAL changes
 func (DatabaseManager *DatabaseManager) loadPageFromDisc(pageId uint64) (PageData, error) {
-	data, err := DatabaseManager.allocator.ReadPageData(pageId)
+	data, err := DatabaseManager.readDiskPage(pageId)
 	if err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			DatabaseManager.logEvent(EventCorruptionDetected, "page", pageId, "error", err)
+		}
 		return data, err
 	}
 
 	// Apply any pending WAL changes to the page
-	walEntries, ok := DatabaseManager.wal.Cache[pageId]
+	err = DatabaseManager.wal.applyPage(pageId, data)
+	return data, err
+}
+
+// cachePage returns a page from the cache, loading it from disk on a miss
+func (DatabaseManager *DatabaseManager) cachePage(pageId uint64) (PageData, error) {
+	entry, ok := DatabaseManager.database[pageId]
+	DatabaseManager.stats.recordCacheAccess(ok)
 	if ok {
-		for _, e := range walEntries {
-			for _, body := range e.Body {
-				if body.PageId != pageId {
-					continue
-				}
-				for i, b := range body.NewData {
-					data[body.Offset+uint32(i)] = b
-				}
-			}
-		}
+		DatabaseManager.policy.Touch(pageId)
+		return entry.data, nil
 	}
+	data, err := DatabaseManager.loadPageFromDisc(pageId)
+	if err != nil {
+		return data, err
+	}
+	err = DatabaseManager.addCacheData(data, pageId)
+	return data, err
+}
 
-	return data, nil
+// checkpointSnapshot holds copies of the pages a checkpoint writes and
+// the id of the first transaction it doesn't cover
+type checkpointSnapshot struct {
+	start    time.Time
+	pages    map[uint64]PageData
+	unlogged []uint64
+	cleaned  []uint64 // Cached pages whose dirty bit the snapshot cleared
+	boundary uint64
 }
 
-// flushCheckpoint writes all dirty pages to disk and clears the WAL
+// flushCheckpoint writes all dirty pages to disk and clears the WAL,
+// holding the lock throughout
 func (DatabaseManager *DatabaseManager) flushCheckpoint() error {
-	var data PageData
+	snapshot, err := DatabaseManager.snapshotCheckpoint()
+	if err != nil {
+		return err
+	}
+	err = DatabaseManager.writeCheckpoint(snapshot, nil)
+	return DatabaseManager.finishCheckpoint(snapshot, err)
+}
+
+// flushCheckpointUnlocked is flushCheckpoint with the lock released while
+// pages are written, so other operations only stall for the snapshot and
+// the WAL rewrite. It must be called with the lock held and no state of
+// the caller's own depending on the cache, the lock is held again on return
+func (DatabaseManager *DatabaseManager) flushCheckpointUnlocked() error {
+	snapshot, err := DatabaseManager.snapshotCheckpoint()
+	if err != nil {
+		return err
+	}
+	limiter := DatabaseManager.limiter
+	DatabaseManager.lock.Unlock()
+	err = DatabaseManager.writeCheckpoint(snapshot, limiter)
+	DatabaseManager.lock.Lock()
+	return DatabaseManager.finishCheckpoint(snapshot, err)
+}
+
+// snapshotCheckpoint copies every page changed since the last checkpoint.
+// Until the checkpoint finishes pages missing from the cache are read from
+// the snapshot instead of the data file, which may be half written
+func (DatabaseManager *DatabaseManager) snapshotCheckpoint() (checkpointSnapshot, error) {
+	snapshot := checkpointSnapshot{
+		start:    time.Now(),
+		pages:    make(map[uint64]PageData),
+		boundary: DatabaseManager.wal.nextTransactionId,
+	}
+	DatabaseManager.logEvent(EventCheckpointStarted, "wal_bytes", DatabaseManager.wal.fileSize, "pages", len(DatabaseManager.wal.Cache))
 	for pageId := range DatabaseManager.wal.Cache {
+		var data PageData
 		entry, ok := DatabaseManager.database[pageId]
-		data = entry.data
-		if !ok {
+		if ok {
+			// cached pages already matching the data file are skipped
+			if !entry.dirty {
+				continue
+			}
+			data = entry.data
+			entry.dirty = false
+			snapshot.cleaned = append(snapshot.cleaned, pageId)
+		} else {
 			var err error
 			data, err = DatabaseManager.loadPageFromDisc(pageId)
 			if err != nil {
-				return err
+				return snapshot, err
 			}
 		}
+		snapshot.pages[pageId] = slices.Clone(data)
+	}
+	// unlogged pages are always cached until they are written, a page
+	// written unlogged again during the checkpoint is marked again
+	for pageId := range DatabaseManager.unlogged {
+		entry := DatabaseManager.database[pageId]
+		snapshot.pages[pageId] = slices.Clone(entry.data)
+		snapshot.unlogged = append(snapshot.unlogged, pageId)
+		delete(DatabaseManager.unlogged, pageId)
+		entry.dirty = false
+		snapshot.cleaned = append(snapshot.cleaned, pageId)
+	}
+	DatabaseManager.checkpointing = true
+	DatabaseManager.flushing = snapshot.pages
+	return snapshot, nil
+}
+
+// writeCheckpoint writes the snapshot pages to the data file, pacing the
+// writes with limiter unless it is nil
+func (DatabaseManager *DatabaseManager) writeCheckpoint(snapshot checkpointSnapshot, limiter *RateLimiter) error {
+	for pageId, data := range snapshot.pages {
+		if limiter != nil {
+			limiter.Wait(1)
+		}
 		err := DatabaseManager.allocator.WritePageData(pageId, data)
 		if err != nil {
 			return err
 		}
 	}
-	err := DatabaseManager.wal.clearFromDisc()
-	return err
+	return nil
+}
+
+// finishCheckpoint drops the transactions covered by the snapshot from the
+// WAL, keeping any committed while the pages were written. On a failed
+// write the WAL is left alone and unlogged pages are marked again
+func (DatabaseManager *DatabaseManager) finishCheckpoint(snapshot checkpointSnapshot, err error) error {
+	DatabaseManager.checkpointing = false
+	DatabaseManager.flushing = nil
+	if err != nil {
+		for _, pageId := range snapshot.unlogged {
+			DatabaseManager.unlogged[pageId] = true
+		}
+		for _, pageId := range snapshot.cleaned {
+			entry, ok := DatabaseManager.database[pageId]
+			if ok {
+				entry.dirty = true
+			}
+		}
+		return err
+	}
+	// the ids of the dropped transactions must never be handed out again,
+	// the pages and the saved id are on disk before the records are gone
+	err = DatabaseManager.allocator.WriteMetaField(MetaNextTransactionId, DatabaseManager.wal.nextTransactionId)
+	if err != nil {
+		return err
+	}
+	err = DatabaseManager.allocator.Database.Sync()
+	if err != nil {
+		return err
+	}
+	err = DatabaseManager.wal.dropBefore(snapshot.boundary)
+	if err != nil {
+		return err
+	}
+	DatabaseManager.stats.recordCheckpoint(snapshot.start, time.Since(snapshot.start))
+	DatabaseManager.logEvent(EventCheckpointFinished, "duration", time.Since(snapshot.start))
+	return nil
+}
+
+// readDiskPage reads a page from the data file, or from the snapshot of a
+// checkpoint in progress
+func (DatabaseManager *DatabaseManager) readDiskPage(pageId uint64) (PageData, error) {
+	data, ok := DatabaseManager.flushing[pageId]
+	if ok {
+		return slices.Clone(data), nil
+	}
+	return DatabaseManager.allocator.ReadPageData(pageId)
 }
 
 func (DatabaseManager *DatabaseManager) applyDelta(change PageDelta) error {
@@ -195,65 +1001,121 @@ func (DatabaseManager *DatabaseManager) applyDelta(change PageDelta) error {
 		return fmt.Errorf("delta out of bounds on page %d", change.pageId)
 	}
 	// apply delta
-	for i, b := range change.newData {
-		DatabaseManager.database[change.pageId].data[change.offset+uint32(i)] = b
-	}
+	copy(data[change.offset:], change.newData)
+	entry.dirty = true
 	return nil
 }
 
+// checkpointTrigger checkpoints once the WAL reached the threshold. The lock
+// is released while pages are written, so public methods call it before
+// reading any state they act on later
 func (DatabaseManager *DatabaseManager) checkpointTrigger() error {
+	// open read transactions rely on the WAL to rebuild their snapshot
+	if DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing || DatabaseManager.maintenance > 0 {
+		return nil
+	}
 	if DatabaseManager.wal.fileSize >= DatabaseManager.checkpointSizeThreshold {
-		return DatabaseManager.flushCheckpoint()
+		return DatabaseManager.flushCheckpointUnlocked()
 	}
 	return nil
 }
 
-func (DatabaseManager *DatabaseManager) addCacheData(data PageData, pageId uint64) {
-	if len(DatabaseManager.database) >= DatabaseManager.cacheCapacityPages {
-		DatabaseManager.removeTail()
-	}
-	newEntry := CacheEntry{data, nil, DatabaseManager.head}
-	if DatabaseManager.head != nil {
-		DatabaseManager.head.next = &newEntry
-	} else {
-		DatabaseManager.tail = &newEntry
+func (DatabaseManager *DatabaseManager) addCacheData(data PageData, pageId uint64) error {
+	if len(DatabaseManager.database) >= DatabaseManager.cacheCapacityPages && !DatabaseManager.deferEviction() {
+		err := DatabaseManager.dirtyTrigger()
+		if err != nil {
+			return err
+		}
+		err = DatabaseManager.evictPages()
+		if err != nil {
+			return err
+		}
 	}
-	DatabaseManager.database[pageId] = &newEntry
-	DatabaseManager.head = &newEntry
+	// pages loaded with WAL changes applied differ from the data file
+	_, dirty := DatabaseManager.wal.Cache[pageId]
+	DatabaseManager.database[pageId] = &CacheEntry{data, dirty}
+	DatabaseManager.policy.Insert(pageId)
+	return nil
+}
 
+// addCacheTail inserts a page as the next one to be evicted
+func (DatabaseManager *DatabaseManager) addCacheTail(data PageData, pageId uint64) error {
+	if len(DatabaseManager.database) >= DatabaseManager.cacheCapacityPages && !DatabaseManager.deferEviction() {
+		err := DatabaseManager.evictPages()
+		if err != nil {
+			return err
+		}
+	}
+	_, dirty := DatabaseManager.wal.Cache[pageId]
+	DatabaseManager.database[pageId] = &CacheEntry{data, dirty}
+	DatabaseManager.policy.InsertCold(pageId)
+	return nil
 }
 
-func (DatabaseManager *DatabaseManager) makeHead(pageId uint64) {
-	if DatabaseManager.database[pageId].next != nil {
-		DatabaseManager.database[pageId].next.prev = DatabaseManager.database[pageId].prev
+// dirtyTrigger checkpoints before the next victim is evicted if it has
+// uncheckpointed changes and the dirty pages reached the watermark
+func (DatabaseManager *DatabaseManager) dirtyTrigger() error {
+	if DatabaseManager.dirtyWatermark <= 0 || DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing || DatabaseManager.maintenance > 0 {
+		return nil
+	}
+	victim, ok := DatabaseManager.policy.Victim()
+	if !ok {
+		return nil
 	}
-	if DatabaseManager.database[pageId].prev != nil {
-		DatabaseManager.database[pageId].prev.next = DatabaseManager.database[pageId].next
+	if _, ok := DatabaseManager.wal.Cache[victim]; !ok {
+		return nil
 	}
-	DatabaseManager.database[pageId].prev = DatabaseManager.head
-	DatabaseManager.database[pageId].next = nil
-	DatabaseManager.head = DatabaseManager.database[pageId]
+	dirty := len(DatabaseManager.wal.Cache)
+	if float64(dirty) >= DatabaseManager.dirtyWatermark*float64(DatabaseManager.cacheCapacityPages) {
+		return DatabaseManager.flushCheckpoint()
+	}
+	return nil
 }
 
-func (DatabaseManager *DatabaseManager) removeTail() {
-	tail := DatabaseManager.tail
-	if tail == nil {
-		return
-	}
+// evictPages makes room for one page in a full cache. At least
+// evictionBatch pages are evicted at once, leaving room for the next
+// misses without evicting for each of them
+func (DatabaseManager *DatabaseManager) evictPages() error {
+	count := len(DatabaseManager.database) - DatabaseManager.cacheCapacityPages + 1
+	return DatabaseManager.removeVictims(max(count, DatabaseManager.evictionBatch))
+}
 
-	for pageId, entry := range DatabaseManager.database {
-		if tail == entry {
-			delete(DatabaseManager.database, pageId)
+// removeVictims evicts up to count pages chosen by the cache policy.
+// During maintenance it stops before a page with unlogged changes
+func (DatabaseManager *DatabaseManager) removeVictims(count int) error {
+	for i := 0; i < count; i++ {
+		if i > 0 && DatabaseManager.deferEviction() {
+			break
+		}
+		evicted, ok := DatabaseManager.policy.Victim()
+		if !ok {
 			break
 		}
+		err := DatabaseManager.removeVictim(evicted)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if tail.next != nil {
-		DatabaseManager.tail = tail.next
-		DatabaseManager.tail.prev = nil
-	} else {
-		DatabaseManager.head = nil
-		DatabaseManager.tail = nil
+// removeVictim evicts page evicted, the current victim of the cache policy
+func (DatabaseManager *DatabaseManager) removeVictim(evicted uint64) error {
+	// unlogged changes only live in the cache, write them out before dropping
+	if DatabaseManager.unlogged[evicted] {
+		err := DatabaseManager.allocator.WritePageData(evicted, DatabaseManager.database[evicted].data)
+		if err != nil {
+			return err
+		}
+		delete(DatabaseManager.unlogged, evicted)
 	}
+	DatabaseManager.policy.Evict()
+	delete(DatabaseManager.database, evicted)
 
+	// notify only once the entry is fully unlinked
+	DatabaseManager.logEvent(EventPageEvicted, "page", evicted)
+	if DatabaseManager.onEvict != nil {
+		DatabaseManager.onEvict(evicted)
+	}
+	return nil
 }
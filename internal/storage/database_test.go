@@ -1,9 +1,18 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newDatabase(t *testing.T, checkPointTrigger uint64, cacheSize int) *DatabaseManager {
@@ -13,12 +22,12 @@ func newDatabase(t *testing.T, checkPointTrigger uint64, cacheSize int) *Databas
 		t.Fatal("Failed to initialize database :", err)
 	}
 
-	err = DatabaseManager.wal.Initialize("test.log")
+	err = DatabaseManager.allocator.Initialize("test.db", 0)
 	if err != nil {
 		t.Fatal("Failed to initialize database :", err)
 	}
 
-	err = DatabaseManager.allocator.Initialize("test.db")
+	err = DatabaseManager.openWal("test.log")
 	if err != nil {
 		t.Fatal("Failed to initialize database :", err)
 	}
@@ -273,3 +282,2237 @@ func TestCheckpointTrigger(t *testing.T) {
 	}
 
 }
+
+func TestGetPageNoPromote(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 3)
+	defer DatabaseManager.Shutdown()
+
+	// allocate some pages
+	PageCount := 4
+	pageIDs := []uint64{}
+	for i := 0; i < PageCount; i++ {
+		pageID, err := DatabaseManager.allocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	// fill the cache, first page is the eviction victim
+	for _, id := range pageIDs[:3] {
+		_, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Read failed for page", id, ":", err)
+		}
+	}
+
+	// a no promote hit must not save the victim
+	_, err := DatabaseManager.GetPageNoPromote(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	_, err = DatabaseManager.GetPage(pageIDs[3])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[3], ":", err)
+	}
+	if _, ok := DatabaseManager.database[pageIDs[0]]; ok {
+		t.Fatal("Page 0 was promoted by a no promote read")
+	}
+
+	// a no promote miss is inserted as the next victim
+	_, err = DatabaseManager.GetPageNoPromote(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	if _, ok := DatabaseManager.database[pageIDs[1]]; ok {
+		t.Fatal("Page 1 was not evicted by the no promote miss")
+	}
+	_, err = DatabaseManager.GetPage(pageIDs[1])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[1], ":", err)
+	}
+	if _, ok := DatabaseManager.database[pageIDs[0]]; ok {
+		t.Fatal("Page 0 was not the eviction victim after a no promote miss")
+	}
+	for _, id := range pageIDs[1:] {
+		if _, ok := DatabaseManager.database[id]; !ok {
+			t.Error("Hot page", id, "was evicted")
+		}
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	// allocate some pages
+	pageIDs := []uint64{}
+	for i := 0; i < 2; i++ {
+		pageID, err := DatabaseManager.allocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	data := make([]byte, 64)
+	rand.Read(data[:])
+
+	// same region written through WriteAt and through WritePages
+	_, err := DatabaseManager.WriteAt(pageIDs[0], 100, data)
+	if err != nil {
+		t.Fatal("WriteAt failed for page", pageIDs[0], ":", err)
+	}
+	_, err = DatabaseManager.WritePages([]PageDelta{
+		{
+			pageIDs[1],
+			100,
+			data,
+		},
+	})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIDs[1], ":", err)
+	}
+
+	first, err := DatabaseManager.GetPage(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	second, err := DatabaseManager.GetPage(pageIDs[1])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[1], ":", err)
+	}
+	if string(first[:]) != string(second[:]) {
+		t.Error("WriteAt result differs from WritePages")
+	}
+
+	// bounds are checked like WritePages
+	_, err = DatabaseManager.WriteAt(pageIDs[0], uint32(len(first))-10, data)
+	if err == nil {
+		t.Error("Expected out of bounds error from WriteAt")
+	}
+}
+
+func TestEngineStats(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	// allocate some pages
+	PageCount := 5
+	pageIDs := []uint64{}
+	for i := 0; i < PageCount; i++ {
+		pageID, err := DatabaseManager.allocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	// every full page write is larger than half the threshold,
+	// so a checkpoint fires before every third write
+	for _, id := range pageIDs {
+		data := MakePageData()
+		rand.Read(data[:])
+		_, err := DatabaseManager.WritePages([]PageDelta{
+			{
+				id,
+				0,
+				data[:],
+			},
+		})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+
+	stats := DatabaseManager.EngineStats()
+	if stats.Transactions != uint64(PageCount) {
+		t.Error("Expected", PageCount, "transactions but got", stats.Transactions)
+	}
+	if stats.Checkpoints != 2 {
+		t.Error("Expected 2 checkpoints but got", stats.Checkpoints)
+	}
+	if stats.AvgTransactionsPerCheckpoint != 2 {
+		t.Error("Expected 2 transactions per checkpoint but got", stats.AvgTransactionsPerCheckpoint)
+	}
+	pageSize := float64(len(MakePageData()))
+	if stats.AvgTransactionBytes < 2*pageSize || stats.AvgTransactionBytes > 2*pageSize+100 {
+		t.Error("Average transaction size out of range :", stats.AvgTransactionBytes)
+	}
+	if stats.AvgCheckpointDuration <= 0 {
+		t.Error("Expected a positive checkpoint duration, got", stats.AvgCheckpointDuration)
+	}
+}
+
+func TestSetCheckpointThreshold(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	data := MakePageData()
+	rand.Read(data[:])
+	_, err = DatabaseManager.WriteAt(id, 0, data[:])
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	if DatabaseManager.EngineStats().Checkpoints != 0 {
+		t.Fatal("Checkpoint fired below the initial threshold")
+	}
+
+	// lowering below the current WAL size checkpoints immediately
+	err = DatabaseManager.SetCheckpointThreshold(1000)
+	if err != nil {
+		t.Fatal("Failed to set checkpoint threshold :", err)
+	}
+	if DatabaseManager.EngineStats().Checkpoints != 1 {
+		t.Fatal("Expected a checkpoint after lowering the threshold")
+	}
+	if DatabaseManager.wal.fileSize != 0 {
+		t.Error("WAL not cleared after checkpoint, size", DatabaseManager.wal.fileSize)
+	}
+	readData, err := DatabaseManager.allocator.ReadPageData(id)
+	if err != nil {
+		t.Fatal("Page read failed  :", err)
+	}
+	if string(readData[:]) != string(data[:]) {
+		t.Error("Data mismatch during transfer to disk at page ", id)
+	}
+
+	// changing the threshold while writing must be safe
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			_, err := DatabaseManager.WriteAt(id, uint32(i), []byte{byte(i)})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		err = DatabaseManager.SetCheckpointThreshold(uint64(100 * (i % 3)))
+		if err != nil {
+			t.Fatal("Failed to set checkpoint threshold :", err)
+		}
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal("Concurrent write failed :", err)
+	}
+}
+
+// syncingStorage records the syncs of the data file
+type syncingStorage struct {
+	Storage
+	syncs *[]string
+}
+
+func (syncingStorage *syncingStorage) Sync() error {
+	*syncingStorage.syncs = append(*syncingStorage.syncs, "data")
+	return syncingStorage.Storage.Sync()
+}
+
+func TestSync(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	// the WAL is synced before the data file
+	syncs := []string{}
+	DatabaseManager.wal.syncFile = func(file *os.File) error {
+		syncs = append(syncs, "wal")
+		return file.Sync()
+	}
+	DatabaseManager.allocator.Database = &syncingStorage{DatabaseManager.allocator.Database, &syncs}
+	err = DatabaseManager.Sync()
+	if err != nil {
+		t.Fatal("Sync failed :", err)
+	}
+	if !slices.Equal(syncs, []string{"wal", "data"}) {
+		t.Error("Expected the WAL and then the data file to sync, got", syncs)
+	}
+
+	// a failing data file sync is reported even when the WAL syncs
+	DatabaseManager.allocator.CloseFile()
+	err = DatabaseManager.Sync()
+	if err == nil {
+		t.Error("Expected sync error for closed data file")
+	}
+
+	// the WAL error is reported first
+	DatabaseManager.wal.closeFile()
+	err = DatabaseManager.Sync()
+	if err == nil || err.Error() != DatabaseManager.wal.Log.Sync().Error() {
+		t.Error("Expected the WAL sync error first, got", err)
+	}
+}
+
+func TestReadTransaction(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{1, 1, 1})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	readTxn := DatabaseManager.BeginRead()
+
+	// a write committed after the read began, large enough to pass the threshold
+	data := MakePageData()
+	rand.Read(data[:])
+	copy(data[:], []byte{2, 2, 2})
+	_, err = DatabaseManager.WriteAt(id, 0, data[:])
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 0, data[:])
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	if DatabaseManager.EngineStats().Checkpoints != 0 {
+		t.Fatal("Checkpoint fired during an open read transaction")
+	}
+
+	snapshot, err := readTxn.GetPage(id)
+	if err != nil {
+		t.Fatal("Snapshot read failed for page", id, ":", err)
+	}
+	if snapshot[0] != 1 || snapshot[3] != 0 {
+		t.Error("Read transaction observed a later write", snapshot[:4])
+	}
+
+	current, err := DatabaseManager.GetPage(id)
+	if err != nil {
+		t.Fatal("Read failed for page", id, ":", err)
+	}
+	if string(current[:]) != string(data[:]) {
+		t.Error("Current read did not observe the write")
+	}
+
+	readTxn.End()
+	_, err = readTxn.GetPage(id)
+	if err == nil {
+		t.Error("Expected error reading from an ended transaction")
+	}
+
+	// checkpoints resume once the read has ended
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{3})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	if DatabaseManager.EngineStats().Checkpoints != 1 {
+		t.Error("Checkpoint did not resume after the read ended")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	first, err := DatabaseManager.WriteAt(id, 0, []byte{1, 1, 1})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 1, []byte{2, 2})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	snapshot, err := DatabaseManager.BeginSnapshot(first)
+	if err != nil {
+		t.Fatal("Failed to begin snapshot:", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 2, []byte{3, 3})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	// the snapshot undoes both transactions after the first write
+	data, err := snapshot.GetPage(id)
+	if err != nil {
+		t.Fatal("Snapshot read failed for page", id, ":", err)
+	}
+	if !slices.Equal(data[:4], []byte{1, 1, 1, 0}) {
+		t.Error("Snapshot observed a later write", data[:4])
+	}
+	current, err := DatabaseManager.GetPage(id)
+	if err != nil {
+		t.Fatal("Read failed for page", id, ":", err)
+	}
+	if !slices.Equal(current[:4], []byte{1, 2, 3, 3}) {
+		t.Error("Current read did not observe the writes", current[:4])
+	}
+
+	_, err = DatabaseManager.BeginSnapshot(first + 10)
+	if err == nil {
+		t.Error("Expected error for a snapshot of a transaction not yet written")
+	}
+	snapshot.End()
+	err = DatabaseManager.flushCheckpoint()
+	if err != nil {
+		t.Fatal("Checkpoint failed:", err)
+	}
+	_, err = DatabaseManager.BeginSnapshot(first)
+	if err == nil {
+		t.Error("Expected error for a snapshot older than the WAL")
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 2)
+	defer DatabaseManager.Shutdown()
+
+	evicted := []uint64{}
+	DatabaseManager.SetOnEvict(func(pageId uint64) {
+		// the entry must already be gone when the hook fires
+		if _, ok := DatabaseManager.database[pageId]; ok {
+			t.Error("Hook fired before page", pageId, "was removed")
+		}
+		evicted = append(evicted, pageId)
+	})
+
+	// allocate some pages
+	pageIDs := []uint64{}
+	for i := 0; i < 3; i++ {
+		pageID, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	for _, id := range pageIDs {
+		_, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Read failed for page", id, ":", err)
+		}
+	}
+
+	if len(evicted) != 1 || evicted[0] != pageIDs[0] {
+		t.Error("Expected eviction of page", pageIDs[0], "but got", evicted)
+	}
+}
+
+func TestWritePagesUnlogged(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	// allocate some pages
+	pageIDs := []uint64{}
+	for i := 0; i < 2; i++ {
+		pageID, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	for _, id := range pageIDs {
+		err := DatabaseManager.WritePagesUnlogged([]PageDelta{{id, 0, []byte{7, 7, 7}}})
+		if err != nil {
+			t.Fatal("Unlogged write failed for page", id, ":", err)
+		}
+	}
+
+	// visible within the session while the WAL stays empty
+	readData, err := DatabaseManager.GetPage(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	if readData[0] != 7 {
+		t.Error("Unlogged write not visible in the session")
+	}
+	if DatabaseManager.wal.fileSize != 0 || len(DatabaseManager.wal.Cache) != 0 {
+		t.Error("Unlogged write reached the WAL")
+	}
+
+	// a checkpoint writes the first page out
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	err = DatabaseManager.WritePagesUnlogged([]PageDelta{{pageIDs[1], 0, []byte{8}}})
+	if err != nil {
+		t.Fatal("Unlogged write failed for page", pageIDs[1], ":", err)
+	}
+
+	// a crash loses writes made since the checkpoint
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+	first, err := DatabaseManager.GetPage(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	if first[0] != 7 {
+		t.Error("Checkpointed unlogged write was lost")
+	}
+	second, err := DatabaseManager.GetPage(pageIDs[1])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[1], ":", err)
+	}
+	if second[0] != 7 {
+		t.Error("Expected the write after the checkpoint to be lost, got", second[0])
+	}
+}
+
+func TestUnloggedEviction(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 1)
+	defer DatabaseManager.Shutdown()
+
+	// allocate some pages
+	pageIDs := []uint64{}
+	for i := 0; i < 2; i++ {
+		pageID, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	err := DatabaseManager.WritePagesUnlogged([]PageDelta{{pageIDs[0], 0, []byte{5}}})
+	if err != nil {
+		t.Fatal("Unlogged write failed for page", pageIDs[0], ":", err)
+	}
+
+	// evicting the page writes it out instead of losing it
+	_, err = DatabaseManager.GetPage(pageIDs[1])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[1], ":", err)
+	}
+	readData, err := DatabaseManager.GetPage(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	if readData[0] != 5 {
+		t.Error("Unlogged write lost on eviction")
+	}
+}
+
+func TestRecoveryEstimate(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+
+	const TransactionCount = 5
+	for i := 0; i < TransactionCount; i++ {
+		_, err = DatabaseManager.WriteAt(id, uint32(i), []byte{byte(i)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+
+	transactions, bytes, err := DatabaseManager.RecoveryEstimate()
+	if err != nil {
+		t.Fatal("Failed to estimate recovery :", err)
+	}
+	if transactions != TransactionCount {
+		t.Error("Expected", TransactionCount, "transactions but got", transactions)
+	}
+	if bytes != DatabaseManager.wal.fileSize {
+		t.Error("Expected", DatabaseManager.wal.fileSize, "bytes but got", bytes)
+	}
+
+	// estimating leaves the log usable
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{9})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	transactions, bytes, err = DatabaseManager.RecoveryEstimate()
+	if err != nil || transactions != 0 || bytes != 0 {
+		t.Error("Expected nothing to replay after a checkpoint, got", transactions, bytes, err)
+	}
+}
+
+func TestSwapPages(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 1)
+	defer DatabaseManager.Shutdown()
+
+	first, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(PagetypeTableData)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(first, 0, []byte{1, 1, 1})
+	if err != nil {
+		t.Fatal("Write failed for page", first, ":", err)
+	}
+	_, err = DatabaseManager.WriteAt(second, 0, []byte{2, 2})
+	if err != nil {
+		t.Fatal("Write failed for page", second, ":", err)
+	}
+
+	transactions := len(DatabaseManager.wal.ordered)
+	transactionId, err := DatabaseManager.SwapPages(first, second)
+	if err != nil {
+		t.Fatal("Failed to swap pages :", err)
+	}
+
+	// both pages change in one transaction
+	if len(DatabaseManager.wal.ordered) != transactions+1 {
+		t.Fatal("Expected a single transaction for the swap, got", len(DatabaseManager.wal.ordered)-transactions)
+	}
+	swap := DatabaseManager.wal.ordered[len(DatabaseManager.wal.ordered)-1]
+	if swap.Header.transactionId != transactionId || len(swap.Body) != 2 {
+		t.Error("Expected transaction", transactionId, "to hold both pages, got", len(swap.Body), "entries")
+	}
+
+	check := func(pageId uint64, expected []byte, pageType byte) {
+		data, err := DatabaseManager.GetPage(pageId)
+		if err != nil {
+			t.Fatal("Failed to read page", pageId, ":", err)
+		}
+		if string(data[:3]) != string(expected) {
+			t.Error("Page", pageId, "expected", expected, "but got", data[:3])
+		}
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageId)
+		if err != nil {
+			t.Fatal("Failed to read header of page", pageId, ":", err)
+		}
+		if header.PageType != pageType {
+			t.Error("Page", pageId, "expected type", pageType, "but got", header.PageType)
+		}
+	}
+	check(first, []byte{2, 2, 0}, PagetypeTableData)
+	check(second, []byte{1, 1, 1}, PagetypeUserdata)
+
+	// the swap survives a checkpoint
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	check(first, []byte{2, 2, 0}, PagetypeTableData)
+	check(second, []byte{1, 1, 1}, PagetypeUserdata)
+
+	_, err = DatabaseManager.SwapPages(first, first)
+	if err == nil {
+		t.Error("Expected error swapping a page with itself")
+	}
+	_, err = DatabaseManager.SwapPages(0, first)
+	if err == nil {
+		t.Error("Expected error swapping the metadata page")
+	}
+	free, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	err = DatabaseManager.FreePage(free)
+	if err != nil {
+		t.Fatal("Failed to free page", free, ":", err)
+	}
+	_, err = DatabaseManager.SwapPages(first, free)
+	if err == nil {
+		t.Error("Expected error swapping a free page")
+	}
+	check(first, []byte{2, 2, 0}, PagetypeTableData)
+}
+
+func TestSwapPagesRecovery(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	first, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(PagetypeTableData)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	transactionId, err := DatabaseManager.SwapPages(first, second)
+	if err != nil {
+		t.Fatal("Failed to swap pages :", err)
+	}
+	checkTypes := func(firstType byte, secondType byte) {
+		for pageId, pageType := range map[uint64]byte{first: firstType, second: secondType} {
+			header, err := DatabaseManager.allocator.ReadPageHeader(pageId)
+			if err != nil || header.PageType != pageType {
+				t.Error("Page", pageId, "expected type", pageType, "but got", header.PageType, err)
+			}
+		}
+	}
+
+	// crash after the swap was logged but before the headers were written
+	DatabaseManager.allocator.WritePageHeader(first, PageHeaderTypeOffset, byte(PagetypeUserdata))
+	DatabaseManager.allocator.WritePageHeader(second, PageHeaderTypeOffset, byte(PagetypeTableData))
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	checkTypes(PagetypeTableData, PagetypeUserdata)
+
+	// rolling the swap back restores the types with the data
+	err = DatabaseManager.RollbackTransaction(transactionId)
+	if err != nil {
+		t.Fatal("Failed to roll back the swap:", err)
+	}
+	checkTypes(PagetypeUserdata, PagetypeTableData)
+	ok, err := DatabaseManager.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Expected the database to verify after rolling back the swap:", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	os.Remove("backup.log")
+	os.Remove("backup.db")
+	defer os.Remove("backup.log")
+	defer os.Remove("backup.db")
+	source := newDatabase(t, 1000000, 32000)
+
+	pageIds := []uint64{}
+	for i := 0; i < 4; i++ {
+		id, err := source.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		_, err = source.WriteAt(id, uint32(i), []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	// free pages don't contribute
+	err := source.allocator.FreePage(pageIds[3])
+	if err != nil {
+		t.Fatal("Failed to free page :", err)
+	}
+
+	// pending WAL changes count before they are checkpointed
+	pending, err := source.Fingerprint()
+	if err != nil {
+		t.Fatal("Failed to fingerprint database :", err)
+	}
+	err = source.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	fingerprint, err := source.Fingerprint()
+	if err != nil {
+		t.Fatal("Failed to fingerprint database :", err)
+	}
+	if pending != fingerprint {
+		t.Error("Fingerprint changed across a checkpoint")
+	}
+	source.Shutdown()
+
+	// back up the data file and open it as a second database
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatal("Failed to read database file :", err)
+	}
+	err = os.WriteFile("backup.db", data, 0666)
+	if err != nil {
+		t.Fatal("Failed to write backup :", err)
+	}
+	backup := &DatabaseManager{}
+	err = backup.Initialize(1000000, 32000)
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	err = backup.wal.Initialize("backup.log")
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	err = backup.allocator.Initialize("backup.db", 0)
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	defer backup.Shutdown()
+
+	backupFingerprint, err := backup.Fingerprint()
+	if err != nil {
+		t.Fatal("Failed to fingerprint backup :", err)
+	}
+	if backupFingerprint != fingerprint {
+		t.Error("Expected backup to share the fingerprint", fingerprint, "but got", backupFingerprint)
+	}
+
+	_, err = backup.WriteAt(pageIds[1], 100, []byte{9})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIds[1], ":", err)
+	}
+	modified, err := backup.Fingerprint()
+	if err != nil {
+		t.Fatal("Failed to fingerprint backup :", err)
+	}
+	if modified == fingerprint {
+		t.Error("Expected the fingerprint to change after modifying a page")
+	}
+}
+
+func TestDirtyWatermark(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	const CacheSize = 4
+	DatabaseManager := newDatabase(t, 1000000, CacheSize)
+	defer DatabaseManager.Shutdown()
+	DatabaseManager.SetDirtyWatermark(0.5)
+
+	pageIds := []uint64{}
+	for i := 0; i < 20; i++ {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+
+	for i, id := range pageIds {
+		_, err := DatabaseManager.WriteAt(id, 0, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+		// without the watermark every written page would stay in the WAL
+		if len(DatabaseManager.wal.Cache) > CacheSize {
+			t.Fatal("Dirty set grew to", len(DatabaseManager.wal.Cache), "pages")
+		}
+	}
+	if DatabaseManager.EngineStats().Checkpoints == 0 {
+		t.Fatal("Expected evictions of dirty pages to trigger checkpoints")
+	}
+
+	for i, id := range pageIds {
+		data, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Failed to read page", id, ":", err)
+		}
+		if data[0] != byte(i+1) {
+			t.Error("Page", id, "expected", i+1, "but got", data[0])
+		}
+	}
+}
+
+// blockingStorage holds the first write until released
+type blockingStorage struct {
+	Storage
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (blockingStorage *blockingStorage) WriteAt(data []byte, offset int64) (int, error) {
+	blockingStorage.once.Do(func() {
+		close(blockingStorage.started)
+		<-blockingStorage.release
+	})
+	return blockingStorage.Storage.WriteAt(data, offset)
+}
+
+func TestConcurrentCheckpoint(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	pageIds := []uint64{}
+	for i := 0; i < 8; i++ {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		_, err = DatabaseManager.WriteAt(id, 0, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+
+	storage := &blockingStorage{
+		Storage: DatabaseManager.allocator.Database,
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	DatabaseManager.allocator.Database = storage
+
+	checkpoint := make(chan error)
+	go func() {
+		checkpoint <- DatabaseManager.SetCheckpointThreshold(0)
+	}()
+	<-storage.started
+
+	// reads and writes proceed while the checkpoint is writing pages
+	done := make(chan error)
+	go func() {
+		for i, id := range pageIds {
+			data, err := DatabaseManager.GetPage(id)
+			if err != nil {
+				done <- err
+				return
+			}
+			if data[0] != byte(i+1) {
+				done <- fmt.Errorf("page %d expected %d but got %d", id, i+1, data[0])
+				return
+			}
+		}
+		_, err := DatabaseManager.WriteAt(pageIds[0], 1, []byte{9})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Operation during checkpoint failed :", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Operations blocked behind the checkpoint")
+	}
+
+	close(storage.release)
+	err := <-checkpoint
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+
+	// the write made during the checkpoint stays in the WAL
+	if len(DatabaseManager.wal.ordered) != 1 || len(DatabaseManager.wal.Cache) != 1 {
+		t.Fatal("Expected the concurrent write to remain in the WAL, got", len(DatabaseManager.wal.ordered), "transactions")
+	}
+	DatabaseManager.Shutdown()
+
+	DatabaseManager = newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+	for i, id := range pageIds {
+		data, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Failed to read page", id, ":", err)
+		}
+		if data[0] != byte(i+1) {
+			t.Error("Page", id, "expected", i+1, "but got", data[0])
+		}
+	}
+	data, err := DatabaseManager.GetPage(pageIds[0])
+	if err != nil || data[1] != 9 {
+		t.Error("Expected the concurrent write to survive a restart, got", data[1], err)
+	}
+}
+
+func TestCheckpointDuringSwap(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1, 32000)
+	defer DatabaseManager.Shutdown()
+
+	a, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	b, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(a, 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page", a, ":", err)
+	}
+	_, err = DatabaseManager.WriteAt(b, 0, []byte{2})
+	if err != nil {
+		t.Fatal("Write failed for page", b, ":", err)
+	}
+
+	storage := &blockingStorage{
+		Storage: DatabaseManager.allocator.Database,
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	DatabaseManager.allocator.Database = storage
+
+	// the swap checkpoints first, a write committed while the checkpoint
+	// writes pages must be part of what is swapped
+	swap := make(chan error)
+	go func() {
+		_, err := DatabaseManager.SwapPages(a, b)
+		swap <- err
+	}()
+	<-storage.started
+	done := make(chan error)
+	go func() {
+		_, err := DatabaseManager.WriteAt(a, 0, []byte{0xEE})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Write during checkpoint failed :", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked behind the checkpoint")
+	}
+	close(storage.release)
+	err = <-swap
+	if err != nil {
+		t.Fatal("Failed to swap pages:", err)
+	}
+
+	dataA, err := DatabaseManager.GetPage(a)
+	if err != nil || dataA[0] != 2 {
+		t.Error("Expected page", a, "to hold 2 after the swap, got", dataA[0], err)
+	}
+	dataB, err := DatabaseManager.GetPage(b)
+	if err != nil || dataB[0] != 0xEE {
+		t.Error("Expected page", b, "to hold the concurrent write after the swap, got", dataB[0], err)
+	}
+}
+
+func benchmarkDatabase(b *testing.B) (*DatabaseManager, uint64) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := &DatabaseManager{}
+	DatabaseManager.Initialize(1<<40, 32000)
+	DatabaseManager.wal.Initialize("test.log")
+	DatabaseManager.allocator.Initialize("test.db", 0)
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		b.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.cachePage(id)
+	if err != nil {
+		b.Fatal("Failed to cache page :", err)
+	}
+	return DatabaseManager, id
+}
+
+func BenchmarkApplyDelta(b *testing.B) {
+	DatabaseManager, id := benchmarkDatabase(b)
+	defer DatabaseManager.Shutdown()
+	delta := PageDelta{id, 0, make([]byte, DefaultPageSize-PageHeaderSize)}
+	b.SetBytes(int64(len(delta.newData)))
+	for b.Loop() {
+		DatabaseManager.applyDelta(delta)
+	}
+}
+
+// BenchmarkApplyDeltaByteLoop applies the same delta the way applyDelta
+// did before it used copy, for comparison
+func BenchmarkApplyDeltaByteLoop(b *testing.B) {
+	DatabaseManager, id := benchmarkDatabase(b)
+	defer DatabaseManager.Shutdown()
+	delta := PageDelta{id, 0, make([]byte, DefaultPageSize-PageHeaderSize)}
+	b.SetBytes(int64(len(delta.newData)))
+	for b.Loop() {
+		for i, value := range delta.newData {
+			DatabaseManager.database[delta.pageId].data[delta.offset+uint32(i)] = value
+		}
+	}
+}
+
+func TestValidateDeltas(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	first, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	freed, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	err = DatabaseManager.allocator.FreePage(freed)
+	if err != nil {
+		t.Fatal("Failed to free page :", err)
+	}
+
+	err = DatabaseManager.ValidateDeltas([]PageDelta{{first, 0, []byte{1}}, {second, 10, []byte{2}}})
+	if err != nil {
+		t.Fatal("Expected a valid batch :", err)
+	}
+
+	invalid := [][]PageDelta{
+		{{first, 0, []byte{1}}, {second, DefaultPageSize - PageHeaderSize, []byte{2}}},
+		{{first, 0, []byte{1}}, {freed, 0, []byte{2}}},
+		{{first, 0, []byte{1}}, {freed + 1, 0, []byte{2}}},
+		{{first, 0, []byte{1}}, {0, 0, []byte{2}}},
+	}
+	for _, changes := range invalid {
+		err = DatabaseManager.ValidateDeltas(changes)
+		if err == nil || !strings.HasPrefix(err.Error(), "delta 1:") {
+			t.Error("Expected delta 1 to fail validation, got", err)
+		}
+	}
+	if len(DatabaseManager.database) != 0 {
+		t.Error("Validation cached", len(DatabaseManager.database), "pages")
+	}
+
+	// a bad delta fails the write before the good one is applied
+	_, err = DatabaseManager.WritePages(invalid[0])
+	if err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if len(DatabaseManager.wal.ordered) != 0 || len(DatabaseManager.database) != 0 {
+		t.Error("Failed write changed the WAL or cache")
+	}
+	data, err := DatabaseManager.GetPage(first)
+	if err != nil || data[0] != 0 {
+		t.Error("Expected page", first, "to be unchanged, got", data[0], err)
+	}
+}
+
+func TestRollbackTransaction(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{1, 1, 1, 1})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	first, err := DatabaseManager.WriteAt(id, 0, []byte{2, 2})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 2, []byte{3, 3})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	// old data survives a restart
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	err = DatabaseManager.RollbackTransaction(first)
+	if err != nil {
+		t.Fatal("Failed to roll back transaction :", err)
+	}
+	data, err := DatabaseManager.GetPage(id)
+	if err != nil {
+		t.Fatal("Failed to read page", id, ":", err)
+	}
+	if string(data[:4]) != string([]byte{1, 1, 3, 3}) {
+		t.Error("Expected only the second change to remain, got", data[:4])
+	}
+
+	// the undo is logged as its own transaction
+	transactions := DatabaseManager.wal.OrderedTransactions()
+	undo := transactions[len(transactions)-1]
+	if undo.Header.transactionId <= first || string(undo.Body[0].NewData) != string([]byte{1, 1}) {
+		t.Error("Expected the rollback to be logged, got", undo)
+	}
+
+	// rolling back under a newer overlapping write is refused
+	second, err := DatabaseManager.WriteAt(id, 4, []byte{4})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 4, []byte{5})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	err = DatabaseManager.RollbackTransaction(second)
+	if err == nil {
+		t.Error("Expected error rolling back an overwritten transaction")
+	}
+
+	err = DatabaseManager.RollbackTransaction(1 << 40)
+	if err == nil {
+		t.Error("Expected error rolling back an unknown transaction")
+	}
+}
+
+func TestCheckpointReleasesMemory(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 32*1024, 8)
+	defer DatabaseManager.Shutdown()
+
+	pageIds := []uint64{}
+	for range 8 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	data := make([]byte, 2048)
+	write := func(count int) {
+		for i := range count {
+			rand.Read(data)
+			_, err := DatabaseManager.WriteAt(pageIds[i%len(pageIds)], 0, data)
+			if err != nil {
+				t.Fatal("Write failed:", err)
+			}
+		}
+	}
+	heap := func() uint64 {
+		runtime.GC()
+		stats := runtime.MemStats{}
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	write(200)
+	before := heap()
+	// about 8MB of old and new data goes through the WAL over the cycles
+	write(2000)
+	after := heap()
+	if DatabaseManager.EngineStats().Checkpoints < 100 {
+		t.Fatal("Expected a checkpoint every few writes, got", DatabaseManager.EngineStats().Checkpoints)
+	}
+	if after > before+1024*1024 {
+		t.Error("Heap grew from", before, "to", after, "bytes across checkpoints")
+	}
+	if len(DatabaseManager.wal.ordered) > 16 || len(DatabaseManager.wal.Cache) > len(pageIds) {
+		t.Error("Expected the WAL cache to only hold transactions since the last checkpoint, got", len(DatabaseManager.wal.ordered))
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1024, 1)
+	defer DatabaseManager.Shutdown()
+
+	first, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+
+	DatabaseManager.EnterMaintenance()
+	if !DatabaseManager.InMaintenance() {
+		t.Fatal("Expected database to be in maintenance")
+	}
+	data := make([]byte, 512)
+	for range 8 {
+		_, err = DatabaseManager.WriteAt(first, 0, data)
+		if err != nil {
+			t.Fatal("Write failed:", err)
+		}
+	}
+	if DatabaseManager.EngineStats().Checkpoints != 0 || DatabaseManager.wal.fileSize < 1024 {
+		t.Fatal("Expected no checkpoint during maintenance, WAL holds", DatabaseManager.wal.fileSize, "bytes")
+	}
+
+	// an unlogged page stays cached instead of being written out
+	err = DatabaseManager.WritePagesUnlogged([]PageDelta{{second, 0, []byte{7}}})
+	if err != nil {
+		t.Fatal("Unlogged write failed:", err)
+	}
+	_, err = DatabaseManager.GetPage(first)
+	if err != nil {
+		t.Fatal("Failed to read page:", err)
+	}
+	if len(DatabaseManager.database) != 2 || !DatabaseManager.unlogged[second] {
+		t.Fatal("Expected the cache to grow past capacity during maintenance, holds", len(DatabaseManager.database))
+	}
+
+	err = DatabaseManager.ExitMaintenance()
+	if err != nil {
+		t.Fatal("Failed to exit maintenance:", err)
+	}
+	if DatabaseManager.EngineStats().Checkpoints != 1 || len(DatabaseManager.wal.ordered) != 0 {
+		t.Error("Expected the pending checkpoint to run after maintenance")
+	}
+	if len(DatabaseManager.database) > 1 {
+		t.Error("Expected the cache to be trimmed to capacity, holds", len(DatabaseManager.database))
+	}
+	saved, err := DatabaseManager.allocator.ReadPageData(second)
+	if err != nil || saved[0] != 7 {
+		t.Error("Expected the unlogged write on disk after maintenance:", err)
+	}
+
+	err = DatabaseManager.ExitMaintenance()
+	if err == nil {
+		t.Error("Expected error exiting maintenance twice")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 4)
+	defer DatabaseManager.Shutdown()
+
+	first, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+
+	// an aborted transaction touches neither the cache, the WAL nor the disk
+	txn := DatabaseManager.Begin()
+	txn.Write(first, 0, []byte{1, 2, 3})
+	err = txn.Abort()
+	if err != nil {
+		t.Fatal("Failed to abort transaction:", err)
+	}
+	if len(DatabaseManager.wal.ordered) != 0 || len(DatabaseManager.database) != 0 {
+		t.Fatal("Expected an aborted transaction to leave the WAL and cache alone")
+	}
+	data, err := DatabaseManager.GetPage(first)
+	if err != nil || data[0] != 0 {
+		t.Fatal("Expected page", first, "unchanged after abort:", err)
+	}
+	err = DatabaseManager.flushCheckpoint()
+	if err != nil {
+		t.Fatal("Checkpoint failed:", err)
+	}
+	saved, err := DatabaseManager.allocator.ReadPageData(first)
+	if err != nil || saved[0] != 0 {
+		t.Fatal("Expected page", first, "unchanged on disk after abort:", err)
+	}
+	_, err = txn.Commit()
+	if err == nil {
+		t.Error("Expected error committing an aborted transaction")
+	}
+
+	// a commit writes every buffered change as one WAL transaction
+	txn = DatabaseManager.Begin()
+	buffer := []byte{4, 5}
+	txn.Write(first, 0, buffer)
+	txn.Write(second, 10, []byte{6})
+	buffer[0] = 9
+	transactionId, err := txn.Commit()
+	if err != nil {
+		t.Fatal("Failed to commit transaction:", err)
+	}
+	if len(DatabaseManager.wal.ordered) != 1 || len(DatabaseManager.wal.ordered[0].Body) != 2 {
+		t.Fatal("Expected a single WAL transaction holding both changes")
+	}
+	if DatabaseManager.wal.ordered[0].Header.transactionId != transactionId {
+		t.Error("Expected commit to return transaction id", DatabaseManager.wal.ordered[0].Header.transactionId, "got", transactionId)
+	}
+	data, err = DatabaseManager.GetPage(first)
+	if err != nil || data[0] != 4 || data[1] != 5 {
+		t.Error("Expected the buffered write on page", first, "got", data[:2], err)
+	}
+	data, err = DatabaseManager.GetPage(second)
+	if err != nil || data[10] != 6 {
+		t.Error("Expected the buffered write on page", second, err)
+	}
+	err = txn.Abort()
+	if err == nil {
+		t.Error("Expected error aborting a committed transaction")
+	}
+
+	// an invalid change fails the whole commit
+	txn = DatabaseManager.Begin()
+	txn.Write(first, 0, []byte{7})
+	txn.Write(0, 0, []byte{7})
+	_, err = txn.Commit()
+	if err == nil {
+		t.Fatal("Expected error committing a change to the metadata page")
+	}
+	data, err = DatabaseManager.GetPage(first)
+	if err != nil || data[0] != 4 {
+		t.Error("Expected a failed commit to leave page", first, "unchanged")
+	}
+	// a page that can't be freed fails the commit before anything is written
+	readTxn := DatabaseManager.BeginRead()
+	txn = DatabaseManager.Begin()
+	txn.Write(first, 0, []byte{8})
+	txn.Free(second)
+	_, err = txn.Commit()
+	if err == nil {
+		t.Error("Expected error freeing a page with logged changes during a read transaction")
+	}
+	readTxn.End()
+	data, err = DatabaseManager.GetPage(first)
+	if err != nil || data[0] != 4 {
+		t.Error("Expected a commit that can't free its pages to leave page", first, "unchanged")
+	}
+	txn = DatabaseManager.Begin()
+	txn.Write(first, 0, []byte{8})
+	txn.Free(second)
+	_, err = txn.Commit()
+	if err != nil {
+		t.Fatal("Failed to commit transaction:", err)
+	}
+	header, err := DatabaseManager.allocator.ReadPageHeader(second)
+	if err != nil || header.PageType != PagetypeFreepage {
+		t.Error("Expected page", second, "to be freed by the commit, got type", header.PageType, err)
+	}
+}
+
+// cacheOrder walks the LRU list from tail to head, failing on broken links
+func cacheOrder(t *testing.T, DatabaseManager *DatabaseManager) []uint64 {
+	lru := DatabaseManager.policy.(*LRUPolicy)
+	order := []uint64{}
+	var previous *lruNode
+	for node := lru.tail; node != nil; node = node.next {
+		if node.prev != previous {
+			t.Fatal("Broken prev link at page", node.pageId)
+		}
+		if len(order) > len(DatabaseManager.database) {
+			t.Fatal("Cycle in the cache list")
+		}
+		if _, ok := DatabaseManager.database[node.pageId]; !ok {
+			t.Fatal("Cache list holds page", node.pageId, "which is not cached")
+		}
+		order = append(order, node.pageId)
+		previous = node
+	}
+	if previous != lru.head {
+		t.Fatal("Walking from the tail doesn't end at the head")
+	}
+	if len(order) != len(DatabaseManager.database) {
+		t.Fatal("Cache list holds", len(order), "pages but the map holds", len(DatabaseManager.database))
+	}
+	return order
+}
+
+func TestCacheListIntegrity(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 3)
+	defer DatabaseManager.Shutdown()
+	evicted := []uint64{}
+	DatabaseManager.SetOnEvict(func(pageId uint64) {
+		evicted = append(evicted, pageId)
+	})
+
+	pageIds := []uint64{}
+	for range 6 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	read := func(index int) {
+		_, err := DatabaseManager.GetPage(pageIds[index])
+		if err != nil {
+			t.Fatal("Failed to read page", pageIds[index], ":", err)
+		}
+	}
+	check := func(expected ...int) {
+		order := cacheOrder(t, DatabaseManager)
+		for i, index := range expected {
+			if i >= len(order) || order[i] != pageIds[index] {
+				t.Fatal("Expected cache order", expected, "but got pages", order)
+			}
+		}
+	}
+
+	read(0)
+	read(1)
+	read(2)
+	check(0, 1, 2)
+	// promoting the tail, the head and a middle entry
+	read(0)
+	check(1, 2, 0)
+	read(0)
+	check(1, 2, 0)
+	read(2)
+	check(1, 0, 2)
+
+	// evictions drop the least recently used pages
+	read(3)
+	check(0, 2, 3)
+	read(0)
+	read(4)
+	read(5)
+	check(0, 4, 5)
+	expected := []uint64{pageIds[1], pageIds[2], pageIds[3]}
+	if !slices.Equal(evicted, expected) {
+		t.Error("Expected pages", expected, "to be evicted, got", evicted)
+	}
+}
+
+func TestIORateLimit(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 2)
+	defer DatabaseManager.Shutdown()
+
+	pageIds := []uint64{}
+	for range 20 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+
+	// the cache holds 2 pages so every read goes to disk, the first one
+	// starts right away and the other 19 wait 5ms each
+	DatabaseManager.SetIORateLimit(200)
+	start := time.Now()
+	for _, id := range pageIds {
+		_, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Failed to read page", id, ":", err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 95*time.Millisecond {
+		t.Error("Expected 20 pages at 200 pages per second to take at least 95ms, took", elapsed)
+	}
+
+	DatabaseManager.SetIORateLimit(0)
+	start = time.Now()
+	for _, id := range pageIds {
+		DatabaseManager.GetPage(id)
+	}
+	if time.Since(start) >= elapsed {
+		t.Error("Expected reads to be faster without a limit, took", time.Since(start))
+	}
+}
+
+func TestIORateLimitCacheHit(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 2)
+	defer DatabaseManager.Shutdown()
+
+	pageIds := []uint64{}
+	for range 4 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+
+	// a scan of the first three pages waits 250ms before each read after
+	// the first, the last page stays cached in the other slot
+	DatabaseManager.SetIORateLimit(4)
+	_, err := DatabaseManager.GetPage(pageIds[3])
+	if err != nil {
+		t.Fatal("Failed to read page:", err)
+	}
+	done := make(chan error)
+	go func() {
+		for _, id := range pageIds[:3] {
+			_, err := DatabaseManager.GetPageNoPromote(id)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	_, err = DatabaseManager.GetPage(pageIds[3])
+	if err != nil {
+		t.Fatal("Failed to read cached page:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("Expected a cache hit not to wait for a throttled scan, took", elapsed)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal("Scan failed:", err)
+	}
+}
+
+func TestWalPagesPastEnd(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	for _, pageType := range []byte{PagetypeUserdata, PagetypeUserdata, PageTypeIndex} {
+		_, err := DatabaseManager.AllocatePage(pageType)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+	}
+	_, err := DatabaseManager.WriteAt(1, 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page 1:", err)
+	}
+	_, err = DatabaseManager.WriteAt(3, 0, []byte{3})
+	if err != nil {
+		t.Fatal("Write failed for page 3:", err)
+	}
+
+	// lose the allocation of pages 2 and 3 as if the metadata never reached disk
+	DatabaseManager.allocator.WriteMetadata(MetadataTotalPageOffset, 2)
+	DatabaseManager.allocator.Database.Truncate(2 * DatabaseManager.allocator.PageSize)
+	DatabaseManager.Shutdown()
+
+	DatabaseManager = newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	err = DatabaseManager.checkWalPages()
+	if err != nil {
+		t.Fatal("Failed to recreate pages written by the WAL:", err)
+	}
+	total, _ := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if total != 4 {
+		t.Fatal("Expected 4 pages after recovery, got", total)
+	}
+	header, _ := DatabaseManager.allocator.ReadPageHeader(2)
+	if header.PageType != PagetypeFreepage {
+		t.Error("Expected page 2 to be free, got type", header.PageType)
+	}
+	// page 3 comes back with the type its logged write recorded
+	header, _ = DatabaseManager.allocator.ReadPageHeader(3)
+	if header.PageType != PageTypeIndex {
+		t.Error("Expected page 3 to be recreated as an index page, got type", header.PageType)
+	}
+	data, err := DatabaseManager.GetPage(3)
+	if err != nil || data[0] != 3 {
+		t.Error("Expected the logged write on page 3, got", data[:1], err)
+	}
+}
+
+func TestCommitOrderReplay(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+
+	// the later transaction reaches the cache first
+	write := func(transactionId uint64, value byte) {
+		transaction := Transaction{}
+		transaction.MakeTransaction()
+		transaction.Header.transactionId = transactionId
+		transaction.Body = append(transaction.Body,
+			PageEntry{PageId: id, Offset: 0, Length: 1, OldData: []byte{0}, NewData: []byte{value}},
+			PageEntry{PageId: id, Offset: 1, Length: 1, OldData: []byte{0}, NewData: []byte{value}})
+		DatabaseManager.wal.addCache(&transaction)
+	}
+	write(20, 2)
+	write(10, 1)
+
+	data, err := DatabaseManager.GetPage(id)
+	if err != nil {
+		t.Fatal("Read failed for page", id, ":", err)
+	}
+	if data[0] != 2 || data[1] != 2 {
+		t.Error("Expected the write of the later transaction, got", data[:2])
+	}
+	cached := DatabaseManager.wal.Cache[id]
+	if len(cached) != 2 || cached[0].Id() != 10 || cached[1].Id() != 20 {
+		t.Error("Expected page transactions cached once each in id order")
+	}
+}
+
+func TestEvictionBatch(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	DatabaseManager.SetEvictionBatch(4)
+	evicted := []uint64{}
+	DatabaseManager.SetOnEvict(func(pageId uint64) {
+		evicted = append(evicted, pageId)
+	})
+
+	pageIds := []uint64{}
+	for range 12 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	for _, id := range pageIds[:10] {
+		_, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Failed to read page", id, ":", err)
+		}
+	}
+
+	// the first miss in a full cache evicts down to the low watermark
+	DatabaseManager.GetPage(pageIds[10])
+	if len(DatabaseManager.database) != 7 || !slices.Equal(evicted, pageIds[:4]) {
+		t.Fatal("Expected the 4 least recently used pages evicted leaving 7, got", evicted, len(DatabaseManager.database))
+	}
+	// the next miss fits without evicting
+	DatabaseManager.GetPage(pageIds[11])
+	if len(DatabaseManager.database) != 8 || len(evicted) != 4 {
+		t.Error("Expected the next miss to fit without evicting, got", len(DatabaseManager.database), "pages")
+	}
+}
+
+func benchmarkEviction(b *testing.B, batch int) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := &DatabaseManager{}
+	DatabaseManager.Initialize(1000000, 1000)
+	DatabaseManager.wal.Initialize("test.log")
+	DatabaseManager.allocator.Initialize("test.db", 0)
+	defer DatabaseManager.Shutdown()
+	DatabaseManager.SetEvictionBatch(batch)
+
+	pageIds := []uint64{}
+	for range 2000 {
+		id, _ := DatabaseManager.AllocatePage(PagetypeUserdata)
+		pageIds = append(pageIds, id)
+	}
+	i := 0
+	for b.Loop() {
+		DatabaseManager.GetPage(pageIds[i%len(pageIds)])
+		i++
+	}
+}
+
+func BenchmarkEvictOne(b *testing.B) {
+	benchmarkEviction(b, 1)
+}
+
+func BenchmarkEvictBatch(b *testing.B) {
+	benchmarkEviction(b, 100)
+}
+
+func TestMaterialize(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 2)
+	defer DatabaseManager.Shutdown()
+
+	pageIds := []uint64{}
+	for i := range 4 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		_, err = DatabaseManager.WriteAt(id, uint32(i), []byte{byte(i + 1), 9})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	err := DatabaseManager.WritePagesUnlogged([]PageDelta{{pageIds[3], 0, []byte{7}}})
+	if err != nil {
+		t.Fatal("Unlogged write failed:", err)
+	}
+	walSize := DatabaseManager.wal.fileSize
+
+	err = DatabaseManager.Materialize()
+	if err != nil {
+		t.Fatal("Failed to materialize:", err)
+	}
+	for _, id := range pageIds {
+		onDisk, err := DatabaseManager.allocator.ReadPageData(id)
+		if err != nil {
+			t.Fatal("Failed to read page", id, "from disk:", err)
+		}
+		current, err := DatabaseManager.GetPage(id)
+		if err != nil {
+			t.Fatal("Read failed for page", id, ":", err)
+		}
+		if !slices.Equal(onDisk, current) {
+			t.Error("Page", id, "on disk does not match its current version")
+		}
+	}
+	if DatabaseManager.wal.fileSize != walSize || len(DatabaseManager.wal.Cache) != 4 {
+		t.Error("Expected the WAL to be kept, got", DatabaseManager.wal.fileSize, "bytes")
+	}
+
+	readTxn := DatabaseManager.BeginRead()
+	defer readTxn.End()
+	err = DatabaseManager.Materialize()
+	if err == nil {
+		t.Error("Expected error materializing during a read transaction")
+	}
+}
+
+// overlappingWrites writes count transactions to one page, each overlapping
+// the previous one, and reopens the database so they are recovered
+func overlappingWrites(t testing.TB, count int) (*DatabaseManager, uint64) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := &DatabaseManager{}
+	DatabaseManager.Initialize(math.MaxUint64, 10)
+	DatabaseManager.wal.Initialize("test.log")
+	DatabaseManager.allocator.Initialize("test.db", 0)
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	for i := range count {
+		_, err = DatabaseManager.WriteAt(id, uint32(i%100), []byte{byte(i), byte(i), byte(i), byte(i)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+	DatabaseManager.Shutdown()
+	DatabaseManager.wal.Initialize("test.log")
+	DatabaseManager.allocator.Initialize("test.db", 0)
+	return DatabaseManager, id
+}
+
+func TestCoalesceWal(t *testing.T) {
+	DatabaseManager, id := overlappingWrites(t, 250)
+	defer DatabaseManager.Shutdown()
+	replayed, err := DatabaseManager.loadPageFromDisc(id)
+	if err != nil {
+		t.Fatal("Failed to load page", id, ":", err)
+	}
+
+	DatabaseManager.wal.coalesce()
+	if len(DatabaseManager.wal.coalesced[id].spans) != 1 {
+		t.Fatal("Expected the overlapping writes to combine into one span, got", len(DatabaseManager.wal.coalesced[id].spans))
+	}
+	coalesced, err := DatabaseManager.loadPageFromDisc(id)
+	if err != nil || !slices.Equal(coalesced, replayed) {
+		t.Fatal("Coalesced page does not match the replayed page", err)
+	}
+
+	// later writes apply over the combined changes
+	_, err = DatabaseManager.WriteAt(id, 2, []byte{0xFF})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	DatabaseManager.uncachePage(id)
+	data, err := DatabaseManager.GetPage(id)
+	if err != nil || data[1] != replayed[1] || data[2] != 0xFF {
+		t.Error("Expected the later write over the combined changes, got", data[:3], err)
+	}
+
+	err = DatabaseManager.flushCheckpoint()
+	if err != nil {
+		t.Fatal("Checkpoint failed:", err)
+	}
+	if len(DatabaseManager.wal.coalesced) != 0 {
+		t.Error("Expected a checkpoint to drop the combined changes")
+	}
+}
+
+func benchmarkColdRead(b *testing.B, coalesce bool) {
+	DatabaseManager, id := overlappingWrites(b, 1000)
+	defer DatabaseManager.Shutdown()
+	if coalesce {
+		DatabaseManager.wal.coalesce()
+	}
+	for b.Loop() {
+		DatabaseManager.loadPageFromDisc(id)
+	}
+}
+
+func BenchmarkColdReadReplay(b *testing.B) {
+	benchmarkColdRead(b, false)
+}
+
+func BenchmarkColdReadCoalesced(b *testing.B) {
+	benchmarkColdRead(b, true)
+}
+
+// countingStorage counts the page writes that reach the data file,
+// checkpoints also update the metadata page which isn't counted
+type countingStorage struct {
+	Storage
+	writes int
+}
+
+func (countingStorage *countingStorage) WriteAt(data []byte, offset int64) (int, error) {
+	if offset >= DefaultPageSize {
+		countingStorage.writes++
+	}
+	return countingStorage.Storage.WriteAt(data, offset)
+}
+
+func TestCheckpointSkipsCleanPages(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	storage := &countingStorage{Storage: DatabaseManager.allocator.Database}
+	DatabaseManager.allocator.Database = storage
+
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	storage.writes = 0
+	err = DatabaseManager.flushCheckpoint()
+	if err != nil || storage.writes == 0 {
+		t.Fatal("Expected the checkpoint to write the page, got", storage.writes, "writes", err)
+	}
+	storage.writes = 0
+	err = DatabaseManager.flushCheckpoint()
+	if err != nil || storage.writes != 0 {
+		t.Error("Expected a checkpoint with nothing written to write nothing, got", storage.writes, "writes", err)
+	}
+
+	// pages already materialized are clean and not written again
+	_, err = DatabaseManager.WriteAt(id, 0, []byte{2})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	err = DatabaseManager.Materialize()
+	if err != nil {
+		t.Fatal("Failed to materialize:", err)
+	}
+	storage.writes = 0
+	err = DatabaseManager.flushCheckpoint()
+	if err != nil || storage.writes != 0 {
+		t.Error("Expected the checkpoint to skip the materialized page, got", storage.writes, "writes", err)
+	}
+	if len(DatabaseManager.wal.Cache) != 0 {
+		t.Error("Expected the checkpoint to clear the WAL")
+	}
+	data, err := DatabaseManager.allocator.ReadPageData(id)
+	if err != nil || data[0] != 2 {
+		t.Error("Expected the materialized write on disk, got", data[:1], err)
+	}
+}
+
+func TestPinnedPages(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 1)
+	defer DatabaseManager.Shutdown()
+	pageIds := []uint64{}
+	for range 4 {
+		pageId, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, pageId)
+	}
+
+	// loading the later pages of the transaction must not evict the earlier ones
+	changes := []PageDelta{}
+	for i, pageId := range pageIds[:3] {
+		changes = append(changes, NewPageDelta(pageId, 0, []byte{byte(i + 1)}))
+	}
+	_, err := DatabaseManager.WritePages(changes)
+	if err != nil {
+		t.Fatal("Failed to write 3 pages with a cache of 1 page:", err)
+	}
+	for i, pageId := range pageIds[:3] {
+		data, err := DatabaseManager.GetPage(pageId)
+		if err != nil || data[0] != byte(i+1) {
+			t.Error("Expected page", pageId, "to hold", i+1, "got", data[0], err)
+		}
+	}
+	_, err = DatabaseManager.GetPage(pageIds[3])
+	if err != nil {
+		t.Fatal("Failed to read page", pageIds[3], ":", err)
+	}
+	if len(DatabaseManager.database) != 1 {
+		t.Error("Expected the next miss to shrink the cache back to 1 page, got", len(DatabaseManager.database))
+	}
+
+	// a pinned page outlives reads of other pages
+	err = DatabaseManager.Pin(pageIds[0])
+	if err != nil {
+		t.Fatal("Failed to pin page", pageIds[0], ":", err)
+	}
+	for _, pageId := range pageIds[1:] {
+		_, err = DatabaseManager.GetPage(pageId)
+		if err != nil {
+			t.Fatal("Failed to read page", pageId, ":", err)
+		}
+	}
+	if _, ok := DatabaseManager.database[pageIds[0]]; !ok {
+		t.Error("Expected pinned page", pageIds[0], "to stay cached")
+	}
+	err = DatabaseManager.Unpin(pageIds[0])
+	if err != nil {
+		t.Fatal("Failed to unpin page", pageIds[0], ":", err)
+	}
+	err = DatabaseManager.Unpin(pageIds[0])
+	if err == nil {
+		t.Error("Expected error unpinning a page that is not pinned")
+	}
+	_, err = DatabaseManager.GetPage(pageIds[1])
+	if err != nil {
+		t.Fatal("Failed to read page", pageIds[1], ":", err)
+	}
+	if _, ok := DatabaseManager.database[pageIds[0]]; ok {
+		t.Error("Expected page", pageIds[0], "to be evicted once unpinned")
+	}
+
+	// a pinned page can't be freed and keeps its pin
+	err = DatabaseManager.Pin(pageIds[2])
+	if err != nil {
+		t.Fatal("Failed to pin page", pageIds[2], ":", err)
+	}
+	err = DatabaseManager.FreePage(pageIds[2])
+	if !errors.Is(err, ErrPagePinned) {
+		t.Error("Expected ErrPagePinned freeing a pinned page, got", err)
+	}
+	if DatabaseManager.pinned[pageIds[2]] != 1 {
+		t.Error("Expected page", pageIds[2], "to keep its pin, got", DatabaseManager.pinned[pageIds[2]])
+	}
+	err = DatabaseManager.Unpin(pageIds[2])
+	if err != nil {
+		t.Fatal("Failed to unpin page", pageIds[2], ":", err)
+	}
+	err = DatabaseManager.FreePage(pageIds[2])
+	if err != nil {
+		t.Error("Failed to free page once unpinned:", err)
+	}
+}
+
+func TestChecksumAlgorithm(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	pageId, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(pageId, 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	err = DatabaseManager.SetChecksumAlgorithm(ChecksumCRC32C)
+	if err != nil {
+		t.Fatal("Failed to switch to CRC32C:", err)
+	}
+	_, err = DatabaseManager.WriteAt(pageId, 1, []byte{2})
+	if err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	DatabaseManager.Shutdown()
+
+	// the reopened database verifies pages and the WAL with CRC32C
+	DatabaseManager = newDatabase(t, 1000000, 10)
+	if DatabaseManager.allocator.ChecksumAlgorithm() != ChecksumCRC32C {
+		t.Fatal("Expected CRC32C after reopening, got", DatabaseManager.allocator.ChecksumAlgorithm())
+	}
+	data, err := DatabaseManager.GetPage(pageId)
+	if err != nil || data[0] != 1 || data[1] != 2 {
+		t.Fatal("Expected both writes after reopening, got", data[:2], err)
+	}
+	ok, err := DatabaseManager.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Database failed verification with CRC32C:", err)
+	}
+
+	// pages written with CRC32C don't verify under CRC32
+	err = DatabaseManager.allocator.WriteMetaField(MetaChecksumAlgorithm, uint64(ChecksumCRC32))
+	if err != nil {
+		t.Fatal("Failed to overwrite the algorithm:", err)
+	}
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 10)
+	_, err = DatabaseManager.allocator.ReadPageData(pageId)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("Expected a checksum mismatch reading a CRC32C page as CRC32, got", err)
+	}
+
+	// an algorithm the database doesn't know is refused outright
+	err = DatabaseManager.allocator.WriteMetaField(MetaChecksumAlgorithm, 99)
+	if err != nil {
+		t.Fatal("Failed to overwrite the algorithm:", err)
+	}
+	DatabaseManager.Shutdown()
+	allocator := &PageAllocator{}
+	err = allocator.Initialize("test.db", 0)
+	if err == nil {
+		allocator.CloseFile()
+		t.Error("Expected error opening a database with an unknown checksum algorithm")
+	}
+	err = DatabaseManager.SetChecksumAlgorithm(99)
+	if err == nil {
+		t.Error("Expected error switching to an unknown checksum algorithm")
+	}
+}
+
+func TestWalKey(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	open := func(key []byte) (*DatabaseManager, error) {
+		DatabaseManager := &DatabaseManager{}
+		err := DatabaseManager.SetWalKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = DatabaseManager.Initialize(1000000, 10)
+		if err != nil {
+			return nil, err
+		}
+		err = DatabaseManager.allocator.Initialize("test.db", 0)
+		if err != nil {
+			return nil, err
+		}
+		return DatabaseManager, DatabaseManager.openWal("test.log")
+	}
+	DatabaseManager, err := open(key)
+	if err != nil {
+		t.Fatal("Failed to initialize database :", err)
+	}
+	pageId, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(pageId, 0, []byte("secret"))
+	if err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	DatabaseManager.Shutdown()
+	raw, err := os.ReadFile("test.log")
+	if err != nil || bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("Expected the write to be encrypted in the log:", err)
+	}
+
+	// the key set before Initialize lets recovery decrypt the log
+	DatabaseManager, err = open(key)
+	if err != nil {
+		t.Fatal("Failed to recover the encrypted log:", err)
+	}
+	data, err := DatabaseManager.GetPage(pageId)
+	if err != nil || string(data[:6]) != "secret" {
+		t.Error("Expected the write to be recovered, got", data[:6], err)
+	}
+	DatabaseManager.Shutdown()
+
+	DatabaseManager, err = open(nil)
+	if DatabaseManager != nil {
+		DatabaseManager.Shutdown()
+	}
+	if !errors.Is(err, ErrWalEncrypted) {
+		t.Error("Expected ErrWalEncrypted opening without the key, got", err)
+	}
+}
+
+func TestWriteUnallocatedPage(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	walSize := DatabaseManager.wal.fileSize
+	lsn := DatabaseManager.CurrentLSN()
+
+	_, err := DatabaseManager.WritePages([]PageDelta{NewPageDelta(99999, 0, []byte{1})})
+	if !errors.Is(err, ErrPageNotAllocated) || !strings.Contains(err.Error(), "page 99999") {
+		t.Fatal("Expected ErrPageNotAllocated naming page 99999, got", err)
+	}
+	if DatabaseManager.wal.fileSize != walSize || DatabaseManager.CurrentLSN() != lsn || len(DatabaseManager.wal.ordered) != 0 {
+		t.Error("Expected the rejected write to leave the WAL untouched")
+	}
+	if len(DatabaseManager.database) != 0 {
+		t.Error("Expected the rejected write to cache nothing, got", len(DatabaseManager.database), "pages")
+	}
+}
+
+func TestGroupCommitWrites(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	pageIds := []uint64{}
+	for range 2 {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+
+	// neither write returns before the batch of two is synced, the first
+	// must wait without holding the lock the second needs
+	DatabaseManager.SetGroupCommit(2, time.Hour)
+	done := make(chan error)
+	for i, id := range pageIds {
+		go func() {
+			_, err := DatabaseManager.WriteAt(id, 0, []byte{byte(i + 1)})
+			done <- err
+		}()
+	}
+	for range pageIds {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal("Write failed :", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Writes did not share a group commit batch")
+		}
+	}
+
+	// a commit that checkpoints after filling its batch syncs it itself
+	DatabaseManager.SetGroupCommit(1, time.Hour)
+	txn := DatabaseManager.Begin()
+	txn.Write(pageIds[0], 1, []byte{9})
+	txn.Free(pageIds[1])
+	commit := make(chan error)
+	go func() {
+		_, err := txn.Commit()
+		commit <- err
+	}()
+	select {
+	case err := <-commit:
+		if err != nil {
+			t.Fatal("Failed to commit transaction:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Commit waited on its own batch")
+	}
+
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+	data, err := DatabaseManager.GetPage(pageIds[0])
+	if err != nil || data[0] != 1 || data[1] != 9 {
+		t.Error("Expected both writes to page", pageIds[0], "after reopening, got", data[:2], err)
+	}
+}
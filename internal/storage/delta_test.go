@@ -0,0 +1,49 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"relationalDatabase/internal/storage"
+)
+
+func TestNewPageDelta(t *testing.T) {
+	os.Remove("wal.log")
+	os.Remove("data.db")
+	DatabaseManager := &storage.DatabaseManager{}
+	err := DatabaseManager.Initialize(1000000, 10)
+	if err != nil {
+		t.Fatal("Failed to initialize database:", err)
+	}
+	defer DatabaseManager.Shutdown()
+
+	first, err := DatabaseManager.AllocatePage(storage.PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(storage.PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WritePages([]storage.PageDelta{
+		storage.NewPageDelta(first, 0, []byte("first")),
+		storage.NewPageDelta(second, 10, []byte("second")),
+	})
+	if err != nil {
+		t.Fatal("Failed to write pages:", err)
+	}
+
+	data, err := DatabaseManager.GetPage(first)
+	if err != nil || string(data[:5]) != "first" {
+		t.Error("Expected first page to hold the delta, got", string(data[:5]), err)
+	}
+	data, err = DatabaseManager.GetPage(second)
+	if err != nil || string(data[10:16]) != "second" {
+		t.Error("Expected second page to hold the delta, got", string(data[10:16]), err)
+	}
+
+	_, err = DatabaseManager.WritePages([]storage.PageDelta{storage.NewPageDelta(second, uint32(len(data)), []byte{1})})
+	if err == nil {
+		t.Error("Expected error for a delta past the end of the page")
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// Fingerprint folds the checksums of all live pages, in id order, into a
+// single value. Free pages and the metadata page are skipped and pending
+// WAL changes are included, so two databases with the same live content
+// share a fingerprint regardless of how much of it has been checkpointed
+func (DatabaseManager *DatabaseManager) Fingerprint() (uint64, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+
+	count, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return 0, err
+	}
+	hash := fnv.New64a()
+	for pageId := uint64(1); pageId < count; pageId++ {
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageId)
+		if err != nil {
+			return 0, err
+		}
+		if header.PageType == PagetypeFreepage {
+			continue
+		}
+
+		var data PageData
+		entry, ok := DatabaseManager.database[pageId]
+		if ok {
+			data = entry.data
+		} else {
+			data, err = DatabaseManager.loadPageFromDisc(pageId)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		record := binary.LittleEndian.AppendUint64([]byte{}, pageId)
+		record = append(record, header.PageType)
+		// CRC32 regardless of the database's algorithm, so fingerprints compare
+		record = binary.LittleEndian.AppendUint32(record, getChecksum(ChecksumCRC32, data))
+		hash.Write(record)
+	}
+	return hash.Sum64(), nil
+}
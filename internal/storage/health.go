@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCheckpointInconsistent is returned by VerifyCheckpoint when the WAL or
+// the data file doesn't reflect a completed checkpoint
+var ErrCheckpointInconsistent = errors.New("checkpoint is inconsistent")
+
+// verifyCheckpointSample is the number of cached pages compared
+// against the data file by VerifyCheckpoint
+const verifyCheckpointSample = 16
+
+// Health is a JSON serializable snapshot of the engine state,
+// suitable for exposing from a health endpoint
+type Health struct {
+	TotalPages          uint64    `json:"total_pages"`          // Pages in the data file including metadata
+	FreePages           uint64    `json:"free_pages"`           // Pages on the free list
+	CachedPages         int       `json:"cached_pages"`         // Pages held in the cache
+	CacheHitRatio       float64   `json:"cache_hit_ratio"`      // Fraction of page lookups served from the cache
+	WalBytes            uint64    `json:"wal_bytes"`            // Bytes of the WAL not yet checkpointed
+	PendingTransactions int       `json:"pending_transactions"` // Transactions in the WAL not yet checkpointed
+	LastCheckpoint      time.Time `json:"last_checkpoint"`      // Start of the last checkpoint, zero if none
+	LastVerify          time.Time `json:"last_verify"`          // Time of the last verification, zero if none
+	VerifyPassed        bool      `json:"verify_passed"`        // Whether the last verification found no corruption
+	Error               string    `json:"error,omitempty"`      // Why the page counts couldn't be read, empty if they could
+}
+
+// VerifyDatabase checks the checksum of every page in the data file and
+// records the result for Health
+func (DatabaseManager *DatabaseManager) VerifyDatabase() (bool, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	ok, err := DatabaseManager.allocator.VerifyDatabase()
+	if err != nil {
+		return ok, err
+	}
+	DatabaseManager.stats.lastVerify = time.Now()
+	DatabaseManager.stats.verifyPassed = ok
+	if !ok {
+		DatabaseManager.logEvent(EventCorruptionDetected, "source", "verify")
+	}
+	return ok, nil
+}
+
+// VerifyCheckpoint checks that nothing is waiting to be checkpointed and that
+// a sample of the cached pages match the data file. It is meant to be
+// called right after a checkpoint as a self-test of the checkpoint path
+func (DatabaseManager *DatabaseManager) VerifyCheckpoint() error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+
+	if len(DatabaseManager.wal.Cache) != 0 || DatabaseManager.wal.fileSize != 0 {
+		return fmt.Errorf("%w: wal holds %d bytes for %d pages", ErrCheckpointInconsistent, DatabaseManager.wal.fileSize, len(DatabaseManager.wal.Cache))
+	}
+	if len(DatabaseManager.unlogged) != 0 {
+		return fmt.Errorf("%w: %d unlogged pages not written", ErrCheckpointInconsistent, len(DatabaseManager.unlogged))
+	}
+
+	checked := 0
+	for pageId, entry := range DatabaseManager.database {
+		if checked == verifyCheckpointSample {
+			break
+		}
+		data, err := DatabaseManager.allocator.ReadPageData(pageId)
+		if err != nil {
+			return fmt.Errorf("%w: page %d: %v", ErrCheckpointInconsistent, pageId, err)
+		}
+		if !bytes.Equal(data, entry.data) {
+			return fmt.Errorf("%w: page %d on disk differs from the cache", ErrCheckpointInconsistent, pageId)
+		}
+		checked++
+	}
+	return nil
+}
+
+// Health aggregates page, cache, WAL and verification statistics. A
+// failure reading the page counts from the data file is reported in Error,
+// the other fields are filled in regardless
+func (DatabaseManager *DatabaseManager) Health() Health {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	counters := DatabaseManager.stats
+	response := Health{
+		CachedPages:         len(DatabaseManager.database),
+		WalBytes:            DatabaseManager.wal.fileSize,
+		PendingTransactions: len(DatabaseManager.wal.ordered),
+		LastCheckpoint:      counters.lastCheckpoint,
+		LastVerify:          counters.lastVerify,
+		VerifyPassed:        counters.verifyPassed,
+	}
+	if lookups := counters.cacheHits + counters.cacheMisses; lookups > 0 {
+		response.CacheHitRatio = float64(counters.cacheHits) / float64(lookups)
+	}
+
+	var err error
+	response.TotalPages, err = DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err == nil {
+		response.FreePages, err = DatabaseManager.allocator.FreePageCount()
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 10000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	// allocate some pages and free one
+	pageIDs := []uint64{}
+	for i := 0; i < 3; i++ {
+		pageID, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+	err := DatabaseManager.allocator.FreePage(pageIDs[2])
+	if err != nil {
+		t.Fatal("Failed to free page", pageIDs[2], ":", err)
+	}
+
+	// one miss followed by a hit, then a checkpoint and two pending writes
+	_, err = DatabaseManager.WriteAt(pageIDs[0], 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIDs[0], ":", err)
+	}
+	_, err = DatabaseManager.GetPage(pageIDs[0])
+	if err != nil {
+		t.Fatal("Read failed for page", pageIDs[0], ":", err)
+	}
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	err = DatabaseManager.SetCheckpointThreshold(10000)
+	if err != nil {
+		t.Fatal("Failed to set checkpoint threshold :", err)
+	}
+	for _, id := range pageIDs[:2] {
+		_, err = DatabaseManager.WriteAt(id, 0, []byte{2})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+	ok, err := DatabaseManager.VerifyDatabase()
+	if err != nil || !ok {
+		t.Fatal("Database verification failed :", err)
+	}
+
+	health := DatabaseManager.Health()
+	if health.Error != "" {
+		t.Fatal("Failed to get health :", health.Error)
+	}
+	encoded, err := json.Marshal(health)
+	if err != nil {
+		t.Fatal("Failed to marshal health :", err)
+	}
+	fields := map[string]any{}
+	err = json.Unmarshal(encoded, &fields)
+	if err != nil {
+		t.Fatal("Failed to unmarshal health :", err)
+	}
+
+	for _, key := range []string{"total_pages", "free_pages", "cached_pages", "cache_hit_ratio",
+		"wal_bytes", "pending_transactions", "last_checkpoint", "last_verify", "verify_passed"} {
+		if _, ok := fields[key]; !ok {
+			t.Error("Health JSON is missing", key)
+		}
+	}
+	if fields["total_pages"] != float64(4) || fields["free_pages"] != float64(1) {
+		t.Error("Unexpected page counts", fields["total_pages"], fields["free_pages"])
+	}
+	if fields["pending_transactions"] != float64(2) || fields["wal_bytes"] == float64(0) {
+		t.Error("Unexpected WAL state", fields["pending_transactions"], fields["wal_bytes"])
+	}
+	if health.CacheHitRatio <= 0 || health.CacheHitRatio >= 1 {
+		t.Error("Implausible cache hit ratio", health.CacheHitRatio)
+	}
+	if health.LastCheckpoint.IsZero() || !health.VerifyPassed {
+		t.Error("Checkpoint or verification not recorded", health.LastCheckpoint, health.VerifyPassed)
+	}
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+
+	pageIDs := []uint64{}
+	for i := 0; i < 3; i++ {
+		pageID, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		_, err = DatabaseManager.WriteAt(pageID, uint32(i), []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", pageID, ":", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	// pending writes fail the check
+	err := DatabaseManager.VerifyCheckpoint()
+	if !errors.Is(err, ErrCheckpointInconsistent) {
+		t.Fatal("Expected an inconsistent checkpoint before checkpointing, got", err)
+	}
+
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	err = DatabaseManager.VerifyCheckpoint()
+	if err != nil {
+		t.Fatal("Expected checkpoint to verify :", err)
+	}
+
+	// a data file that lost a write fails the check
+	stale := MakePageData()
+	err = DatabaseManager.allocator.WritePageData(pageIDs[1], stale)
+	if err != nil {
+		t.Fatal("Write failed for page", pageIDs[1], ":", err)
+	}
+	err = DatabaseManager.VerifyCheckpoint()
+	if !errors.Is(err, ErrCheckpointInconsistent) {
+		t.Error("Expected a mismatched page to fail verification, got", err)
+	}
+}
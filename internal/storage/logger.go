@@ -0,0 +1,33 @@
+package storage
+
+// Logger receives structured events from the engine. Fields are
+// alternating key value pairs in the style of log/slog
+type Logger interface {
+	Event(name string, fields ...any)
+}
+
+// Events emitted to the Logger
+const (
+	EventPageAllocated        = "page_allocated"
+	EventTransactionCommitted = "transaction_committed"
+	EventCheckpointStarted    = "checkpoint_started"
+	EventCheckpointFinished   = "checkpoint_finished"
+	EventPageEvicted          = "page_evicted"
+	EventCorruptionDetected   = "corruption_detected"
+	EventVacuumed             = "vacuumed"
+)
+
+// SetLogger sets the logger engine events are sent to, nil disables logging
+func (DatabaseManager *DatabaseManager) SetLogger(logger Logger) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.logger = logger
+}
+
+// logEvent sends an event to the logger if one is set
+func (DatabaseManager *DatabaseManager) logEvent(name string, fields ...any) {
+	if DatabaseManager.logger == nil {
+		return
+	}
+	DatabaseManager.logger.Event(name, fields...)
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+type captureLogger struct {
+	events []string
+}
+
+func (captureLogger *captureLogger) Event(name string, fields ...any) {
+	captureLogger.events = append(captureLogger.events, name)
+}
+
+func TestLogger(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 1)
+	defer DatabaseManager.Shutdown()
+
+	logger := &captureLogger{}
+	DatabaseManager.SetLogger(logger)
+
+	first, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	second, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	_, err = DatabaseManager.WriteAt(first, 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page", first, ":", err)
+	}
+	// the cache holds one page so this evicts the first
+	_, err = DatabaseManager.WriteAt(second, 0, []byte{2})
+	if err != nil {
+		t.Fatal("Write failed for page", second, ":", err)
+	}
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+
+	expected := []string{
+		EventPageAllocated,
+		EventPageAllocated,
+		EventTransactionCommitted,
+		EventPageEvicted,
+		EventTransactionCommitted,
+		EventCheckpointStarted,
+		EventCheckpointFinished,
+	}
+	if len(logger.events) != len(expected) {
+		t.Fatal("Expected events", expected, "but got", logger.events)
+	}
+	for i, event := range expected {
+		if logger.events[i] != event {
+			t.Error("Expected event", i, "to be", event, "but got", logger.events[i])
+		}
+	}
+
+	// no events once the logger is removed
+	DatabaseManager.SetLogger(nil)
+	_, err = DatabaseManager.WriteAt(second, 0, []byte{3})
+	if err != nil {
+		t.Fatal("Write failed for page", second, ":", err)
+	}
+	if len(logger.events) != len(expected) {
+		t.Error("Expected no events after removing the logger, got", logger.events[len(expected):])
+	}
+}
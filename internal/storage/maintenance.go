@@ -0,0 +1,53 @@
+package storage
+
+import "fmt"
+
+// EnterMaintenance pauses checkpoints and the writes evicting an unlogged
+// page would cause, so maintenance work like a backup sees a stable data
+// file. The cache grows past its capacity instead of writing pages out.
+// Calls nest, every call must be matched by ExitMaintenance
+func (DatabaseManager *DatabaseManager) EnterMaintenance() {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.maintenance++
+}
+
+// ExitMaintenance ends a maintenance period. Once the last one ends, a
+// checkpoint that came due runs and the cache is trimmed back to capacity
+func (DatabaseManager *DatabaseManager) ExitMaintenance() error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if DatabaseManager.maintenance == 0 {
+		return fmt.Errorf("database is not in maintenance")
+	}
+	DatabaseManager.maintenance--
+	if DatabaseManager.maintenance > 0 {
+		return nil
+	}
+
+	err := DatabaseManager.checkpointTrigger()
+	if err != nil {
+		return err
+	}
+	if len(DatabaseManager.database) > DatabaseManager.cacheCapacityPages {
+		return DatabaseManager.removeVictims(len(DatabaseManager.database) - DatabaseManager.cacheCapacityPages)
+	}
+	return nil
+}
+
+// InMaintenance reports whether the database is in maintenance
+func (DatabaseManager *DatabaseManager) InMaintenance() bool {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.maintenance > 0
+}
+
+// deferEviction reports whether evicting the next victim has to wait for the
+// end of maintenance, as it would write unlogged changes to the data file
+func (DatabaseManager *DatabaseManager) deferEviction() bool {
+	if DatabaseManager.maintenance == 0 {
+		return false
+	}
+	victim, ok := DatabaseManager.policy.Victim()
+	return ok && DatabaseManager.unlogged[victim]
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Overflow page layout, each page of a chain starts with the id of the next
+// page, 0 for the last one, and the number of payload bytes it holds
+const (
+	OverflowNextOffset   = 0  // Offset to the next page id (8 bytes)
+	OverflowLengthOffset = 8  // Offset to the payload length (4 bytes)
+	OverflowHeaderSize   = 12 // Bytes before the payload
+)
+
+// WriteOverflow stores data larger than a page in a chain of overflow pages
+// written as one transaction, and returns the id of the first page
+func (DatabaseManager *DatabaseManager) WriteOverflow(data []byte) (uint64, error) {
+	return DatabaseManager.commitLogged(func() (uint64, *walSync, error) {
+		return DatabaseManager.writeOverflow(data)
+	})
+}
+
+// writeOverflow implements WriteOverflow with the lock held
+func (DatabaseManager *DatabaseManager) writeOverflow(data []byte) (uint64, *walSync, error) {
+	capacity := int(DatabaseManager.allocator.PageSize) - PageHeaderSize - OverflowHeaderSize
+	count := max(1, (len(data)+capacity-1)/capacity)
+	pageIds := []uint64{}
+	for range count {
+		id, err := DatabaseManager.allocator.AllocatePage(PageTypeOverflow)
+		if err != nil {
+			DatabaseManager.freePages(pageIds)
+			return 0, nil, err
+		}
+		DatabaseManager.modified[id] = DatabaseManager.wal.nextTransactionId
+		DatabaseManager.logEvent(EventPageAllocated, "page", id, "type", PageTypeOverflow)
+		pageIds = append(pageIds, id)
+	}
+
+	changes := []PageDelta{}
+	for i, pageId := range pageIds {
+		chunk := data[min(i*capacity, len(data)):min((i+1)*capacity, len(data))]
+		next := uint64(0)
+		if i+1 < len(pageIds) {
+			next = pageIds[i+1]
+		}
+		page := binary.LittleEndian.AppendUint64([]byte{}, next)
+		page = binary.LittleEndian.AppendUint32(page, uint32(len(chunk)))
+		page = append(page, chunk...)
+		changes = append(changes, PageDelta{pageId, 0, page})
+	}
+	_, synced, err := DatabaseManager.writePages(changes)
+	if err != nil {
+		DatabaseManager.freePages(pageIds)
+		return 0, nil, err
+	}
+	return pageIds[0], synced, nil
+}
+
+// ReadOverflow follows the chain of overflow pages starting at headId and
+// returns the data reassembled
+func (DatabaseManager *DatabaseManager) ReadOverflow(headId uint64) ([]byte, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	_, data, err := DatabaseManager.overflowChain(headId)
+	return data, err
+}
+
+// FreeOverflow returns every page of the chain starting at headId to the free list
+func (DatabaseManager *DatabaseManager) FreeOverflow(headId uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	pageIds, _, err := DatabaseManager.overflowChain(headId)
+	if err != nil {
+		return err
+	}
+	err = DatabaseManager.checkFreeable(pageIds)
+	if err != nil {
+		return err
+	}
+	return DatabaseManager.freePages(pageIds)
+}
+
+// overflowChain walks a chain of overflow pages and returns their ids
+// along with the payload they hold
+func (DatabaseManager *DatabaseManager) overflowChain(headId uint64) ([]uint64, []byte, error) {
+	total, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	pageIds := []uint64{}
+	response := []byte{}
+	for pageId := headId; pageId != 0; {
+		if uint64(len(pageIds)) >= total || pageId >= total {
+			return nil, nil, fmt.Errorf("overflow chain from page %d is broken at page %d", headId, pageId)
+		}
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.PageType != PageTypeOverflow {
+			return nil, nil, fmt.Errorf("page %d is not an overflow page", pageId)
+		}
+		data, err := DatabaseManager.cachePage(pageId)
+		if err != nil {
+			return nil, nil, err
+		}
+		length := int(binary.LittleEndian.Uint32(data[OverflowLengthOffset:]))
+		if OverflowHeaderSize+length > len(data) {
+			return nil, nil, fmt.Errorf("overflow page %d holds %d bytes, more than fit in a page", pageId, length)
+		}
+		response = append(response, data[OverflowHeaderSize:OverflowHeaderSize+length]...)
+		pageIds = append(pageIds, pageId)
+		pageId = binary.LittleEndian.Uint64(data[OverflowNextOffset:])
+	}
+	return pageIds, response, nil
+}
+
+// checkFreeable returns an error if any of the pages can't be freed now
+func (DatabaseManager *DatabaseManager) checkFreeable(pageIds []uint64) error {
+	total, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	for _, pageId := range pageIds {
+		if pageId == 0 {
+			return fmt.Errorf("page 0 holds the database metadata")
+		}
+		if pageId >= total {
+			return fmt.Errorf("page %d does not exist, database has %d pages", pageId, total)
+		}
+		if DatabaseManager.pinned[pageId] > 0 {
+			return fmt.Errorf("%w: page %d holds %d pins", ErrPagePinned, pageId, DatabaseManager.pinned[pageId])
+		}
+		_, pending := DatabaseManager.wal.Cache[pageId]
+		if (pending || DatabaseManager.unlogged[pageId]) && (DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing) {
+			return fmt.Errorf("page %d has changes that can't be checkpointed yet", pageId)
+		}
+	}
+	return nil
+}
+
+// freePages drops pages from the cache and returns them to the free list.
+// Pages with changes not yet on disk are checkpointed first, otherwise
+// the checkpoint would later write them over the free list link. Callers
+// check the pages with checkFreeable first
+func (DatabaseManager *DatabaseManager) freePages(pageIds []uint64) error {
+	for _, pageId := range pageIds {
+		_, pending := DatabaseManager.wal.Cache[pageId]
+		if !pending && !DatabaseManager.unlogged[pageId] {
+			continue
+		}
+		if DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing {
+			return fmt.Errorf("page %d has changes that can't be checkpointed yet", pageId)
+		}
+		err := DatabaseManager.flushCheckpoint()
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	for _, pageId := range pageIds {
+		DatabaseManager.uncachePage(pageId)
+		err := DatabaseManager.allocator.FreePage(pageId)
+		if err != nil {
+			return err
+		}
+		DatabaseManager.modified[pageId] = DatabaseManager.wal.nextTransactionId
+	}
+	return nil
+}
+
+// uncachePage drops a page from the cache without writing it out. Any pins
+// on it are left for Unpin to release
+func (DatabaseManager *DatabaseManager) uncachePage(pageId uint64) {
+	if _, ok := DatabaseManager.database[pageId]; !ok {
+		return
+	}
+	DatabaseManager.policy.Remove(pageId)
+	delete(DatabaseManager.database, pageId)
+	delete(DatabaseManager.unlogged, pageId)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestOverflow(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 2)
+
+	payload := make([]byte, 10*1024)
+	rand.Read(payload)
+	headId, err := DatabaseManager.WriteOverflow(payload)
+	if err != nil {
+		t.Fatal("Failed to write overflow data:", err)
+	}
+	pageIds, _, err := DatabaseManager.overflowChain(headId)
+	if err != nil {
+		t.Fatal("Failed to walk overflow chain:", err)
+	}
+	if len(pageIds) != 3 {
+		t.Fatal("Expected 10KB to span 3 pages, got", len(pageIds))
+	}
+
+	// the chain is rebuilt from the WAL after a restart
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 2)
+	defer DatabaseManager.Shutdown()
+	data, err := DatabaseManager.ReadOverflow(headId)
+	if err != nil {
+		t.Fatal("Failed to read overflow data:", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatal("Overflow data mismatch, got", len(data), "bytes")
+	}
+
+	// a pin on any page of the chain stops the whole chain being freed
+	err = DatabaseManager.Pin(pageIds[1])
+	if err != nil {
+		t.Fatal("Failed to pin page", pageIds[1], ":", err)
+	}
+	err = DatabaseManager.FreeOverflow(headId)
+	if !errors.Is(err, ErrPagePinned) {
+		t.Fatal("Expected ErrPagePinned freeing a pinned chain, got", err)
+	}
+	free, err := DatabaseManager.allocator.FreePageCount()
+	if err != nil || free != 0 {
+		t.Fatal("Expected no pages freed from a pinned chain, got", free, err)
+	}
+	err = DatabaseManager.Unpin(pageIds[1])
+	if err != nil {
+		t.Fatal("Failed to unpin page", pageIds[1], ":", err)
+	}
+
+	err = DatabaseManager.FreeOverflow(headId)
+	if err != nil {
+		t.Fatal("Failed to free overflow chain:", err)
+	}
+	free, err = DatabaseManager.allocator.FreePageCount()
+	if err != nil || free != 3 {
+		t.Error("Expected the 3 pages of the chain on the free list, got", free, err)
+	}
+	_, err = DatabaseManager.ReadOverflow(headId)
+	if err == nil {
+		t.Error("Expected error reading a freed overflow chain")
+	}
+
+	// freed pages are reused and an empty payload still takes a page
+	headId, err = DatabaseManager.WriteOverflow([]byte{})
+	if err != nil {
+		t.Fatal("Failed to write empty overflow data:", err)
+	}
+	data, err = DatabaseManager.ReadOverflow(headId)
+	if err != nil || len(data) != 0 {
+		t.Error("Expected empty overflow data, got", len(data), "bytes", err)
+	}
+}
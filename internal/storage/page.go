@@ -1,10 +1,13 @@
 package storage
 
-import "hash/crc32"
+import (
+	"fmt"
+	"hash/crc32"
+)
 
 // PageData represents the data portion of a page, excluding the header.
-// It's a fixed-size array of bytes with a size of DefaultPageSize - PageHeaderSize.
-type PageData *[DefaultPageSize - PageHeaderSize]byte
+// Its length is the database's page size minus PageHeaderSize.
+type PageData []byte
 
 // Page represents a complete database page, containing both header and data.
 type Page struct {
@@ -19,18 +22,54 @@ type Page struct {
 type PageHeader struct {
 	PageVersion byte   // Version number for page format
 	PageType    byte   // Type of page (metadata, user data, etc.)
-	Checksum    uint32 // CRC32 checksum of page data
+	Checksum    uint32 // Checksum of page data, and of the version and type when the database covers headers
+}
+
+// ChecksumAlgorithm selects the function page and WAL checksums are
+// computed with. It is stored in MetaChecksumAlgorithm
+type ChecksumAlgorithm uint64
+
+// Checksum algorithms, databases without a stored algorithm use CRC32
+const (
+	ChecksumCRC32  ChecksumAlgorithm = iota // CRC32 with the IEEE polynomial
+	ChecksumCRC32C                          // CRC32 with the Castagnoli polynomial, hardware accelerated on most CPUs
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// table returns the CRC32 table of the algorithm
+func (algorithm ChecksumAlgorithm) table() *crc32.Table {
+	if algorithm == ChecksumCRC32C {
+		return castagnoliTable
+	}
+	return crc32.IEEETable
 }
 
-// getChecksum calculates a CRC32 checksum for the page data
-func getChecksum(data PageData) uint32 {
-	return crc32.ChecksumIEEE(data[:])
+// valid reports whether the algorithm is known
+func (algorithm ChecksumAlgorithm) valid() bool {
+	return algorithm == ChecksumCRC32 || algorithm == ChecksumCRC32C
 }
 
-// MakePageData creates a new empty page data buffer
+// getChecksum calculates the checksum of the page data
+func getChecksum(algorithm ChecksumAlgorithm, data PageData) uint32 {
+	return crc32.Checksum(data[:], algorithm.table())
+}
+
+// getHeaderChecksum calculates a checksum over the page version and type
+// bytes followed by the page data
+func getHeaderChecksum(algorithm ChecksumAlgorithm, version byte, pageType byte, data PageData) uint32 {
+	checksum := crc32.Checksum([]byte{version, pageType}, algorithm.table())
+	return crc32.Update(checksum, algorithm.table(), data[:])
+}
+
+// MakePageData creates a new empty page data buffer for DefaultPageSize pages
 func MakePageData() PageData {
-	value := [DefaultPageSize - PageHeaderSize]byte{}
-	return &value
+	return MakePageDataSize(DefaultPageSize)
+}
+
+// MakePageDataSize creates a new empty page data buffer for pages of the given size
+func MakePageDataSize(pageSize int64) PageData {
+	return make(PageData, pageSize-PageHeaderSize)
 }
 
 // Page header layout constants
@@ -48,6 +87,70 @@ const (
 	MetadataPageSizeOffset     = 16 + PageHeaderSize // Offset to page size
 )
 
+// MetaField names a 64-bit field in the metadata page. Field n is stored
+// at PageHeaderSize + 8*n, so the first fields match the offsets above
+type MetaField int
+
+// Metadata fields, new fields are appended before the extension area
+const (
+	MetaFreeListHead      MetaField = iota // Head of the free list
+	MetaTotalPages                         // Total page count
+	MetaPageSize                           // Page size
+	MetaDirectoryHead                      // First page of the table directory
+	MetaChecksumAlgorithm                  // Algorithm used for page checksums
+	MetaHighWaterMark                      // Highest page id ever allocated
+	MetaBackupLSN                          // First transaction not covered by a backup file
+	MetaChecksumFlags                      // Format flags for page checksums
+	MetaNextTransactionId                  // First transaction id not in use when the WAL was last cleared
+	MetaChecksumSwitch                     // Checksum scheme pages are being rewritten to, 0 when no switch is in progress
+	MetaExtension         MetaField = 32   // First of the slots reserved for extensions
+	MetaFieldSlots                  = 64   // Number of metadata field slots
+)
+
+// Checksum format flags stored in MetaChecksumFlags
+const (
+	ChecksumCoversHeader = 1 << iota // Page checksums include the version and type bytes
+)
+
+// checksumScheme is how page checksums are computed
+type checksumScheme struct {
+	algorithm    ChecksumAlgorithm
+	coversHeader bool
+}
+
+// checksumSwitchPending marks MetaChecksumSwitch as holding a scheme
+const checksumSwitchPending = 1 << 63
+
+// pageChecksum calculates the checksum of a page under the scheme
+func (scheme checksumScheme) pageChecksum(header PageHeader, data PageData) uint32 {
+	if scheme.coversHeader {
+		return getHeaderChecksum(scheme.algorithm, header.PageVersion, header.PageType, data)
+	}
+	return getChecksum(scheme.algorithm, data)
+}
+
+// encode packs the scheme into a MetaChecksumSwitch value, the algorithm
+// in the low bits and the format flags from bit 32
+func (scheme checksumScheme) encode() uint64 {
+	value := checksumSwitchPending | uint64(scheme.algorithm)&0xffffffff
+	if scheme.coversHeader {
+		value |= ChecksumCoversHeader << 32
+	}
+	return value
+}
+
+// decodeChecksumScheme unpacks a MetaChecksumSwitch value
+func decodeChecksumScheme(value uint64) (checksumScheme, error) {
+	scheme := checksumScheme{
+		algorithm:    ChecksumAlgorithm(value & 0xffffffff),
+		coversHeader: (value>>32)&ChecksumCoversHeader != 0,
+	}
+	if !scheme.algorithm.valid() {
+		return scheme, fmt.Errorf("checksum switch to unknown algorithm %d", scheme.algorithm)
+	}
+	return scheme, nil
+}
+
 // Page type constants
 // These define the different types of pages in the database
 const (
@@ -58,7 +161,11 @@ const (
 	PagetypeTableData        // Page containing table data
 	PageTypeOverflow         // Page for overflow data
 	PageTypeIndex            // Page containing index data
+	PageTypeDirectory        // Page listing the tables and their schema pages
 )
 
 // DefaultPageSize is the standard size of a database page (4KB)
 const DefaultPageSize = 4096
+
+// MinPageSize is the smallest page that fits the header and every metadata field
+const MinPageSize = PageHeaderSize + 8*MetaFieldSlots
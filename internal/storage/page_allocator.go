@@ -2,70 +2,134 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 )
 
+// ErrDatabaseFull is returned when allocating a page would grow the
+// database file past its configured maximum size
+var ErrDatabaseFull = errors.New("database file has reached its maximum size")
+
+// ErrDoubleFree is returned when freeing a page that is already free
+var ErrDoubleFree = errors.New("page is already free")
+
+// ErrChecksumMismatch is returned when a page's data doesn't match its checksum
+var ErrChecksumMismatch = errors.New("Checksum Mismatch")
+
 // PageAllocator manages the allocation and deallocation of pages in the database.
 // It maintains a free list of pages and handles page metadata including:
 // - Page version
 // - Page type
 // - Checksum for data integrity
 type PageAllocator struct {
-	PageSize int64    // Size of each page in bytes
-	Database *os.File // File handle for the database file
+	PageSize int64   // Size of each page in bytes
+	Database Storage // Storage backing the database, usually a file
 	// Pre-calculated checksum for empty pages to avoid recalculation
 	emptyChecksum uint32
+	// Maximum size of the database file in bytes, 0 for no limit
+	maxFileSize int64
+	// Whether checksums cover the version and type bytes of the header
+	headerChecksum bool
+	// Algorithm page checksums are computed with
+	checksum ChecksumAlgorithm
+	// Hooks transforming page data on its way to and from storage
+	readHooks  []PageHook
+	writeHooks []PageHook
 }
 
 // Initialize sets up the page allocator by:
 // 1. Opening the database file
 // 2. Creating the metadata page if the database is new
 // 3. Initializing the free list and page count
-func (pageAllocator *PageAllocator) Initialize(file string) error {
-	// Initialize fields
-	pageAllocator.PageSize = DefaultPageSize
-	var err error
-	pageAllocator.Database, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0666)
+// The page size is only used when creating a database, 0 selects
+// DefaultPageSize. An existing database keeps the size it was created with
+func (pageAllocator *PageAllocator) Initialize(file string, pageSize int64) error {
+	database, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
-	data := MakePageData()
-	pageAllocator.emptyChecksum = getChecksum(data)
+	return pageAllocator.InitializeStorage(fileStorage{database}, pageSize)
+}
 
-	// Check if database is new (needs metadata page)
-	info, err := pageAllocator.Database.Stat()
-	if err != nil || info.Size() != 0 {
-		return err
+// InitializeStorage sets up the page allocator on the given storage,
+// creating the metadata page with the given page size if the storage is empty
+func (pageAllocator *PageAllocator) InitializeStorage(database Storage, pageSize int64) error {
+	// Initialize fields
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
 	}
-
-	// Create metadata page with headers
-	metaData := make([]byte, pageAllocator.PageSize)
-	metaData[PageHeaderVersionOffset] = 0
-	metaData[PageHeaderTypeOffset] = PagetypeMetadata
-	binary.LittleEndian.PutUint32(data[PageHeaderChecksumOffset:], pageAllocator.emptyChecksum)
-
-	// Write metadata page to disk
-	_, err = pageAllocator.Database.Write(metaData)
-	if err != nil {
-		return err
+	if pageSize < MinPageSize {
+		return fmt.Errorf("page size %d is smaller than the minimum of %d", pageSize, MinPageSize)
 	}
+	pageAllocator.Database = database
 
-	// Initialize metadata values
-	err = pageAllocator.WriteMetadata(MetadataFreeListHeadOffset, 0) // Empty free list
+	// Existing databases use the page size stored in their metadata
+	size, err := pageAllocator.Database.Size()
 	if err != nil {
 		return err
 	}
-	err = pageAllocator.WriteMetadata(MetadataTotalPageOffset, 1) // One page (metadata)
-	if err != nil {
-		return err
+	if size != 0 {
+		storedSize, err := pageAllocator.ReadMetadata(MetadataPageSizeOffset)
+		if err != nil {
+			return err
+		}
+		if storedSize != 0 {
+			pageSize = int64(storedSize)
+		}
 	}
-	err = pageAllocator.WriteMetadata(MetadataPageSizeOffset, uint64(pageAllocator.PageSize))
+	pageAllocator.PageSize = pageSize
+	pageAllocator.headerChecksum = false
+	pageAllocator.checksum = ChecksumCRC32
+	if size != 0 {
+		flags, err := pageAllocator.ReadMetaField(MetaChecksumFlags)
+		if err != nil {
+			return err
+		}
+		pageAllocator.headerChecksum = flags&ChecksumCoversHeader != 0
+		// pages are only ever verified with the algorithm they were written with
+		algorithm, err := pageAllocator.ReadMetaField(MetaChecksumAlgorithm)
+		if err != nil {
+			return err
+		}
+		pageAllocator.checksum = ChecksumAlgorithm(algorithm)
+		if !pageAllocator.checksum.valid() {
+			return fmt.Errorf("database uses unknown checksum algorithm %d", algorithm)
+		}
+		pageAllocator.emptyChecksum = getChecksum(pageAllocator.checksum, pageAllocator.makePageData())
+		// a checksum switch cut short is finished before any page is read
+		pending, err := pageAllocator.ReadMetaField(MetaChecksumSwitch)
+		if err != nil || pending == 0 {
+			return err
+		}
+		target, err := decodeChecksumScheme(pending)
+		if err != nil {
+			return err
+		}
+		return pageAllocator.finishChecksumSwitch(pageAllocator.scheme(), target)
+	}
+	pageAllocator.emptyChecksum = getChecksum(pageAllocator.checksum, pageAllocator.makePageData())
+
+	// Build the whole metadata page so it is created with a single write,
+	// a crash can't leave some of the fields unset. New databases checksum
+	// the page headers too
+	flagsOffset, err := metaFieldOffset(MetaChecksumFlags)
 	if err != nil {
 		return err
 	}
+	pageAllocator.headerChecksum = true
+	metaData := make([]byte, pageAllocator.PageSize)
+	metaData[PageHeaderVersionOffset] = 0
+	metaData[PageHeaderTypeOffset] = PagetypeMetadata
+	binary.LittleEndian.PutUint64(metaData[MetadataFreeListHeadOffset:], 0) // Empty free list
+	binary.LittleEndian.PutUint64(metaData[MetadataTotalPageOffset:], 1)    // One page (metadata)
+	binary.LittleEndian.PutUint64(metaData[MetadataPageSizeOffset:], uint64(pageAllocator.PageSize))
+	binary.LittleEndian.PutUint64(metaData[flagsOffset:], ChecksumCoversHeader)
+	checksum := getHeaderChecksum(pageAllocator.checksum, 0, PagetypeMetadata, metaData[PageHeaderSize:])
+	binary.LittleEndian.PutUint32(metaData[PageHeaderChecksumOffset:], checksum)
 
+	_, err = pageAllocator.Database.WriteAt(metaData, 0)
 	return err
 }
 
@@ -80,46 +144,280 @@ func (pageAllocator *PageAllocator) AllocatePage(pageType byte) (uint64, error)
 	}
 	if freePage == 0 {
 		// No free pages, create a new one
-		data := make([]byte, pageAllocator.PageSize)
+		return pageAllocator.appendPage(pageType)
+	}
+
+	// Reuse a page from the free list
+	nextPage := make([]byte, 8)
+	_, err = pageAllocator.Database.ReadAt(nextPage, int64(freePage)*int64(pageAllocator.PageSize)+PageHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Update free list to point to next free page
+	err = pageAllocator.WriteFreeList(binary.LittleEndian.Uint64(nextPage))
+	// Update page type
+	pageAllocator.WritePageHeader(freePage, PageHeaderTypeOffset, pageType)
+	return freePage, err
+}
+
+// appendPage creates a new page at the end of the database file
+func (pageAllocator *PageAllocator) appendPage(pageType byte) (uint64, error) {
+	ids, err := pageAllocator.appendPages(pageType, 1)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// appendPages creates count pages at the end of the database file with a
+// single write, and updates the total page count once
+func (pageAllocator *PageAllocator) appendPages(pageType byte, count int) ([]uint64, error) {
+	// Get new page ID
+	first, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to grow past the configured cap
+	end := first + uint64(count)
+	if pageAllocator.maxFileSize > 0 && int64(end)*pageAllocator.PageSize > pageAllocator.maxFileSize {
+		return nil, ErrDatabaseFull
+	}
+
+	checksum := pageAllocator.emptyChecksum
+	if pageAllocator.headerChecksum {
+		checksum = getHeaderChecksum(pageAllocator.checksum, 0, pageType, pageAllocator.makePageData())
+	}
+	data := make([]byte, int64(count)*pageAllocator.PageSize)
+	ids := make([]uint64, 0, count)
+	for id := first; id < end; id++ {
+		page := data[int64(id-first)*pageAllocator.PageSize:][:pageAllocator.PageSize]
 		// Set page headers
-		data[PageHeaderVersionOffset] = 0
-		data[PageHeaderTypeOffset] = pageType
-		binary.LittleEndian.PutUint32(data[PageHeaderChecksumOffset:], pageAllocator.emptyChecksum)
+		page[PageHeaderVersionOffset] = 0
+		page[PageHeaderTypeOffset] = pageType
+		binary.LittleEndian.PutUint32(page[PageHeaderChecksumOffset:], checksum)
 
-		// Get new page ID
-		id, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+		// the empty data goes through the write hooks like any other
+		encoded, err := pageAllocator.encodePage(id, PageData(page[PageHeaderSize:]))
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
+		copy(page[PageHeaderSize:], encoded)
+		ids = append(ids, id)
+	}
+
+	// Write new pages to disk
+	_, err = pageAllocator.Database.WriteAt(data, int64(first)*pageAllocator.PageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update total page count
+	err = pageAllocator.WriteMetadata(MetadataTotalPageOffset, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// Raise the high-water mark, it stays put when Shrink cuts the file
+	mark, err := pageAllocator.ReadMetaField(MetaHighWaterMark)
+	if err != nil || mark >= end-1 {
+		return ids, err
+	}
+	return ids, pageAllocator.WriteMetaField(MetaHighWaterMark, end-1)
+}
 
-		// Write new page to disk
-		_, err = pageAllocator.Database.Write(data)
+// AllocatePageBatch allocates count pages of the specified type. Pages on
+// the free list are reused first, the rest are added to the end of the
+// file with a single write
+func (pageAllocator *PageAllocator) AllocatePageBatch(pageType byte, count int) ([]uint64, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("page count must be positive, got %d", count)
+	}
+	ids := []uint64{}
+	for len(ids) < count {
+		freePage, err := pageAllocator.ReadFreeList()
 		if err != nil {
-			return 0, err
+			return nil, pageAllocator.releasePages(ids, err)
 		}
+		if freePage == 0 {
+			break
+		}
+		id, err := pageAllocator.AllocatePage(pageType)
+		if err != nil {
+			return nil, pageAllocator.releasePages(ids, err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == count {
+		return ids, nil
+	}
+	appended, err := pageAllocator.appendPages(pageType, count-len(ids))
+	if err != nil {
+		return nil, pageAllocator.releasePages(ids, err)
+	}
+	return append(ids, appended...), nil
+}
 
-		// Update total page count
-		err = pageAllocator.WriteMetadata(MetadataTotalPageOffset, id+1)
-		return id, err
+// releasePages puts pages taken by a failed batch back on the free list
+// and returns the error that failed it
+func (pageAllocator *PageAllocator) releasePages(ids []uint64, err error) error {
+	for _, id := range ids {
+		pageAllocator.FreePage(id)
 	}
+	return err
+}
 
-	// Reuse a page from the free list
+// AllocateSpecific makes the page with the given id live, as needed when
+// restoring pages whose ids are referenced elsewhere. Pages between the end
+// of the file and id are created on the free list, and a free page with
+// that id is taken off the free list. Errors if the page is already live
+func (pageAllocator *PageAllocator) AllocateSpecific(id uint64, pageType byte) error {
+	if id == 0 {
+		return fmt.Errorf("page 0 holds the database metadata")
+	}
+	total, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+
+	if id < total {
+		header, err := pageAllocator.ReadPageHeader(id)
+		if err != nil {
+			return err
+		}
+		if header.PageType != PagetypeFreepage {
+			return fmt.Errorf("page %d is already live", id)
+		}
+		err = pageAllocator.unlinkFreePage(id)
+		if err != nil {
+			return err
+		}
+		return pageAllocator.WritePageHeader(id, PageHeaderTypeOffset, pageType)
+	}
+
+	// Check the cap up front so a failure doesn't leave the file half extended
+	if pageAllocator.maxFileSize > 0 && int64(id+1)*pageAllocator.PageSize > pageAllocator.maxFileSize {
+		return ErrDatabaseFull
+	}
+	for next := total; next < id; next++ {
+		_, err = pageAllocator.appendPage(PagetypeUserdata)
+		if err != nil {
+			return err
+		}
+		err = pageAllocator.FreePage(next)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = pageAllocator.appendPage(pageType)
+	return err
+}
+
+// unlinkFreePage removes a page from anywhere in the free list
+func (pageAllocator *PageAllocator) unlinkFreePage(id uint64) error {
+	total, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	previous := uint64(0)
+	current, err := pageAllocator.ReadFreeList()
+	if err != nil {
+		return err
+	}
 	nextPage := make([]byte, 8)
-	_, err = pageAllocator.Database.ReadAt(nextPage, int64(freePage)*int64(pageAllocator.PageSize)+PageHeaderSize)
+	for steps := uint64(0); current != 0; steps++ {
+		if steps > total {
+			return fmt.Errorf("free list is longer than the %d pages in the database", total)
+		}
+		_, err = pageAllocator.Database.ReadAt(nextPage, int64(current)*pageAllocator.PageSize+PageHeaderSize)
+		if err != nil {
+			return err
+		}
+		if current != id {
+			previous = current
+			current = binary.LittleEndian.Uint64(nextPage)
+			continue
+		}
+
+		if previous == 0 {
+			return pageAllocator.WriteFreeList(binary.LittleEndian.Uint64(nextPage))
+		}
+		// Point the previous free page past this one
+		_, err = pageAllocator.Database.WriteAt(nextPage, int64(previous)*pageAllocator.PageSize+PageHeaderSize)
+		if err != nil {
+			return err
+		}
+		return pageAllocator.updateChecksum(previous)
+	}
+	return fmt.Errorf("page %d is not on the free list", id)
+}
+
+// Shrink removes the run of free pages at the end of the file from the free
+// list and truncates the file to drop them. It returns the bytes reclaimed
+func (pageAllocator *PageAllocator) Shrink() (int64, error) {
+	total, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return 0, err
+	}
+	end := total
+	for end > 1 {
+		header, err := pageAllocator.ReadPageHeader(end - 1)
+		if err != nil {
+			return 0, err
+		}
+		if header.PageType != PagetypeFreepage {
+			break
+		}
+		err = pageAllocator.unlinkFreePage(end - 1)
+		if err != nil {
+			return 0, err
+		}
+		end--
+	}
+	if end == total {
+		return 0, nil
+	}
+
+	// The pages are off the free list and past the page count before the
+	// file is cut, so a failed truncate only leaves unused space behind
+	err = pageAllocator.WriteMetadata(MetadataTotalPageOffset, end)
+	if err != nil {
+		return 0, err
+	}
+	err = pageAllocator.Database.Truncate(int64(end) * pageAllocator.PageSize)
 	if err != nil {
 		return 0, err
 	}
+	return int64(total-end) * pageAllocator.PageSize, nil
+}
 
-	// Update free list to point to next free page
-	err = pageAllocator.WriteFreeList(binary.LittleEndian.Uint64(nextPage))
-	// Update page type
-	pageAllocator.WritePageHeader(freePage, PageHeaderTypeOffset, pageType)
-	return freePage, err
+// SetMaxFileSize caps the size of the database file in bytes.
+// Pages on the free list can still be reused once the cap is reached.
+// A size of 0 removes the cap
+func (pageAllocator *PageAllocator) SetMaxFileSize(size int64) {
+	pageAllocator.maxFileSize = size
 }
 
 // FreePage adds a page to the free list for reuse.
 // It updates the free list head and marks the page as free.
 func (pageAllocator *PageAllocator) FreePage(id uint64) error {
+	total, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	if id == 0 || id >= total {
+		return fmt.Errorf("cannot free page %d, pages 1 to %d can be freed", id, total-1)
+	}
+	// Freeing a page twice would link it into the free list twice
+	header, err := pageAllocator.ReadPageHeader(id)
+	if err != nil {
+		return err
+	}
+	if header.PageType == PagetypeFreepage {
+		return fmt.Errorf("%w: page %d", ErrDoubleFree, id)
+	}
+
 	// Get current free list head
 	oldId, err := pageAllocator.ReadFreeList()
 	if err != nil {
@@ -137,17 +435,12 @@ func (pageAllocator *PageAllocator) FreePage(id uint64) error {
 	if err != nil {
 		return err
 	}
-	// Update page metadata
-	pageData, err := pageAllocator.readPageDataWithoutVerify(id)
-	if err != nil {
-		return err
-	}
-	err = pageAllocator.WritePageHeader(id, PageHeaderChecksumOffset, getChecksum(pageData))
+	// Update page metadata, the type goes first as the checksum may cover it
+	err = pageAllocator.WritePageHeader(id, PageHeaderTypeOffset, byte(PagetypeFreepage))
 	if err != nil {
 		return err
 	}
-	err = pageAllocator.WritePageHeader(id, PageHeaderTypeOffset, PagetypeFreepage)
-	return err
+	return pageAllocator.updateChecksum(id)
 }
 
 // ReadFreeList retrieves the head of the free list from metadata
@@ -160,6 +453,58 @@ func (pageAllocator *PageAllocator) WriteFreeList(id uint64) error {
 	return pageAllocator.WriteMetadata(MetadataFreeListHeadOffset, id)
 }
 
+// FreePageCount walks the free list and returns the number of pages on it
+func (pageAllocator *PageAllocator) FreePageCount() (uint64, error) {
+	total, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return 0, err
+	}
+	id, err := pageAllocator.ReadFreeList()
+	if err != nil {
+		return 0, err
+	}
+	count := uint64(0)
+	nextPage := make([]byte, 8)
+	for id != 0 {
+		count++
+		if count > total {
+			return 0, fmt.Errorf("free list is longer than the %d pages in the database", total)
+		}
+		_, err = pageAllocator.Database.ReadAt(nextPage, int64(id)*pageAllocator.PageSize+PageHeaderSize)
+		if err != nil {
+			return 0, err
+		}
+		id = binary.LittleEndian.Uint64(nextPage)
+	}
+	return count, nil
+}
+
+// ReadMetaField reads a named field from the metadata page
+func (pageAllocator *PageAllocator) ReadMetaField(key MetaField) (uint64, error) {
+	offset, err := metaFieldOffset(key)
+	if err != nil {
+		return 0, err
+	}
+	return pageAllocator.ReadMetadata(offset)
+}
+
+// WriteMetaField writes a named field to the metadata page
+func (pageAllocator *PageAllocator) WriteMetaField(key MetaField, value uint64) error {
+	offset, err := metaFieldOffset(key)
+	if err != nil {
+		return err
+	}
+	return pageAllocator.WriteMetadata(offset, value)
+}
+
+// metaFieldOffset returns the offset of a field in the metadata page
+func metaFieldOffset(key MetaField) (int64, error) {
+	if key < 0 || key >= MetaFieldSlots {
+		return 0, fmt.Errorf("metadata field %d out of range for %d slots", key, MetaFieldSlots)
+	}
+	return PageHeaderSize + 8*int64(key), nil
+}
+
 // ReadMetadata reads a 64-bit value from the metadata page at the specified offset
 func (pageAllocator *PageAllocator) ReadMetadata(offset int64) (uint64, error) {
 	data := make([]byte, 8)
@@ -187,14 +532,229 @@ func (pageAllocator *PageAllocator) WriteMetadata(offset int64, data uint64) err
 	}
 
 	// Update metadata page checksum
-	pageData, err := pageAllocator.readPageDataWithoutVerify(0)
+	return pageAllocator.updateChecksum(0)
+}
+
+// SetHeaderChecksum sets whether page checksums cover the version and type
+// bytes of the header so a corrupt header is caught too. The choice is
+// stored in the metadata page and every page's checksum is recomputed
+func (pageAllocator *PageAllocator) SetHeaderChecksum(enabled bool) error {
+	target := pageAllocator.scheme()
+	target.coversHeader = enabled
+	return pageAllocator.switchChecksum(target)
+}
+
+// SetChecksumAlgorithm switches the algorithm page checksums are computed
+// with. The algorithm is stored in the metadata page and every page's
+// checksum is recomputed
+func (pageAllocator *PageAllocator) SetChecksumAlgorithm(algorithm ChecksumAlgorithm) error {
+	if !algorithm.valid() {
+		return fmt.Errorf("unknown checksum algorithm %d", algorithm)
+	}
+	target := pageAllocator.scheme()
+	target.algorithm = algorithm
+	return pageAllocator.switchChecksum(target)
+}
+
+// switchChecksum recomputes every page's checksum under target. All pages
+// are verified under the current scheme first, so a corrupt page fails the
+// switch instead of getting a valid checksum. The target is recorded in the
+// metadata page before any page is rewritten, a switch cut short by a crash
+// is finished when the database is opened again
+func (pageAllocator *PageAllocator) switchChecksum(target checksumScheme) error {
+	current := pageAllocator.scheme()
+	if target == current {
+		return nil
+	}
+	count, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	for id := range count {
+		header, err := pageAllocator.ReadPageHeader(id)
+		if err != nil {
+			return err
+		}
+		data, err := pageAllocator.readPageDataWithoutVerify(id)
+		if err != nil {
+			return err
+		}
+		if current.pageChecksum(header, data) != header.Checksum {
+			return fmt.Errorf("%w on page %d, checksums were not switched", ErrChecksumMismatch, id)
+		}
+	}
+
+	err = pageAllocator.writeMetaPage(current, map[MetaField]uint64{MetaChecksumSwitch: target.encode()})
+	if err != nil {
+		return err
+	}
+	err = pageAllocator.Database.Sync()
+	if err != nil {
+		return err
+	}
+	return pageAllocator.finishChecksumSwitch(current, target)
+}
+
+// finishChecksumSwitch rewrites the checksum of every page still valid
+// under from to target, leaving pages already rewritten alone, then makes
+// target the database's scheme. The metadata page keeps a checksum under
+// from until the last write, which stores the scheme and clears the switch
+func (pageAllocator *PageAllocator) finishChecksumSwitch(from checksumScheme, target checksumScheme) error {
+	count, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return err
+	}
+	for id := uint64(1); id < count; id++ {
+		header, err := pageAllocator.ReadPageHeader(id)
+		if err != nil {
+			return err
+		}
+		data, err := pageAllocator.readPageDataWithoutVerify(id)
+		if err != nil {
+			return err
+		}
+		switch header.Checksum {
+		case target.pageChecksum(header, data):
+			continue
+		case from.pageChecksum(header, data):
+			err = pageAllocator.WritePageHeader(id, PageHeaderChecksumOffset, target.pageChecksum(header, data))
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w on page %d while switching checksums", ErrChecksumMismatch, id)
+		}
+	}
+	err = pageAllocator.Database.Sync()
+	if err != nil {
+		return err
+	}
+
+	// the scheme and the cleared switch are stored with a single write
+	flags, err := pageAllocator.ReadMetaField(MetaChecksumFlags)
 	if err != nil {
 		return err
 	}
-	err = pageAllocator.WritePageHeader(0, PageHeaderChecksumOffset, getChecksum(pageData))
+	if target.coversHeader {
+		flags |= ChecksumCoversHeader
+	} else {
+		flags &^= ChecksumCoversHeader
+	}
+	err = pageAllocator.writeMetaPage(target, map[MetaField]uint64{
+		MetaChecksumAlgorithm: uint64(target.algorithm),
+		MetaChecksumFlags:     flags,
+		MetaChecksumSwitch:    0,
+	})
+	if err != nil {
+		return err
+	}
+
+	pageAllocator.checksum = target.algorithm
+	pageAllocator.headerChecksum = target.coversHeader
+	pageAllocator.emptyChecksum = getChecksum(target.algorithm, pageAllocator.makePageData())
+	return nil
+}
+
+// writeMetaPage sets metadata fields and the metadata page checksum under
+// scheme with a single write, so a crash can't leave the fields and the
+// checksum disagreeing
+func (pageAllocator *PageAllocator) writeMetaPage(scheme checksumScheme, fields map[MetaField]uint64) error {
+	page := make([]byte, pageAllocator.PageSize)
+	_, err := pageAllocator.Database.ReadAt(page, 0)
+	if err != nil {
+		return err
+	}
+	for key, value := range fields {
+		offset, err := metaFieldOffset(key)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(page[offset:], value)
+	}
+	header := PageHeader{PageVersion: page[PageHeaderVersionOffset], PageType: page[PageHeaderTypeOffset]}
+	binary.LittleEndian.PutUint32(page[PageHeaderChecksumOffset:], scheme.pageChecksum(header, page[PageHeaderSize:]))
+	_, err = pageAllocator.Database.WriteAt(page, 0)
 	return err
 }
 
+// scheme returns the scheme page checksums are currently computed with
+func (pageAllocator *PageAllocator) scheme() checksumScheme {
+	return checksumScheme{algorithm: pageAllocator.checksum, coversHeader: pageAllocator.headerChecksum}
+}
+
+// ChecksumAlgorithm returns the algorithm page checksums are computed with
+func (pageAllocator *PageAllocator) ChecksumAlgorithm() ChecksumAlgorithm {
+	return pageAllocator.checksum
+}
+
+// HeaderChecksum reports whether page checksums cover the page header
+func (pageAllocator *PageAllocator) HeaderChecksum() bool {
+	return pageAllocator.headerChecksum
+}
+
+// pageChecksum calculates the checksum of a page with the given header and data
+func (pageAllocator *PageAllocator) pageChecksum(header PageHeader, data PageData) uint32 {
+	return pageAllocator.scheme().pageChecksum(header, data)
+}
+
+// updateChecksum recomputes a page's checksum from what is on disk.
+// Header fields must be written before calling it
+func (pageAllocator *PageAllocator) updateChecksum(id uint64) error {
+	header, err := pageAllocator.ReadPageHeader(id)
+	if err != nil {
+		return err
+	}
+	data, err := pageAllocator.readPageDataWithoutVerify(id)
+	if err != nil {
+		return err
+	}
+	return pageAllocator.WritePageHeader(id, PageHeaderChecksumOffset, pageAllocator.pageChecksum(header, data))
+}
+
+// RawPage returns a copy of the full on-disk bytes of a page including its
+// header, without verifying the checksum so it also works on corrupt pages
+func (pageAllocator *PageAllocator) RawPage(id uint64) ([]byte, error) {
+	count, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return nil, err
+	}
+	if id >= count {
+		return nil, fmt.Errorf("page %d does not exist, database has %d pages", id, count)
+	}
+	data := make([]byte, pageAllocator.PageSize)
+	_, err = pageAllocator.Database.ReadAt(data, int64(id)*pageAllocator.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DuplicatePages groups live pages by the checksum in their header and
+// returns the groups with more than one page, such as many empty pages
+func (pageAllocator *PageAllocator) DuplicatePages() (map[uint32][]uint64, error) {
+	count, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[uint32][]uint64)
+	for id := uint64(1); id < count; id++ {
+		header, err := pageAllocator.ReadPageHeader(id)
+		if err != nil {
+			return nil, err
+		}
+		if header.PageType == PagetypeFreepage {
+			continue
+		}
+		groups[header.Checksum] = append(groups[header.Checksum], id)
+	}
+	for checksum, ids := range groups {
+		if len(ids) < 2 {
+			delete(groups, checksum)
+		}
+	}
+	return groups, nil
+}
+
 // ReadPageHeader reads the header information for a page
 func (pageAllocator *PageAllocator) ReadPageHeader(id uint64) (PageHeader, error) {
 	data := make([]byte, PageHeaderSize)
@@ -206,13 +766,17 @@ func (pageAllocator *PageAllocator) ReadPageHeader(id uint64) (PageHeader, error
 	return response, err
 }
 
-// WritePageHeader writes a value to a specific offset in a page's header
+// WritePageHeader writes a value to a specific offset in a page's header.
+// Writing the version or type recomputes the checksum if it covers the header
 func (pageAllocator *PageAllocator) WritePageHeader(id uint64, offset int64, header any) error {
 	switch header.(type) {
 	case byte:
 		data, _ := header.(byte)
 		_, err := pageAllocator.Database.WriteAt([]byte{data}, int64(id)*pageAllocator.PageSize+offset)
-		return err
+		if err != nil || !pageAllocator.headerChecksum {
+			return err
+		}
+		return pageAllocator.updateChecksum(id)
 	case uint32:
 		data, _ := header.(uint32)
 		dataBytes := make([]byte, 0, 4)
@@ -224,36 +788,54 @@ func (pageAllocator *PageAllocator) WritePageHeader(id uint64, offset int64, hea
 	}
 }
 
+// makePageData creates an empty page data buffer for this database's page size
+func (pageAllocator *PageAllocator) makePageData() PageData {
+	return MakePageDataSize(pageAllocator.PageSize)
+}
+
 // WritePageData writes data to a page, starting after the page header
 func (pageAllocator *PageAllocator) WritePageData(id uint64, data PageData) error {
-	_, err := pageAllocator.Database.WriteAt(data[:], int64(id)*pageAllocator.PageSize+PageHeaderSize)
+	if int64(len(data)) != pageAllocator.PageSize-PageHeaderSize {
+		return fmt.Errorf("page data is %d bytes but pages hold %d", len(data), pageAllocator.PageSize-PageHeaderSize)
+	}
+	encoded, err := pageAllocator.encodePage(id, data)
+	if err != nil {
+		return err
+	}
+	_, err = pageAllocator.Database.WriteAt(encoded, int64(id)*pageAllocator.PageSize+PageHeaderSize)
 	if err != nil {
 		return err
 	}
-	// Update page checksum
-	return pageAllocator.WritePageHeader(id, PageHeaderChecksumOffset, getChecksum(data))
+	// Update page checksum, computed over the data before the write hooks
+	header, err := pageAllocator.ReadPageHeader(id)
+	if err != nil {
+		return err
+	}
+	return pageAllocator.WritePageHeader(id, PageHeaderChecksumOffset, pageAllocator.pageChecksum(header, data))
 }
 
 // readPageDataWithoutVerify reads page data without validating its checksum.
 // This is used internally when we need to read data to calculate a new checksum.
 func (pageAllocator *PageAllocator) readPageDataWithoutVerify(id uint64) (PageData, error) {
-	data := MakePageData()
+	data := pageAllocator.makePageData()
 	_, err := pageAllocator.Database.ReadAt(data[:], int64(id)*pageAllocator.PageSize+PageHeaderSize)
-	return data, err
+	if err != nil {
+		return data, err
+	}
+	return pageAllocator.decodePage(id, data)
 }
 
 // ReadPageData reads page data and verifies its integrity using the checksum.
 // Returns an error if the checksum doesn't match, indicating data corruption.
 func (pageAllocator *PageAllocator) ReadPageData(id uint64) (PageData, error) {
-	data := MakePageData()
-	_, err := pageAllocator.Database.ReadAt(data[:], int64(id)*pageAllocator.PageSize+PageHeaderSize)
+	data, err := pageAllocator.readPageDataWithoutVerify(id)
 	if err != nil {
 		return data, err
 	}
 	header, err := pageAllocator.ReadPageHeader(id)
-	checksum := getChecksum(data)
+	checksum := pageAllocator.pageChecksum(header, data)
 	if header.Checksum != checksum {
-		return data, fmt.Errorf("Checksum Mismatch %d against %d", header.Checksum, checksum)
+		return data, fmt.Errorf("%w %d against %d", ErrChecksumMismatch, header.Checksum, checksum)
 	}
 	return data, err
 }
@@ -276,7 +858,7 @@ func (pageAllocator *PageAllocator) VerifyDatabase() (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		if getChecksum(data) != header.Checksum {
+		if pageAllocator.pageChecksum(header, data) != header.Checksum {
 			return false, nil
 		}
 	}
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"os"
+	"reflect"
+	"slices"
 	"testing"
 )
 
@@ -10,7 +14,7 @@ func newAllocator(t *testing.T) *PageAllocator {
 	os.Remove("test.db")
 
 	pageAllocator := &PageAllocator{}
-	err := pageAllocator.Initialize("test.db")
+	err := pageAllocator.Initialize("test.db", 0)
 	if err != nil {
 		t.Fatal("Failed to initialize page allocator:", err)
 	}
@@ -126,3 +130,956 @@ func TestMetadata(t *testing.T) {
 	}
 
 }
+
+func TestMaxFileSize(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	// room for the metadata page and three more
+	pageAllocator.SetMaxFileSize(4 * pageAllocator.PageSize)
+
+	pageIDs := []uint64{}
+	for i := 0; i < 3; i++ {
+		pageID, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	_, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if !errors.Is(err, ErrDatabaseFull) {
+		t.Fatal("Expected ErrDatabaseFull when extending past the cap, got", err)
+	}
+
+	// reuse from the free list still works at the cap
+	err = pageAllocator.FreePage(pageIDs[1])
+	if err != nil {
+		t.Fatal("Failed to free page", pageIDs[1], ":", err)
+	}
+	newPage, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to reuse a freed page at the cap:", err)
+	}
+	if newPage != pageIDs[1] {
+		t.Error("Expected reuse of page", pageIDs[1], "but got", newPage)
+	}
+
+	_, err = pageAllocator.AllocatePage(PagetypeUserdata)
+	if !errors.Is(err, ErrDatabaseFull) {
+		t.Fatal("Expected ErrDatabaseFull after reusing the free page, got", err)
+	}
+
+	size, err := pageAllocator.Database.Size()
+	if err != nil {
+		t.Fatal("Failed to stat database :", err)
+	}
+	if size > 4*pageAllocator.PageSize {
+		t.Error("Database grew past the cap to", size)
+	}
+}
+
+func TestDoubleFree(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to allocate page:", err)
+	}
+	other, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to allocate page:", err)
+	}
+
+	err = pageAllocator.FreePage(id)
+	if err != nil {
+		t.Fatal("Failed to free page", id, ":", err)
+	}
+	err = pageAllocator.FreePage(id)
+	if !errors.Is(err, ErrDoubleFree) {
+		t.Fatal("Expected ErrDoubleFree on second free, got", err)
+	}
+
+	// the free list holds the page once, so the next allocations differ
+	first, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to allocate page:", err)
+	}
+	second, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to allocate page:", err)
+	}
+	if first != id || second == id || second == other {
+		t.Error("Free list corrupted, allocated", first, "and", second)
+	}
+
+	// the metadata page and pages past the end are never linked in
+	err = pageAllocator.FreePage(0)
+	if err == nil {
+		t.Error("Expected error freeing the metadata page")
+	}
+	err = pageAllocator.FreePage(second + 1)
+	if err == nil {
+		t.Error("Expected error freeing a page past the end of the file")
+	}
+	free, err := pageAllocator.FreePageCount()
+	if err != nil || free != 0 {
+		t.Error("Expected an empty free list, got", free, err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	const PageCount = 5
+	pageAllocator := &PageAllocator{}
+	err := pageAllocator.InitializeStorage(&MemoryStorage{}, 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	defer pageAllocator.CloseFile()
+
+	// Allocate a few pages
+	pageIDs := []uint64{}
+	for i := 0; i < PageCount; i++ {
+		pageID, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	// Write random data to pages
+	pageData := make(map[uint64]PageData)
+	for _, id := range pageIDs {
+		data := MakePageData()
+		rand.Read(data[:])
+
+		err := pageAllocator.WritePageData(id, data)
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+		pageData[id] = data
+	}
+
+	// Free and reuse a page
+	err = pageAllocator.FreePage(pageIDs[2])
+	if err != nil {
+		t.Fatal("Failed to free page", pageIDs[2], ":", err)
+	}
+	newPage, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil || newPage != pageIDs[2] {
+		t.Fatal("Expected reuse of page", pageIDs[2], "but got", newPage, err)
+	}
+
+	// Read back and verify the data
+	for _, id := range pageIDs {
+		if id == pageIDs[2] {
+			continue
+		}
+		readData, err := pageAllocator.ReadPageData(id)
+		if err != nil {
+			t.Fatal("Read failed for page", id, ":", err)
+		}
+
+		if string(readData[:]) != string(pageData[id][:]) {
+			t.Error("Data mismatch for page", id)
+		}
+	}
+
+	size, err := pageAllocator.Database.Size()
+	if err != nil {
+		t.Fatal("Failed to get storage size :", err)
+	}
+	if size != (PageCount+1)*pageAllocator.PageSize {
+		t.Error("Unexpected storage size", size)
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Verification failed on memory storage :", err)
+	}
+}
+
+func TestRawPage(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	data := MakePageData()
+	rand.Read(data[:])
+	err = pageAllocator.WritePageData(id, data)
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	// corrupt the page so checksum verification would fail
+	_, err = pageAllocator.Database.WriteAt([]byte{^data[0]}, int64(id)*pageAllocator.PageSize+PageHeaderSize)
+	if err != nil {
+		t.Fatal("Failed to corrupt page :", err)
+	}
+
+	raw, err := pageAllocator.RawPage(id)
+	if err != nil {
+		t.Fatal("Failed to read raw page :", err)
+	}
+	expected := make([]byte, pageAllocator.PageSize)
+	_, err = pageAllocator.Database.ReadAt(expected, int64(id)*pageAllocator.PageSize)
+	if err != nil {
+		t.Fatal("Failed to read page region :", err)
+	}
+	if string(raw) != string(expected) {
+		t.Error("Raw page does not match the on-disk bytes")
+	}
+
+	// the result is a copy
+	raw[0] = ^raw[0]
+	again, err := pageAllocator.RawPage(id)
+	if err != nil {
+		t.Fatal("Failed to read raw page :", err)
+	}
+	if again[0] != expected[0] {
+		t.Error("Modifying the returned bytes changed the page")
+	}
+
+	_, err = pageAllocator.RawPage(id + 1)
+	if err == nil {
+		t.Error("Expected error reading a page past the end of the database")
+	}
+}
+
+func TestAllocateSpecific(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	err := pageAllocator.AllocateSpecific(5, PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to allocate page 5 :", err)
+	}
+
+	// pages before it are free filled
+	for id := uint64(1); id < 5; id++ {
+		header, err := pageAllocator.ReadPageHeader(id)
+		if err != nil {
+			t.Fatal("Failed to read header of page", id, ":", err)
+		}
+		if header.PageType != PagetypeFreepage {
+			t.Error("Expected page", id, "to be free, got type", header.PageType)
+		}
+	}
+	count, err := pageAllocator.FreePageCount()
+	if err != nil || count != 4 {
+		t.Fatal("Expected 4 free pages, got", count, err)
+	}
+
+	// page 5 is usable
+	data := MakePageData()
+	rand.Read(data[:])
+	err = pageAllocator.WritePageData(5, data)
+	if err != nil {
+		t.Fatal("Write failed for page 5 :", err)
+	}
+	readData, err := pageAllocator.ReadPageData(5)
+	if err != nil || string(readData[:]) != string(data[:]) {
+		t.Error("Failed to read back page 5 :", err)
+	}
+
+	err = pageAllocator.AllocateSpecific(5, PagetypeUserdata)
+	if err == nil {
+		t.Error("Expected error allocating a live page")
+	}
+
+	// a free page in the middle of the list can be claimed
+	err = pageAllocator.AllocateSpecific(3, PagetypeTableData)
+	if err != nil {
+		t.Fatal("Failed to allocate page 3 :", err)
+	}
+	header, err := pageAllocator.ReadPageHeader(3)
+	if err != nil || header.PageType != PagetypeTableData {
+		t.Error("Expected page 3 to be table data, got", header.PageType, err)
+	}
+	count, err = pageAllocator.FreePageCount()
+	if err != nil || count != 3 {
+		t.Fatal("Expected 3 free pages, got", count, err)
+	}
+
+	// the remaining free pages are handed out without reusing 3 or 5
+	for range 3 {
+		id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		if id == 3 || id == 5 || id > 5 {
+			t.Error("Expected a page from the free list, got", id)
+		}
+	}
+
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Database failed verification :", err)
+	}
+}
+
+func TestMetaFields(t *testing.T) {
+	pageAllocator := newAllocator(t)
+
+	// named fields alias the fixed offsets
+	_, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Failed to allocate page:", err)
+	}
+	total, err := pageAllocator.ReadMetaField(MetaTotalPages)
+	if err != nil || total != 2 {
+		t.Error("Expected 2 total pages, got", total, err)
+	}
+	pageSize, err := pageAllocator.ReadMetaField(MetaPageSize)
+	if err != nil || pageSize != uint64(pageAllocator.PageSize) {
+		t.Error("Expected page size", pageAllocator.PageSize, "got", pageSize, err)
+	}
+
+	fields := map[MetaField]uint64{
+		MetaDirectoryHead: 7,
+		MetaBackupLSN:     1 << 40,
+		MetaExtension + 3: 42,
+	}
+	for key, value := range fields {
+		err = pageAllocator.WriteMetaField(key, value)
+		if err != nil {
+			t.Fatal("Failed to write field", key, ":", err)
+		}
+	}
+	pageAllocator.CloseFile()
+
+	// fields persist and the metadata page still verifies
+	pageAllocator = &PageAllocator{}
+	err = pageAllocator.Initialize("test.db", 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	defer pageAllocator.CloseFile()
+	for key, value := range fields {
+		read, err := pageAllocator.ReadMetaField(key)
+		if err != nil {
+			t.Fatal("Failed to read field", key, ":", err)
+		}
+		if read != value {
+			t.Error("Field", key, "expected", value, "but got", read)
+		}
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Database failed verification :", err)
+	}
+
+	_, err = pageAllocator.ReadMetaField(MetaFieldSlots)
+	if err == nil {
+		t.Error("Expected error reading a field past the reserved slots")
+	}
+	err = pageAllocator.WriteMetaField(-1, 0)
+	if err == nil {
+		t.Error("Expected error writing a negative field")
+	}
+}
+
+func TestDuplicatePages(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	shared := MakePageData()
+	rand.Read(shared[:])
+	duplicates := []uint64{}
+	unique := []uint64{}
+	for i := 0; i < 6; i++ {
+		id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		data := shared
+		if i%2 == 1 {
+			data = MakePageData()
+			rand.Read(data[:])
+			unique = append(unique, id)
+		} else {
+			duplicates = append(duplicates, id)
+		}
+		err = pageAllocator.WritePageData(id, data)
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+	// a freed copy is not live
+	err := pageAllocator.FreePage(duplicates[2])
+	if err != nil {
+		t.Fatal("Failed to free page :", err)
+	}
+	duplicates = duplicates[:2]
+
+	groups, err := pageAllocator.DuplicatePages()
+	if err != nil {
+		t.Fatal("Failed to find duplicates :", err)
+	}
+	if len(groups) != 1 {
+		t.Fatal("Expected 1 group of duplicates, got", groups)
+	}
+	ids := groups[pageAllocator.pageChecksum(PageHeader{PageType: PagetypeUserdata}, shared)]
+	if !reflect.DeepEqual(ids, duplicates) {
+		t.Error("Expected duplicates", duplicates, "but got", ids)
+	}
+	for _, group := range groups {
+		for _, id := range group {
+			for _, uniqueId := range unique {
+				if id == uniqueId {
+					t.Error("Unique page", id, "grouped as a duplicate")
+				}
+			}
+		}
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	os.Remove("test.db")
+	const PageSize = 8192
+	pageAllocator := &PageAllocator{}
+	err := pageAllocator.Initialize("test.db", PageSize)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	data := MakePageDataSize(PageSize)
+	rand.Read(data)
+	err = pageAllocator.WritePageData(id, data)
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	err = pageAllocator.WritePageData(id, MakePageData())
+	if err == nil {
+		t.Error("Expected error writing data sized for another page size")
+	}
+	pageAllocator.CloseFile()
+
+	// the stored page size wins over the one passed on reopen
+	pageAllocator = &PageAllocator{}
+	err = pageAllocator.Initialize("test.db", 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	defer pageAllocator.CloseFile()
+	if pageAllocator.PageSize != PageSize {
+		t.Fatal("Expected page size", PageSize, "after reopening, got", pageAllocator.PageSize)
+	}
+	readData, err := pageAllocator.ReadPageData(id)
+	if err != nil {
+		t.Fatal("Read failed for page", id, ":", err)
+	}
+	if string(readData) != string(data) {
+		t.Error("Data mismatch for page", id)
+	}
+	info, err := os.Stat("test.db")
+	if err != nil || info.Size() != 2*PageSize {
+		t.Error("Expected a file of 2 pages of", PageSize, "bytes, got", info.Size(), err)
+	}
+
+	err = (&PageAllocator{}).InitializeStorage(&MemoryStorage{}, MinPageSize-1)
+	if err == nil {
+		t.Error("Expected error for a page size below the minimum")
+	}
+}
+
+func TestHeaderChecksum(t *testing.T) {
+	pageAllocator := newAllocator(t)
+
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	data := MakePageData()
+	rand.Read(data)
+	err = pageAllocator.WritePageData(id, data)
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	// without header coverage a flipped type byte goes unnoticed
+	err = pageAllocator.SetHeaderChecksum(false)
+	if err != nil {
+		t.Fatal("Failed to disable header checksums:", err)
+	}
+	_, err = pageAllocator.Database.WriteAt([]byte{PagetypeTableData}, int64(id)*pageAllocator.PageSize+PageHeaderTypeOffset)
+	if err != nil {
+		t.Fatal("Failed to corrupt page header:", err)
+	}
+	_, err = pageAllocator.ReadPageData(id)
+	if err != nil {
+		t.Fatal("Expected the data checksum to ignore the header:", err)
+	}
+
+	err = pageAllocator.SetHeaderChecksum(true)
+	if err != nil {
+		t.Fatal("Failed to enable header checksums:", err)
+	}
+	// changing the type through the allocator keeps the checksum valid
+	err = pageAllocator.WritePageHeader(id, PageHeaderTypeOffset, byte(PagetypeUserdata))
+	if err != nil {
+		t.Fatal("Failed to write page header:", err)
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Fatal("Expected database to verify after enabling header checksums:", err)
+	}
+	pageAllocator.CloseFile()
+
+	// the flag is kept on reopen
+	pageAllocator = &PageAllocator{}
+	err = pageAllocator.Initialize("test.db", 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	defer pageAllocator.CloseFile()
+	if !pageAllocator.HeaderChecksum() {
+		t.Fatal("Expected header checksums to stay enabled after reopening")
+	}
+	readData, err := pageAllocator.ReadPageData(id)
+	if err != nil || string(readData) != string(data) {
+		t.Fatal("Failed to read page", id, "after reopening:", err)
+	}
+
+	// corrupt the type byte behind the allocator's back
+	_, err = pageAllocator.Database.WriteAt([]byte{PagetypeTableData}, int64(id)*pageAllocator.PageSize+PageHeaderTypeOffset)
+	if err != nil {
+		t.Fatal("Failed to corrupt page header:", err)
+	}
+	_, err = pageAllocator.ReadPageData(id)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("Expected checksum mismatch for a corrupt type byte, got", err)
+	}
+	ok, err = pageAllocator.VerifyDatabase()
+	if err != nil || ok {
+		t.Error("Expected verification to fail for a corrupt type byte:", err)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	pageIds := []uint64{}
+	for range 10 {
+		id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	// free a page in the middle too, so the tail pages sit around it in the free list
+	freed := []uint64{pageIds[9], pageIds[2], pageIds[7], pageIds[8], pageIds[6]}
+	for _, id := range freed {
+		err := pageAllocator.FreePage(id)
+		if err != nil {
+			t.Fatal("Failed to free page", id, ":", err)
+		}
+	}
+	before, err := pageAllocator.Database.Size()
+	if err != nil {
+		t.Fatal("Failed to read file size:", err)
+	}
+
+	reclaimed, err := pageAllocator.Shrink()
+	if err != nil {
+		t.Fatal("Failed to shrink database:", err)
+	}
+	after, err := pageAllocator.Database.Size()
+	if err != nil {
+		t.Fatal("Failed to read file size:", err)
+	}
+	if reclaimed != 4*pageAllocator.PageSize || after != before-reclaimed {
+		t.Fatal("Expected file to shrink by 4 pages, shrank from", before, "to", after, "reporting", reclaimed)
+	}
+
+	// the high-water mark still names the last page before the shrink
+	mark, err := pageAllocator.ReadMetaField(MetaHighWaterMark)
+	if err != nil || mark != pageIds[9] {
+		t.Fatal("Expected high-water mark", pageIds[9], "after shrinking, got", mark, err)
+	}
+
+	// only the page in the middle is left on the free list
+	count, err := pageAllocator.FreePageCount()
+	if err != nil || count != 1 {
+		t.Fatal("Expected 1 free page after shrinking, got", count, err)
+	}
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil || id != pageIds[2] {
+		t.Error("Expected page", pageIds[2], "to be reused, got", id, err)
+	}
+	id, err = pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil || id != pageIds[6] {
+		t.Error("Expected the file to grow from page", pageIds[6], "got", id, err)
+	}
+	mark, err = pageAllocator.ReadMetaField(MetaHighWaterMark)
+	if err != nil || mark != pageIds[9] {
+		t.Error("Expected high-water mark to stay at", pageIds[9], "got", mark, err)
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Expected database to verify after shrinking:", err)
+	}
+
+	reclaimed, err = pageAllocator.Shrink()
+	if err != nil || reclaimed != 0 {
+		t.Error("Expected nothing to reclaim without trailing free pages, got", reclaimed, err)
+	}
+}
+
+// crashingStorage fails every write after the first writesLeft, as if the
+// process died at that point
+type crashingStorage struct {
+	Storage
+	writesLeft int
+}
+
+func (crashingStorage *crashingStorage) WriteAt(data []byte, offset int64) (int, error) {
+	if crashingStorage.writesLeft == 0 {
+		return 0, errors.New("crashed")
+	}
+	crashingStorage.writesLeft--
+	return crashingStorage.Storage.WriteAt(data, offset)
+}
+
+func TestCreateCrash(t *testing.T) {
+	for writes := range 4 {
+		storage := &MemoryStorage{}
+		pageAllocator := &PageAllocator{}
+		pageAllocator.InitializeStorage(&crashingStorage{storage, writes}, 0)
+
+		// whatever made it to storage is either nothing or a complete metadata page
+		size, _ := storage.Size()
+		if size == 0 {
+			continue
+		}
+		pageAllocator = &PageAllocator{}
+		err := pageAllocator.InitializeStorage(storage, 0)
+		if err != nil {
+			t.Fatal("Failed to reopen after crashing at write", writes, ":", err)
+		}
+		ok, err := pageAllocator.VerifyDatabase()
+		if err != nil || !ok {
+			t.Error("Expected a valid metadata page after crashing at write", writes, err)
+		}
+		total, err := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+		if err != nil || total != 1 || pageAllocator.PageSize != DefaultPageSize {
+			t.Error("Expected metadata fields set after crashing at write", writes, "got", total, "pages of", pageAllocator.PageSize)
+		}
+	}
+}
+
+// newChecksumStorage creates an in-memory database with a few written pages
+func newChecksumStorage(t *testing.T) *MemoryStorage {
+	storage := &MemoryStorage{}
+	pageAllocator := &PageAllocator{}
+	err := pageAllocator.InitializeStorage(storage, 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	for range 4 {
+		id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		data := MakePageData()
+		rand.Read(data)
+		err = pageAllocator.WritePageData(id, data)
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+	return storage
+}
+
+func TestChecksumAlgorithmCrash(t *testing.T) {
+	for writes := 0; ; writes++ {
+		storage := newChecksumStorage(t)
+		pageAllocator := &PageAllocator{}
+		err := pageAllocator.InitializeStorage(storage, 0)
+		if err != nil {
+			t.Fatal("Failed to initialize page allocator:", err)
+		}
+		pageAllocator.Database = &crashingStorage{storage, writes}
+		switchErr := pageAllocator.SetChecksumAlgorithm(ChecksumCRC32C)
+
+		// reopening finishes a switch that was recorded, or finds none
+		pageAllocator = &PageAllocator{}
+		err = pageAllocator.InitializeStorage(storage, 0)
+		if err != nil {
+			t.Fatal("Failed to reopen after crashing at write", writes, ":", err)
+		}
+		ok, err := pageAllocator.VerifyDatabase()
+		if err != nil || !ok {
+			t.Fatal("Expected every page to verify after crashing at write", writes, err)
+		}
+		pending, err := pageAllocator.ReadMetaField(MetaChecksumSwitch)
+		if err != nil || pending != 0 {
+			t.Fatal("Expected no switch pending after reopening, got", pending, err)
+		}
+		if writes == 0 && pageAllocator.ChecksumAlgorithm() != ChecksumCRC32 {
+			t.Fatal("Expected a switch that recorded nothing to keep CRC32")
+		}
+		if switchErr == nil {
+			if pageAllocator.ChecksumAlgorithm() != ChecksumCRC32C {
+				t.Fatal("Expected CRC32C after a finished switch")
+			}
+			break
+		}
+	}
+}
+
+func TestChecksumAlgorithmCorruptPage(t *testing.T) {
+	storage := newChecksumStorage(t)
+	pageAllocator := &PageAllocator{}
+	err := pageAllocator.InitializeStorage(storage, 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	_, err = storage.WriteAt([]byte{0xFF}, 3*pageAllocator.PageSize+PageHeaderSize+10)
+	if err != nil {
+		t.Fatal("Failed to corrupt page:", err)
+	}
+
+	// the corrupt page must not be given a valid checksum under CRC32C
+	err = pageAllocator.SetChecksumAlgorithm(ChecksumCRC32C)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("Expected a checksum mismatch switching with a corrupt page, got", err)
+	}
+	if pageAllocator.ChecksumAlgorithm() != ChecksumCRC32 {
+		t.Error("Expected the algorithm to stay CRC32 after a failed switch")
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || ok {
+		t.Error("Expected the corrupt page to still fail verification:", err)
+	}
+	pageAllocator = &PageAllocator{}
+	err = pageAllocator.InitializeStorage(storage, 0)
+	if err != nil || pageAllocator.ChecksumAlgorithm() != ChecksumCRC32 {
+		t.Error("Expected to reopen with CRC32 after a failed switch:", err)
+	}
+}
+
+func TestHeaderChecksumCrash(t *testing.T) {
+	for writes := 0; ; writes++ {
+		storage := newChecksumStorage(t)
+		pageAllocator := &PageAllocator{}
+		err := pageAllocator.InitializeStorage(storage, 0)
+		if err != nil {
+			t.Fatal("Failed to initialize page allocator:", err)
+		}
+		pageAllocator.Database = &crashingStorage{storage, writes}
+		switchErr := pageAllocator.SetHeaderChecksum(false)
+
+		pageAllocator = &PageAllocator{}
+		err = pageAllocator.InitializeStorage(storage, 0)
+		if err != nil {
+			t.Fatal("Failed to reopen after crashing at write", writes, ":", err)
+		}
+		ok, err := pageAllocator.VerifyDatabase()
+		if err != nil || !ok {
+			t.Fatal("Expected every page to verify after crashing at write", writes, err)
+		}
+		if writes == 0 && !pageAllocator.HeaderChecksum() {
+			t.Fatal("Expected a switch that recorded nothing to keep header checksums")
+		}
+		if switchErr == nil {
+			if pageAllocator.HeaderChecksum() {
+				t.Fatal("Expected header checksums off after a finished switch")
+			}
+			break
+		}
+	}
+
+	// a corrupt page fails the switch instead of getting a valid checksum
+	storage := newChecksumStorage(t)
+	pageAllocator := &PageAllocator{}
+	err := pageAllocator.InitializeStorage(storage, 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	_, err = storage.WriteAt([]byte{PagetypeTableData}, 2*pageAllocator.PageSize+PageHeaderTypeOffset)
+	if err != nil {
+		t.Fatal("Failed to corrupt page header:", err)
+	}
+	err = pageAllocator.SetHeaderChecksum(false)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("Expected a checksum mismatch switching with a corrupt header, got", err)
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || ok || !pageAllocator.HeaderChecksum() {
+		t.Error("Expected the corrupt header to still fail verification:", err)
+	}
+}
+
+func TestHeaderChecksumDefault(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+	if !pageAllocator.HeaderChecksum() {
+		t.Fatal("Expected new databases to checksum page headers")
+	}
+
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Fatal("Expected a new database to verify:", err)
+	}
+	_, err = pageAllocator.Database.WriteAt([]byte{PagetypeTableData}, int64(id)*pageAllocator.PageSize+PageHeaderTypeOffset)
+	if err != nil {
+		t.Fatal("Failed to corrupt page header:", err)
+	}
+	ok, err = pageAllocator.VerifyDatabase()
+	if err != nil || ok {
+		t.Error("Expected verification to fail for a flipped type byte:", err)
+	}
+}
+
+func TestPageHooks(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	identityCalls := 0
+	identity := func(id uint64, data []byte) ([]byte, error) {
+		identityCalls++
+		return data, nil
+	}
+	reverse := func(id uint64, data []byte) ([]byte, error) {
+		response := slices.Clone(data)
+		slices.Reverse(response)
+		return response, nil
+	}
+	pageAllocator.AddPageWriteHook(identity)
+	pageAllocator.AddPageWriteHook(reverse)
+	pageAllocator.AddPageReadHook(identity)
+	pageAllocator.AddPageReadHook(reverse)
+
+	id, err := pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	data := MakePageData()
+	rand.Read(data)
+	err = pageAllocator.WritePageData(id, data)
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+
+	// storage holds the transformed bytes, reads undo the transform
+	raw, err := pageAllocator.RawPage(id)
+	if err != nil {
+		t.Fatal("Failed to read raw page:", err)
+	}
+	reversed, _ := reverse(id, data)
+	if !bytes.Equal(raw[PageHeaderSize:], reversed) {
+		t.Error("Expected the write hooks to reverse the stored page")
+	}
+	readData, err := pageAllocator.ReadPageData(id)
+	if err != nil || !bytes.Equal(readData, data) {
+		t.Fatal("Failed to read back page", id, "through the hooks:", err)
+	}
+	if identityCalls == 0 {
+		t.Error("Expected the identity hook to be called")
+	}
+	err = pageAllocator.FreePage(id)
+	if err != nil {
+		t.Fatal("Failed to free page:", err)
+	}
+	ok, err := pageAllocator.VerifyDatabase()
+	if err != nil || !ok {
+		t.Error("Expected database to verify with hooks:", err)
+	}
+	pageAllocator.CloseFile()
+
+	// the checksum covers the data before the write hooks, so reading
+	// without the hooks is caught
+	pageAllocator = &PageAllocator{}
+	err = pageAllocator.Initialize("test.db", 0)
+	if err != nil {
+		t.Fatal("Failed to initialize page allocator:", err)
+	}
+	defer pageAllocator.CloseFile()
+	id, err = pageAllocator.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	pageAllocator.AddPageWriteHook(reverse)
+	err = pageAllocator.WritePageData(id, data)
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	_, err = pageAllocator.ReadPageData(id)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Error("Expected checksum mismatch reading without the read hook, got", err)
+	}
+
+	pageAllocator.AddPageWriteHook(func(id uint64, data []byte) ([]byte, error) {
+		return data[1:], nil
+	})
+	err = pageAllocator.WritePageData(id, data)
+	if err == nil {
+		t.Error("Expected error for a hook changing the page length")
+	}
+}
+
+func TestAllocatePageBatch(t *testing.T) {
+	pageAllocator := newAllocator(t)
+	defer pageAllocator.CloseFile()
+
+	for range 3 {
+		_, err := pageAllocator.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+	}
+	pageAllocator.FreePage(1)
+	pageAllocator.FreePage(3)
+
+	pageIds, err := pageAllocator.AllocatePageBatch(PagetypeTableData, 1000)
+	if err != nil {
+		t.Fatal("Batch allocation failed:", err)
+	}
+	if len(pageIds) != 1000 || !slices.Contains(pageIds, 1) || !slices.Contains(pageIds, 3) {
+		t.Fatal("Expected 1000 pages starting with the free ones, got", len(pageIds), pageIds[:2])
+	}
+	seen := map[uint64]bool{}
+	for _, id := range pageIds {
+		if seen[id] || id == 0 || id == 2 {
+			t.Fatal("Page", id, "was handed out twice or was already live")
+		}
+		seen[id] = true
+		header, err := pageAllocator.ReadPageHeader(id)
+		if err != nil || header.PageType != PagetypeTableData {
+			t.Fatal("Expected page", id, "to be table data, got", header.PageType, err)
+		}
+		_, err = pageAllocator.ReadPageData(id)
+		if err != nil {
+			t.Fatal("Failed to read page", id, ":", err)
+		}
+	}
+	total, _ := pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	free, _ := pageAllocator.FreePageCount()
+	if total != 1002 || free != 0 {
+		t.Error("Expected 1002 pages and none free, got", total, free)
+	}
+
+	// a batch past the cap takes nothing, freed pages stay on the free list
+	pageAllocator.FreePage(5)
+	pageAllocator.SetMaxFileSize(1003 * pageAllocator.PageSize)
+	_, err = pageAllocator.AllocatePageBatch(PagetypeUserdata, 3)
+	if !errors.Is(err, ErrDatabaseFull) {
+		t.Fatal("Expected ErrDatabaseFull, got", err)
+	}
+	total, _ = pageAllocator.ReadMetadata(MetadataTotalPageOffset)
+	free, _ = pageAllocator.FreePageCount()
+	if total != 1002 || free != 1 {
+		t.Error("Expected a failed batch to leave 1002 pages with 1 free, got", total, free)
+	}
+}
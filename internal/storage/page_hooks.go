@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+)
+
+// PageHook transforms the data of a page, excluding the header, on its way
+// to or from storage. It must return data of the same length
+type PageHook func(id uint64, data []byte) ([]byte, error)
+
+// AddPageWriteHook adds a hook applied to page data before it is written.
+// Write hooks run in the order they were added. Checksums are computed
+// before any write hook runs, so they always cover the page as the engine
+// sees it. The metadata page is never passed to hooks
+func (pageAllocator *PageAllocator) AddPageWriteHook(hook PageHook) {
+	pageAllocator.writeHooks = append(pageAllocator.writeHooks, hook)
+}
+
+// AddPageReadHook adds a hook applied to page data after it is read, before
+// its checksum is verified. Read hooks run in the reverse of the order they
+// were added, so hooks added together with their write hooks undo them.
+// Free pages hold the free list link as written, without the write hooks,
+// so read hooks must accept any bytes
+func (pageAllocator *PageAllocator) AddPageReadHook(hook PageHook) {
+	pageAllocator.readHooks = append(pageAllocator.readHooks, hook)
+}
+
+// encodePage runs the write hooks over a copy of the page data
+func (pageAllocator *PageAllocator) encodePage(id uint64, data PageData) (PageData, error) {
+	if id == 0 || len(pageAllocator.writeHooks) == 0 {
+		return data, nil
+	}
+	response := slices.Clone(data)
+	for _, hook := range pageAllocator.writeHooks {
+		encoded, err := hook(id, response)
+		if err != nil {
+			return nil, err
+		}
+		if len(encoded) != len(data) {
+			return nil, fmt.Errorf("write hook returned %d bytes for page %d of %d", len(encoded), id, len(data))
+		}
+		response = encoded
+	}
+	return response, nil
+}
+
+// decodePage runs the read hooks over page data read from storage
+func (pageAllocator *PageAllocator) decodePage(id uint64, data PageData) (PageData, error) {
+	if id == 0 {
+		return data, nil
+	}
+	for i := len(pageAllocator.readHooks) - 1; i >= 0; i-- {
+		decoded, err := pageAllocator.readHooks[i](id, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) != len(data) {
+			return nil, fmt.Errorf("read hook returned %d bytes for page %d of %d", len(decoded), id, len(data))
+		}
+		data = decoded
+	}
+	return data, nil
+}
+
+// AddPageWriteHook adds a hook applied to page data before it is written,
+// see PageAllocator.AddPageWriteHook
+func (DatabaseManager *DatabaseManager) AddPageWriteHook(hook PageHook) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.allocator.AddPageWriteHook(hook)
+}
+
+// AddPageReadHook adds a hook applied to page data after it is read,
+// see PageAllocator.AddPageReadHook
+func (DatabaseManager *DatabaseManager) AddPageReadHook(hook PageHook) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.allocator.AddPageReadHook(hook)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage is the positioned IO surface the page allocator uses for the
+// data file. Implementing it lets the database run on storage other than
+// a local file, such as object store range reads or a network block device.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error // Resize the storage to size bytes
+	Sync() error               // Flush written data to durable storage
+	Size() (int64, error)      // Current size in bytes
+	Close() error              // Release the storage
+}
+
+// fileStorage adapts an os.File to the Storage interface
+type fileStorage struct {
+	*os.File
+}
+
+// Size returns the size of the file from its metadata
+func (fileStorage fileStorage) Size() (int64, error) {
+	info, err := fileStorage.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// MemoryStorage is a Storage held entirely in memory.
+// It is useful for tests and for databases that don't need to persist.
+type MemoryStorage struct {
+	lock sync.Mutex
+	data []byte
+}
+
+// ReadAt reads from the buffer, returning io.EOF past its end like a file
+func (memoryStorage *MemoryStorage) ReadAt(data []byte, offset int64) (int, error) {
+	memoryStorage.lock.Lock()
+	defer memoryStorage.lock.Unlock()
+	if offset >= int64(len(memoryStorage.data)) {
+		return 0, io.EOF
+	}
+	n := copy(data, memoryStorage.data[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the buffer, growing it as needed
+func (memoryStorage *MemoryStorage) WriteAt(data []byte, offset int64) (int, error) {
+	memoryStorage.lock.Lock()
+	defer memoryStorage.lock.Unlock()
+	end := offset + int64(len(data))
+	if end > int64(len(memoryStorage.data)) {
+		memoryStorage.data = append(memoryStorage.data, make([]byte, end-int64(len(memoryStorage.data)))...)
+	}
+	return copy(memoryStorage.data[offset:], data), nil
+}
+
+// Truncate resizes the buffer, zero filling when it grows
+func (memoryStorage *MemoryStorage) Truncate(size int64) error {
+	memoryStorage.lock.Lock()
+	defer memoryStorage.lock.Unlock()
+	if size <= int64(len(memoryStorage.data)) {
+		memoryStorage.data = memoryStorage.data[:size]
+		return nil
+	}
+	memoryStorage.data = append(memoryStorage.data, make([]byte, size-int64(len(memoryStorage.data)))...)
+	return nil
+}
+
+// Sync is a no-op as the buffer is never persisted
+func (memoryStorage *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Size returns the length of the buffer
+func (memoryStorage *MemoryStorage) Size() (int64, error) {
+	memoryStorage.lock.Lock()
+	defer memoryStorage.lock.Unlock()
+	return int64(len(memoryStorage.data)), nil
+}
+
+// Close is a no-op, the buffer stays readable after closing
+func (memoryStorage *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPagePinned is returned when freeing a page that still holds a pin
+var ErrPagePinned = errors.New("page is pinned")
+
+// Pin loads a page into the cache and keeps it there until a matching
+// Unpin. Pinned pages are hidden from the cache policy, so they are never
+// evicted and the cache grows past its capacity if needed. Calls nest
+func (DatabaseManager *DatabaseManager) Pin(pageId uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	_, err := DatabaseManager.pin(pageId)
+	return err
+}
+
+// Unpin releases a pin taken by Pin. Once the last pin is released the page
+// can be evicted again, a cache over capacity shrinks on the next miss
+func (DatabaseManager *DatabaseManager) Unpin(pageId uint64) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if DatabaseManager.pinned[pageId] == 0 {
+		return fmt.Errorf("page %d is not pinned", pageId)
+	}
+	DatabaseManager.unpin(pageId)
+	return nil
+}
+
+// pin caches a page and takes a pin on it, returning the cached data
+func (DatabaseManager *DatabaseManager) pin(pageId uint64) (PageData, error) {
+	data, err := DatabaseManager.cachePage(pageId)
+	if err != nil {
+		return data, err
+	}
+	if DatabaseManager.pinned[pageId] == 0 {
+		DatabaseManager.policy.Remove(pageId)
+	}
+	DatabaseManager.pinned[pageId]++
+	return data, nil
+}
+
+// unpin releases a pin, handing the page back to the cache policy as
+// recently used once no pins are left
+func (DatabaseManager *DatabaseManager) unpin(pageId uint64) {
+	DatabaseManager.pinned[pageId]--
+	if DatabaseManager.pinned[pageId] > 0 {
+		return
+	}
+	delete(DatabaseManager.pinned, pageId)
+	if _, ok := DatabaseManager.database[pageId]; ok {
+		DatabaseManager.policy.Insert(pageId)
+	}
+}
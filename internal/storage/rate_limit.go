@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter paces page IO to a number of pages per second. Each page
+// reserves the next free slot, so a burst of reads or writes is spread out
+// instead of starving other users of the same storage
+type RateLimiter struct {
+	lock           sync.Mutex
+	pagesPerSecond float64
+	next           time.Time // Earliest time the next page may be transferred
+}
+
+// NewRateLimiter creates a limiter allowing pagesPerSecond pages of IO
+func NewRateLimiter(pagesPerSecond float64) *RateLimiter {
+	return &RateLimiter{pagesPerSecond: pagesPerSecond}
+}
+
+// Wait blocks until pages more pages may be transferred
+func (rateLimiter *RateLimiter) Wait(pages int) {
+	rateLimiter.lock.Lock()
+	now := time.Now()
+	start := now
+	if rateLimiter.next.After(now) {
+		start = rateLimiter.next
+	}
+	rateLimiter.next = start.Add(time.Duration(float64(pages) / rateLimiter.pagesPerSecond * float64(time.Second)))
+	rateLimiter.lock.Unlock()
+	time.Sleep(start.Sub(now))
+}
+
+// throttleUnlocked waits for the rate limiter, if one is set, with the
+// lock released so other operations aren't stalled by the wait.
+// It must be called with the lock held, the lock is held again on return
+func (DatabaseManager *DatabaseManager) throttleUnlocked(pages int) {
+	limiter := DatabaseManager.limiter
+	if limiter == nil {
+		return
+	}
+	DatabaseManager.lock.Unlock()
+	limiter.Wait(pages)
+	DatabaseManager.lock.Lock()
+}
@@ -0,0 +1,114 @@
+package storage
+
+import "fmt"
+
+// ReadTxn is a read transaction that sees the database as it was when it
+// began. Transactions committed after it began are ignored, giving
+// repeatable reads for long running scans.
+// Checkpoints are deferred while any read transaction is open, so read
+// transactions should be ended promptly.
+type ReadTxn struct {
+	manager  *DatabaseManager // Manager the transaction reads from
+	boundary uint64           // Transactions with a lower id are visible
+	ended    bool             // Set once End has been called
+	undo     bool             // Pages are rebuilt by undoing newer transactions
+}
+
+// BeginRead starts a read transaction pinned at the current end of the WAL
+func (DatabaseManager *DatabaseManager) BeginRead() *ReadTxn {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.activeReads++
+	return &ReadTxn{DatabaseManager, DatabaseManager.wal.nextTransactionId, false, false}
+}
+
+// BeginSnapshot starts a read transaction that sees the database as of the
+// transaction lsn. Pages are rebuilt from their current version by undoing
+// every later transaction with its old data, so every transaction after lsn
+// must still be in the WAL. Unlogged writes can't be undone and are visible
+func (DatabaseManager *DatabaseManager) BeginSnapshot(lsn uint64) (*ReadTxn, error) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if lsn != NoLSN && lsn >= DatabaseManager.wal.nextTransactionId {
+		return nil, fmt.Errorf("transaction %d has not been written yet", lsn)
+	}
+	_, err := DatabaseManager.wal.TransactionsSince(lsn)
+	if err != nil {
+		return nil, err
+	}
+	DatabaseManager.activeReads++
+	return &ReadTxn{DatabaseManager, lsn + 1, false, true}, nil
+}
+
+// GetPage returns a copy of the page as of the start of the read transaction
+func (ReadTxn *ReadTxn) GetPage(pageId uint64) (PageData, error) {
+	ReadTxn.manager.lock.Lock()
+	defer ReadTxn.manager.lock.Unlock()
+	ReadTxn.manager.throttleUnlocked(1)
+	if ReadTxn.ended {
+		return nil, fmt.Errorf("read transaction has already ended")
+	}
+	if ReadTxn.undo {
+		return ReadTxn.manager.undoPageTo(pageId, ReadTxn.boundary)
+	}
+	return ReadTxn.manager.loadPageAsOf(pageId, ReadTxn.boundary)
+}
+
+// End closes the read transaction and allows checkpoints to resume
+func (ReadTxn *ReadTxn) End() {
+	ReadTxn.manager.lock.Lock()
+	defer ReadTxn.manager.lock.Unlock()
+	if ReadTxn.ended {
+		return
+	}
+	ReadTxn.ended = true
+	ReadTxn.manager.activeReads--
+}
+
+// loadPageAsOf loads a page from disk and applies only the WAL changes
+// of transactions with an id lower than boundary
+func (DatabaseManager *DatabaseManager) loadPageAsOf(pageId uint64, boundary uint64) (PageData, error) {
+	data, err := DatabaseManager.readDiskPage(pageId)
+	if err != nil {
+		return data, err
+	}
+
+	for _, transaction := range DatabaseManager.wal.Cache[pageId] {
+		if transaction.Header.transactionId >= boundary {
+			continue
+		}
+		for _, body := range transaction.Body {
+			if body.PageId != pageId {
+				continue
+			}
+			copy(data[body.Offset:], body.NewData)
+		}
+	}
+
+	return data, nil
+}
+
+// undoPageTo copies the current version of a page and reverts the changes
+// of transactions with an id of boundary or higher, newest first
+func (DatabaseManager *DatabaseManager) undoPageTo(pageId uint64, boundary uint64) (PageData, error) {
+	current, err := DatabaseManager.cachePage(pageId)
+	if err != nil {
+		return current, err
+	}
+	data := append(PageData{}, current...)
+
+	transactions := DatabaseManager.wal.Cache[pageId]
+	for i := len(transactions) - 1; i >= 0; i-- {
+		transaction := transactions[i]
+		if transaction.Header.transactionId < boundary {
+			break
+		}
+		for j := len(transaction.Body) - 1; j >= 0; j-- {
+			body := transaction.Body[j]
+			if body.PageId == pageId {
+				copy(data[body.Offset:], body.OldData)
+			}
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import "time"
+
+// EngineStats summarizes write and checkpoint activity since startup.
+// It is intended for tuning the checkpoint threshold
+type EngineStats struct {
+	Transactions                 uint64        // Transactions committed to the WAL
+	Checkpoints                  uint64        // Checkpoints completed
+	AvgTransactionBytes          float64       // Average WAL bytes per transaction
+	AvgTransactionsPerCheckpoint float64       // Average transactions between checkpoints
+	AvgCheckpointDuration        time.Duration // Average time spent flushing a checkpoint
+}
+
+// engineCounters holds the raw counters EngineStats is derived from
+type engineCounters struct {
+	transactions             uint64        // transactions committed
+	transactionBytes         uint64        // WAL bytes written by committed transactions
+	intervalTransactions     uint64        // transactions since the last checkpoint
+	checkpointedTransactions uint64        // transactions covered by completed checkpoints
+	checkpoints              uint64        // checkpoints completed
+	checkpointDuration       time.Duration // total time spent in checkpoints
+	lastCheckpoint           time.Time     // start of the last completed checkpoint
+	cacheHits                uint64        // page lookups served from the cache
+	cacheMisses              uint64        // page lookups that went to disk
+	lastVerify               time.Time     // time of the last database verification
+	verifyPassed             bool          // result of the last database verification
+}
+
+// recordTransaction accounts for a transaction of the given WAL size
+func (counters *engineCounters) recordTransaction(bytes uint64) {
+	counters.transactions++
+	counters.transactionBytes += bytes
+	counters.intervalTransactions++
+}
+
+// recordCheckpoint accounts for a completed checkpoint and starts a new interval
+func (counters *engineCounters) recordCheckpoint(start time.Time, duration time.Duration) {
+	counters.checkpoints++
+	counters.lastCheckpoint = start
+	counters.checkpointDuration += duration
+	counters.checkpointedTransactions += counters.intervalTransactions
+	counters.intervalTransactions = 0
+}
+
+// recordCacheAccess accounts for a page lookup hitting or missing the cache
+func (counters *engineCounters) recordCacheAccess(hit bool) {
+	if hit {
+		counters.cacheHits++
+	} else {
+		counters.cacheMisses++
+	}
+}
+
+// EngineStats returns averages computed from the engine counters
+func (DatabaseManager *DatabaseManager) EngineStats() EngineStats {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	counters := DatabaseManager.stats
+	response := EngineStats{
+		Transactions: counters.transactions,
+		Checkpoints:  counters.checkpoints,
+	}
+	if counters.transactions > 0 {
+		response.AvgTransactionBytes = float64(counters.transactionBytes) / float64(counters.transactions)
+	}
+	if counters.checkpoints > 0 {
+		response.AvgTransactionsPerCheckpoint = float64(counters.checkpointedTransactions) / float64(counters.checkpoints)
+		response.AvgCheckpointDuration = counters.checkpointDuration / time.Duration(counters.checkpoints)
+	}
+	return response
+}
@@ -0,0 +1,78 @@
+package storage
+
+import "fmt"
+
+// Txn buffers page changes so several writes commit atomically as one WAL
+// transaction. Nothing reaches the cache or the WAL before Commit
+type Txn struct {
+	manager  *DatabaseManager // Manager the changes are committed to
+	changes  []PageDelta      // Buffered changes in the order they were written
+	freed    []uint64         // Pages freed once the changes are committed
+	finished bool             // Set once Commit or Abort has been called
+}
+
+// Begin starts a write transaction
+func (DatabaseManager *DatabaseManager) Begin() *Txn {
+	return &Txn{manager: DatabaseManager}
+}
+
+// Write buffers a change to a page region. The data is copied so the
+// caller may reuse its buffer. Bounds are checked on Commit
+func (Txn *Txn) Write(pageId uint64, offset uint32, data []byte) {
+	Txn.changes = append(Txn.changes, PageDelta{pageId, offset, append([]byte{}, data...)})
+}
+
+// Free buffers freeing a page, for changes that drop the last reference
+// to it. The page is freed right after the changes are logged
+func (Txn *Txn) Free(pageId uint64) {
+	Txn.freed = append(Txn.freed, pageId)
+}
+
+// Commit writes the buffered changes as a single WAL transaction, frees
+// the pages passed to Free and returns the transaction id, 0 if there are
+// only pages to free. Nothing is applied if any change is invalid or any
+// page can't be freed
+func (Txn *Txn) Commit() (uint64, error) {
+	if Txn.finished {
+		return 0, fmt.Errorf("transaction has already finished")
+	}
+	if len(Txn.changes) == 0 && len(Txn.freed) == 0 {
+		return 0, fmt.Errorf("transaction has no changes to commit")
+	}
+	Txn.finished = true
+	if len(Txn.freed) == 0 {
+		return Txn.manager.WritePages(Txn.changes)
+	}
+	return Txn.manager.commitLogged(func() (uint64, *walSync, error) {
+		return Txn.manager.writeAndFree(Txn.changes, Txn.freed)
+	})
+}
+
+// writeAndFree writes changes as one transaction and then frees pages,
+// checking that every page can be freed before anything is written.
+// Must be called with the lock held
+func (DatabaseManager *DatabaseManager) writeAndFree(changes []PageDelta, freed []uint64) (uint64, *walSync, error) {
+	err := DatabaseManager.checkFreeable(freed)
+	if err != nil {
+		return 0, nil, err
+	}
+	transactionId := uint64(0)
+	var synced *walSync
+	if len(changes) > 0 {
+		transactionId, synced, err = DatabaseManager.writePages(changes)
+		if err != nil {
+			return transactionId, synced, err
+		}
+	}
+	return transactionId, synced, DatabaseManager.freePages(freed)
+}
+
+// Abort discards the buffered changes
+func (Txn *Txn) Abort() error {
+	if Txn.finished {
+		return fmt.Errorf("transaction has already finished")
+	}
+	Txn.finished = true
+	Txn.changes = nil
+	return nil
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// VacuumHook lets a layer that stores page ids inside pages follow the
+// pages Vacuum moves. Both methods run with the manager locked and must
+// not call back into it
+type VacuumHook interface {
+	// RemapPage rewrites the page ids stored in the data of live page pageId
+	// as it is copied, remap maps every old live page id to its new id
+	RemapPage(pageId uint64, pageType byte, data PageData, remap map[uint64]uint64) error
+	// Remapped is called once the compacted file has replaced the old one
+	Remapped(remap map[uint64]uint64)
+}
+
+// SetVacuumHook registers the hook Vacuum calls for the pages it moves
+func (DatabaseManager *DatabaseManager) SetVacuumHook(hook VacuumHook) {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	DatabaseManager.vacuumHook = hook
+}
+
+// Vacuum rewrites the live pages into a fresh data file without free pages
+// and swaps it in place of the old file. Pages keep their relative order
+// and are numbered from 1 up. Overflow chains and the directory head are
+// remapped here, page ids stored by other layers through the vacuum hook.
+// The WAL is checkpointed first and the cache is emptied afterwards. Page
+// ids changed, so incremental backups have to start from a new full backup
+func (DatabaseManager *DatabaseManager) Vacuum() error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	if DatabaseManager.activeReads > 0 || DatabaseManager.checkpointing || DatabaseManager.maintenance > 0 || len(DatabaseManager.pinned) > 0 {
+		return fmt.Errorf("cannot vacuum during a read transaction, checkpoint, maintenance or with pinned pages")
+	}
+	file, ok := DatabaseManager.allocator.Database.(fileStorage)
+	if !ok {
+		return fmt.Errorf("vacuum needs a database stored in a file")
+	}
+	if DatabaseManager.wal.fileSize != 0 || len(DatabaseManager.unlogged) != 0 {
+		err := DatabaseManager.flushCheckpoint()
+		if err != nil {
+			return err
+		}
+	}
+
+	remap, order, err := DatabaseManager.vacuumRemap()
+	if err != nil {
+		return err
+	}
+	fileName := file.Name()
+	vacuumName := fileName + ".vacuum"
+	err = DatabaseManager.writeVacuumFile(vacuumName, remap, order)
+	if err != nil {
+		os.Remove(vacuumName)
+		return err
+	}
+
+	// the rename swaps the files atomically, a crash before it leaves the
+	// old file in place
+	err = DatabaseManager.allocator.CloseFile()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(vacuumName, fileName)
+	if err != nil {
+		os.Remove(vacuumName)
+		DatabaseManager.allocator.Initialize(fileName, 0)
+		return err
+	}
+	err = DatabaseManager.allocator.Initialize(fileName, 0)
+	if err != nil {
+		return err
+	}
+
+	// every cached page is known by its old id
+	for pageId := range DatabaseManager.database {
+		DatabaseManager.policy.Remove(pageId)
+	}
+	clear(DatabaseManager.database)
+	clear(DatabaseManager.modified)
+	DatabaseManager.trackedSince = DatabaseManager.wal.nextTransactionId
+	if DatabaseManager.vacuumHook != nil {
+		DatabaseManager.vacuumHook.Remapped(remap)
+	}
+	DatabaseManager.logEvent(EventVacuumed, "pages", len(order))
+	return nil
+}
+
+// vacuumRemap numbers the live pages from 1 in id order. Returns the new
+// id of every live page and the live pages in order
+func (DatabaseManager *DatabaseManager) vacuumRemap() (map[uint64]uint64, []uint64, error) {
+	total, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	remap := make(map[uint64]uint64)
+	order := []uint64{}
+	for pageId := uint64(1); pageId < total; pageId++ {
+		header, err := DatabaseManager.allocator.ReadPageHeader(pageId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.PageType == PagetypeFreepage {
+			continue
+		}
+		order = append(order, pageId)
+		remap[pageId] = uint64(len(order))
+	}
+	return remap, order, nil
+}
+
+// writeVacuumFile creates a data file at fileName holding the live pages
+// under their new ids, with the metadata and checksum settings of the
+// current file
+func (DatabaseManager *DatabaseManager) writeVacuumFile(fileName string, remap map[uint64]uint64, order []uint64) error {
+	old := &DatabaseManager.allocator
+	os.Remove(fileName)
+	vacuumed := PageAllocator{readHooks: old.readHooks, writeHooks: old.writeHooks}
+	err := vacuumed.Initialize(fileName, old.PageSize)
+	if err != nil {
+		return err
+	}
+	defer vacuumed.CloseFile()
+	err = vacuumed.SetHeaderChecksum(old.headerChecksum)
+	if err != nil {
+		return err
+	}
+	err = vacuumed.SetChecksumAlgorithm(old.checksum)
+	if err != nil {
+		return err
+	}
+	err = DatabaseManager.copyVacuumMetadata(&vacuumed, remap)
+	if err != nil {
+		return err
+	}
+
+	for _, pageId := range order {
+		header, err := old.ReadPageHeader(pageId)
+		if err != nil {
+			return err
+		}
+		data, err := old.ReadPageData(pageId)
+		if err != nil {
+			return fmt.Errorf("failed to read page %d: %w", pageId, err)
+		}
+		if header.PageType == PageTypeOverflow {
+			next := binary.LittleEndian.Uint64(data[OverflowNextOffset:])
+			binary.LittleEndian.PutUint64(data[OverflowNextOffset:], remap[next])
+		}
+		if DatabaseManager.vacuumHook != nil {
+			err = DatabaseManager.vacuumHook.RemapPage(pageId, header.PageType, data, remap)
+			if err != nil {
+				return fmt.Errorf("failed to remap page %d: %w", pageId, err)
+			}
+		}
+
+		id, err := vacuumed.AllocatePage(header.PageType)
+		if err != nil {
+			return err
+		}
+		if id != remap[pageId] {
+			return fmt.Errorf("page %d was copied to page %d instead of %d", pageId, id, remap[pageId])
+		}
+		if header.PageVersion != 0 {
+			err = vacuumed.WritePageHeader(id, PageHeaderVersionOffset, header.PageVersion)
+			if err != nil {
+				return err
+			}
+		}
+		err = vacuumed.WritePageData(id, data)
+		if err != nil {
+			return err
+		}
+	}
+	return vacuumed.Database.Sync()
+}
+
+// copyVacuumMetadata copies the metadata fields the vacuumed file doesn't
+// manage itself, remapping the directory head
+func (DatabaseManager *DatabaseManager) copyVacuumMetadata(vacuumed *PageAllocator, remap map[uint64]uint64) error {
+	for field := MetaField(0); field < MetaFieldSlots; field++ {
+		switch field {
+		case MetaFreeListHead, MetaTotalPages, MetaPageSize, MetaChecksumAlgorithm, MetaBackupLSN, MetaChecksumFlags, MetaChecksumSwitch:
+			continue
+		}
+		value, err := DatabaseManager.allocator.ReadMetaField(field)
+		if err != nil {
+			return err
+		}
+		if field == MetaDirectoryHead {
+			value = remap[value]
+		}
+		if value == 0 {
+			continue
+		}
+		err = vacuumed.WriteMetaField(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
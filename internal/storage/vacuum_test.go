@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestVacuum(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+
+	// fragment the file, every other page is freed and an overflow chain
+	// is spread over the holes
+	pageIds := []uint64{}
+	for i := range 12 {
+		pageId, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		_, err = DatabaseManager.WriteAt(pageId, 0, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", pageId, ":", err)
+		}
+		pageIds = append(pageIds, pageId)
+	}
+	for i := 0; i < len(pageIds); i += 2 {
+		err := DatabaseManager.FreePage(pageIds[i])
+		if err != nil {
+			t.Fatal("Failed to free page", pageIds[i], ":", err)
+		}
+	}
+	payload := bytes.Repeat([]byte("vacuum"), 1500)
+	head, err := DatabaseManager.WriteOverflow(payload)
+	if err != nil {
+		t.Fatal("Failed to write overflow chain:", err)
+	}
+	chain, _, err := DatabaseManager.overflowChain(head)
+	if err != nil {
+		t.Fatal("Failed to follow overflow chain:", err)
+	}
+	err = DatabaseManager.FreePage(pageIds[len(pageIds)-1])
+	if err != nil {
+		t.Fatal("Failed to free page", pageIds[len(pageIds)-1], ":", err)
+	}
+	free, err := DatabaseManager.allocator.FreePageCount()
+	if err != nil || free == 0 {
+		t.Fatal("Expected free pages before vacuuming, got", free, err)
+	}
+
+	live := slices.Clone(chain)
+	for i := 1; i < len(pageIds)-1; i += 2 {
+		live = append(live, pageIds[i])
+	}
+	slices.Sort(live)
+	newId := func(pageId uint64) uint64 {
+		return uint64(slices.Index(live, pageId) + 1)
+	}
+
+	err = DatabaseManager.Vacuum()
+	if err != nil {
+		t.Fatal("Vacuum failed:", err)
+	}
+	check := func() {
+		free, err := DatabaseManager.allocator.FreePageCount()
+		if err != nil || free != 0 {
+			t.Error("Expected no free pages after vacuuming, got", free, err)
+		}
+		total, err := DatabaseManager.allocator.ReadMetadata(MetadataTotalPageOffset)
+		if err != nil || total != uint64(len(live)+1) {
+			t.Error("Expected", len(live)+1, "pages after vacuuming, got", total, err)
+		}
+		for i := 1; i < len(pageIds)-1; i += 2 {
+			data, err := DatabaseManager.GetPage(newId(pageIds[i]))
+			if err != nil || data[0] != byte(i+1) {
+				t.Error("Expected page", pageIds[i], "moved to", newId(pageIds[i]), "to hold", i+1, "got", data[0], err)
+			}
+		}
+		data, err := DatabaseManager.ReadOverflow(newId(head))
+		if err != nil || !bytes.Equal(data, payload) {
+			t.Error("Overflow chain mismatch after vacuuming:", err)
+		}
+		ok, err := DatabaseManager.VerifyDatabase()
+		if err != nil || !ok {
+			t.Error("Database failed verification after vacuuming:", err)
+		}
+	}
+	check()
+
+	// the swapped file is the database from now on
+	DatabaseManager.Shutdown()
+	DatabaseManager = newDatabase(t, 1000000, 10)
+	defer DatabaseManager.Shutdown()
+	check()
+	if _, err := os.Stat("test.db.vacuum"); !os.IsNotExist(err) {
+		t.Error("Expected the vacuum file to be gone, got", err)
+	}
+}
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"cmp"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"slices"
 )
 
 // WriteAheadLog implements the write-ahead logging mechanism for ensuring
@@ -14,8 +19,24 @@ type WriteAheadLog struct {
 	Log               *os.File                  // The log file handle
 	FileName          string                    // Name of the log file
 	Cache             map[uint64][]*Transaction // In-memory cache of transactions by page ID
+	ordered           []*Transaction            // Cached transactions in commit order
 	nextTransactionId uint64                    // Next transaction ID to assign
-	fileSize          uint64                    // Current size of the log file
+	fileSize          uint64                    // Logical end of the log, where the next transaction is written
+	physicalSize      uint64                    // Size of the log file on disk including pre-allocated space
+	preallocateSize   uint64                    // Size of the chunks the log grows by, 0 to grow per append
+	cipher            cipher.AEAD               // Encrypts page changes when set
+	group             groupCommit               // Batches the syncs of appended transactions
+	coalesced         map[uint64]*coalescedPage // Combined changes of recovered transactions by page ID
+	checksum          ChecksumAlgorithm         // Algorithm of the transaction checksums
+	syncFile          func(*os.File) error      // Flushes the log file to disk, nil for File.Sync
+}
+
+// sync flushes the log file to disk
+func (WriteAheadLog *WriteAheadLog) sync() error {
+	if WriteAheadLog.syncFile != nil {
+		return WriteAheadLog.syncFile(WriteAheadLog.Log)
+	}
+	return WriteAheadLog.Log.Sync()
 }
 
 // Initialize sets up the WAL by opening the log file and recovering
@@ -28,6 +49,7 @@ func (WriteAheadLog *WriteAheadLog) Initialize(fileName string) error {
 		return err
 	}
 	WriteAheadLog.FileName = fileName
+	WriteAheadLog.fileSize = 0
 	WriteAheadLog.refreshCache()
 
 	// Read and validate existing transactions
@@ -38,29 +60,130 @@ func (WriteAheadLog *WriteAheadLog) Initialize(fileName string) error {
 		offset = walReader.bytesRead
 		transaction, err := walReader.getTransaction()
 		if err != nil {
+			// A zeroed tail too short to hold a record is the unused end
+			// of a pre-allocated segment, like a zeroed record
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				zero, error := WriteAheadLog.zeroFrom(offset)
+				if error != nil {
+					return error
+				}
+				if zero {
+					return WriteAheadLog.readPhysicalSize()
+				}
+			}
 			// Truncate log at last valid transaction
 			error := WriteAheadLog.Log.Truncate(int64(offset))
 			if error != nil {
 				return error
 			}
 			if errors.Is(err, io.EOF) {
-				return nil
+				return WriteAheadLog.readPhysicalSize()
 			}
 			return err
 		}
 		// Validate transaction checksum
-		_, _, ok := transaction.checkSum()
+		_, _, ok := transaction.checkSum(WriteAheadLog.checksum)
 		if !ok {
+			// A zeroed record is the unused tail of a pre-allocated segment
+			if transaction.isEmpty() {
+				return WriteAheadLog.readPhysicalSize()
+			}
 			continue
 		}
-		WriteAheadLog.addCache(transaction)
+		// Decrypt only after the checksum has validated the ciphertext,
+		// a wrong key must not truncate the log
+		if transaction.sealed != nil {
+			err = WriteAheadLog.unseal(&transaction)
+			if err != nil {
+				return err
+			}
+		}
+		WriteAheadLog.addCache(&transaction)
 		WriteAheadLog.fileSize = walReader.bytesRead
+		if transaction.Header.transactionId >= WriteAheadLog.nextTransactionId {
+			WriteAheadLog.nextTransactionId = transaction.Header.transactionId + 1
+		}
+	}
+}
+
+// scanValid reads the log from the start without modifying it and returns
+// the number of valid transactions and the offset just past the last one
+func (WriteAheadLog *WriteAheadLog) scanValid() (int, uint64, error) {
+	walReader := WalReader{}
+	walReader.initialize(WriteAheadLog)
+	count := 0
+	end := uint64(0)
+	for {
+		transaction, err := walReader.getTransaction()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return count, end, nil
+			}
+			return count, end, err
+		}
+		_, _, ok := transaction.checkSum(WriteAheadLog.checksum)
+		if !ok {
+			if transaction.isEmpty() {
+				return count, end, nil
+			}
+			continue
+		}
+		count++
+		end = walReader.bytesRead
+	}
+}
+
+// zeroFrom reports whether every byte of the log file from offset on is zero
+func (WriteAheadLog *WriteAheadLog) zeroFrom(offset uint64) (bool, error) {
+	tail, err := io.ReadAll(io.NewSectionReader(WriteAheadLog.Log, int64(offset), math.MaxInt64-int64(offset)))
+	if err != nil {
+		return false, err
 	}
+	return !slices.ContainsFunc(tail, func(b byte) bool { return b != 0 }), nil
 }
 
-// refreshCache clears the in-memory transaction cache
+// SetPreallocation makes the log grow in chunks of the given size instead
+// of on every append, reducing file metadata updates. A size of 0 disables it
+func (WriteAheadLog *WriteAheadLog) SetPreallocation(chunkSize uint64) {
+	WriteAheadLog.preallocateSize = chunkSize
+}
+
+// readPhysicalSize refreshes the physical size from the log file
+func (WriteAheadLog *WriteAheadLog) readPhysicalSize() error {
+	info, err := WriteAheadLog.Log.Stat()
+	if err != nil {
+		return err
+	}
+	WriteAheadLog.physicalSize = uint64(info.Size())
+	return nil
+}
+
+// reserve grows the log file by whole chunks until size bytes
+// past the logical end fit within it
+func (WriteAheadLog *WriteAheadLog) reserve(size uint64) error {
+	end := WriteAheadLog.fileSize + size
+	if WriteAheadLog.preallocateSize == 0 || end <= WriteAheadLog.physicalSize {
+		return nil
+	}
+	chunks := (end + WriteAheadLog.preallocateSize - 1) / WriteAheadLog.preallocateSize
+	err := WriteAheadLog.Log.Truncate(int64(chunks * WriteAheadLog.preallocateSize))
+	if err != nil {
+		return err
+	}
+	WriteAheadLog.physicalSize = chunks * WriteAheadLog.preallocateSize
+	return nil
+}
+
+// refreshCache clears the in-memory transaction cache. The old containers
+// are emptied so a reference left to either doesn't keep the checkpointed
+// transactions and their page data alive, and the map is replaced as maps
+// never give back the space they grew to
 func (WriteAheadLog *WriteAheadLog) refreshCache() {
+	clear(WriteAheadLog.Cache)
+	clear(WriteAheadLog.ordered)
 	WriteAheadLog.Cache = make(map[uint64][]*Transaction)
+	WriteAheadLog.ordered = nil
+	WriteAheadLog.coalesced = make(map[uint64]*coalescedPage)
 }
 
 // clearFromDisc removes the current log file and creates a new one.
@@ -78,16 +201,89 @@ func (WriteAheadLog *WriteAheadLog) clearFromDisc() error {
 	return err
 }
 
-// addCache adds a transaction to the in-memory cache, organizing
-// it by the pages it modifies for efficient recovery
-func (writeAheadLog *WriteAheadLog) addCache(transaction Transaction) {
+// dropBefore removes the transactions with an id lower than boundary from
+// the log. Later transactions are kept with their ids by writing them to a
+// new log that replaces the current one
+func (writeAheadLog *WriteAheadLog) dropBefore(boundary uint64) error {
+	keep := []Transaction{}
+	for _, transaction := range writeAheadLog.ordered {
+		if transaction.Header.transactionId >= boundary {
+			keep = append(keep, *transaction)
+		}
+	}
+	if len(keep) == 0 {
+		return writeAheadLog.clearFromDisc()
+	}
+
+	fileName := writeAheadLog.FileName + ".tmp"
+	os.Remove(fileName)
+	rewrite := WriteAheadLog{cipher: writeAheadLog.cipher, preallocateSize: writeAheadLog.preallocateSize, checksum: writeAheadLog.checksum, syncFile: writeAheadLog.syncFile}
+	err := rewrite.Initialize(fileName)
+	if err != nil {
+		return err
+	}
+	for _, transaction := range keep {
+		rewrite.nextTransactionId = transaction.Header.transactionId
+		err, _ = rewrite.AppendTransaction(transaction)
+		if err != nil {
+			rewrite.closeFile()
+			return err
+		}
+	}
+	err = rewrite.sync()
+	if err != nil {
+		rewrite.closeFile()
+		return err
+	}
+	err = rewrite.closeFile()
+	if err != nil {
+		return err
+	}
+
+	err = writeAheadLog.closeFile()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fileName, writeAheadLog.FileName)
+	if err != nil {
+		return err
+	}
+	return writeAheadLog.Initialize(writeAheadLog.FileName)
+}
+
+// addCache adds a validated transaction to the in-memory cache, organizing
+// it by the pages it modifies for efficient recovery. Every page shares the
+// same record so a transaction is cached for all of its pages or none.
+// Cached transactions are kept in ascending id order, so replaying them
+// lets the latest write to a byte win whatever order they were added in
+func (writeAheadLog *WriteAheadLog) addCache(transaction *Transaction) {
+	cached := make(map[uint64]bool)
 	for _, body := range transaction.Body {
-		if writeAheadLog.Cache[body.PageId] == nil {
-			writeAheadLog.Cache[body.PageId] = make([]*Transaction, 0)
+		// a transaction writing the same page twice is cached once
+		if cached[body.PageId] {
+			continue
+		}
+		cached[body.PageId] = true
+		writeAheadLog.Cache[body.PageId] = insertOrdered(writeAheadLog.Cache[body.PageId], transaction)
+		// an older transaction arriving late isn't part of the combined changes
+		page, ok := writeAheadLog.coalesced[body.PageId]
+		if ok && transaction.Header.transactionId <= page.upTo {
+			delete(writeAheadLog.coalesced, body.PageId)
 		}
+	}
+	writeAheadLog.ordered = insertOrdered(writeAheadLog.ordered, transaction)
+}
 
-		writeAheadLog.Cache[body.PageId] = append(writeAheadLog.Cache[body.PageId], &transaction)
+// insertOrdered inserts a transaction into a list sorted by transaction id
+func insertOrdered(transactions []*Transaction, transaction *Transaction) []*Transaction {
+	id := transaction.Header.transactionId
+	if len(transactions) == 0 || transactions[len(transactions)-1].Header.transactionId <= id {
+		return append(transactions, transaction)
 	}
+	index, _ := slices.BinarySearchFunc(transactions, id, func(cached *Transaction, id uint64) int {
+		return cmp.Compare(cached.Header.transactionId, id)
+	})
+	return slices.Insert(transactions, index, transaction)
 }
 
 // AppendTransaction writes a new transaction to the log file.
@@ -97,38 +293,140 @@ func (writeAheadLog *WriteAheadLog) addCache(transaction Transaction) {
 // - For each page: ID, offset, length, old data, new data
 // - Transaction ID (repeated for validation)
 // - Checksum
+// With group commit enabled it returns once the transaction is synced
 func (WriteAheadLog *WriteAheadLog) AppendTransaction(transaction Transaction) (error, uint64) {
-	// Write transaction header
-	data := binary.LittleEndian.AppendUint64([]byte{}, WriteAheadLog.nextTransactionId)
-	data = binary.LittleEndian.AppendUint32(data, transaction.Header.pageCount)
+	err, id, synced := WriteAheadLog.appendGrouped(transaction)
+	if err != nil {
+		return err, id
+	}
+	// Wait for the batch holding the transaction to be synced
+	return synced.wait(), id
+}
+
+// appendTransaction writes a transaction at the end of the log and caches it
+func (WriteAheadLog *WriteAheadLog) appendTransaction(transaction Transaction) (error, uint64) {
+	// Stamp the id so cached transactions can be ordered and filtered
+	transaction.Header.transactionId = WriteAheadLog.nextTransactionId
+	transaction.End.TransactionId = WriteAheadLog.nextTransactionId
 
-	// Write each page modification
+	// Serialize each page modification
+	body := []byte{}
 	for _, page := range transaction.Body {
-		data = binary.LittleEndian.AppendUint64(data, page.PageId)
-		data = binary.LittleEndian.AppendUint32(data, page.Offset)
-		data = binary.LittleEndian.AppendUint32(data, page.Length)
-		data = append(data, page.OldData...)
-		data = append(data, page.NewData...)
+		body = appendPageEntry(body, page, transaction.Header.typed)
+	}
 
-		WriteAheadLog.addCache(transaction)
+	// Write transaction header, with the page changes encrypted if a cipher is set
+	data := binary.LittleEndian.AppendUint64([]byte{}, WriteAheadLog.nextTransactionId)
+	if WriteAheadLog.cipher != nil {
+		sealed, err := WriteAheadLog.seal(body, sealedHeader(&transaction))
+		if err != nil {
+			return err, WriteAheadLog.nextTransactionId
+		}
+		data = binary.LittleEndian.AppendUint32(data, transaction.countField(true))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(sealed)))
+		data = append(data, sealed...)
+	} else {
+		data = binary.LittleEndian.AppendUint32(data, transaction.countField(false))
+		data = append(data, body...)
 	}
 
 	// Write transaction footer (ID and checksum)
 	data = binary.LittleEndian.AppendUint64(data, WriteAheadLog.nextTransactionId)
-	data = binary.LittleEndian.AppendUint32(data, getChecksumFromBytes(data))
+	data = binary.LittleEndian.AppendUint32(data, getChecksumFromBytes(WriteAheadLog.checksum, data))
 
-	// Write to log file
-	_, err := WriteAheadLog.Log.Write(data)
+	// Write to log file at the logical end
+	err := WriteAheadLog.reserve(uint64(len(data)))
+	if err != nil {
+		return err, WriteAheadLog.nextTransactionId
+	}
+	_, err = WriteAheadLog.Log.Seek(int64(WriteAheadLog.fileSize), io.SeekStart)
+	if err != nil {
+		return err, WriteAheadLog.nextTransactionId
+	}
+	_, err = WriteAheadLog.Log.Write(data)
 	if err != nil {
 		return err, WriteAheadLog.nextTransactionId
 	}
 
+	// Cache only once the whole record is on disk
+	WriteAheadLog.addCache(&transaction)
 	WriteAheadLog.nextTransactionId++
 	WriteAheadLog.fileSize += uint64(len(data))
 	return nil, WriteAheadLog.nextTransactionId - 1
 }
 
-// closeFile closes the log file handle
+// OrderedTransactions returns the cached transactions in commit order
+func (WriteAheadLog *WriteAheadLog) OrderedTransactions() []Transaction {
+	response := make([]Transaction, 0, len(WriteAheadLog.ordered))
+	for _, transaction := range WriteAheadLog.ordered {
+		response = append(response, *transaction)
+	}
+	return response
+}
+
+// NoLSN is passed to TransactionsSince by a consumer that hasn't read any
+// transaction yet, as transaction ids start at 0
+const NoLSN uint64 = math.MaxUint64
+
+// TransactionsSince returns the cached transactions with an id greater than
+// lsn in commit order, for consumers polling the log for changes. Errors if
+// transactions after lsn were already dropped by a checkpoint, or if lsn
+// was never written, as the consumer would silently miss transactions
+func (WriteAheadLog *WriteAheadLog) TransactionsSince(lsn uint64) ([]Transaction, error) {
+	if lsn != NoLSN && lsn >= WriteAheadLog.nextTransactionId {
+		return nil, fmt.Errorf("transaction %d has not been written yet, the log is at %d", lsn, WriteAheadLog.nextTransactionId)
+	}
+	// NoLSN wraps around to the first id
+	next := lsn + 1
+	if next >= WriteAheadLog.nextTransactionId {
+		return []Transaction{}, nil
+	}
+	if len(WriteAheadLog.ordered) == 0 || WriteAheadLog.ordered[0].Header.transactionId > next {
+		return nil, fmt.Errorf("transactions after %d are no longer in the log", lsn)
+	}
+
+	response := []Transaction{}
+	for _, transaction := range WriteAheadLog.ordered {
+		if transaction.Header.transactionId >= next {
+			response = append(response, *transaction)
+		}
+	}
+	return response, nil
+}
+
+// PageStates reconstructs the state of every page touched by the log
+// by applying its deltas in commit order over a zeroed page, without
+// reading the data file. Bytes the log never wrote are left as zero.
+// The log doesn't know the page size, pages are DefaultPageSize or
+// longer if a delta reaches further
+func (WriteAheadLog *WriteAheadLog) PageStates() map[uint64]PageData {
+	response := make(map[uint64]PageData)
+	for pageId, transactions := range WriteAheadLog.Cache {
+		size := DefaultPageSize - PageHeaderSize
+		for _, transaction := range transactions {
+			for _, body := range transaction.Body {
+				if body.PageId == pageId && int(body.Offset+body.Length) > size {
+					size = int(body.Offset + body.Length)
+				}
+			}
+		}
+		data := make(PageData, size)
+		for _, transaction := range transactions {
+			for _, body := range transaction.Body {
+				if body.PageId != pageId {
+					continue
+				}
+				copy(data[body.Offset:], body.NewData)
+			}
+		}
+		response[pageId] = data
+	}
+	return response
+}
+
+// closeFile closes the log file handle once the group commit batches
+// written to it are synced
 func (WriteAheadLog *WriteAheadLog) closeFile() error {
+	WriteAheadLog.flushBatches()
 	return WriteAheadLog.Log.Close()
 }
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// walSealedFlag is set in the page count of a transaction whose
+// page changes are encrypted
+const walSealedFlag = 1 << 31
+
+// ErrWalEncrypted is returned when recovering an encrypted log without a key
+var ErrWalEncrypted = errors.New("wal is encrypted but no key was set")
+
+// ErrWalKey is returned when the log cannot be decrypted with the key set
+var ErrWalKey = errors.New("wal could not be decrypted with the given key")
+
+// SetCipher enables AES-GCM encryption of the page changes written to the log.
+// The key must be 16, 24 or 32 bytes, and must be set before Initialize so
+// recovery can decrypt existing transactions, DatabaseManager.SetWalKey
+// does this for a manager. A nil key disables encryption for new transactions.
+func (WriteAheadLog *WriteAheadLog) SetCipher(key []byte) error {
+	if key == nil {
+		WriteAheadLog.cipher = nil
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	WriteAheadLog.cipher, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealedHeader returns the record header a sealed transaction is
+// authenticated with, its id and flagged page count, so ciphertext can't be
+// moved to another record or given another page count
+func sealedHeader(transaction *Transaction) []byte {
+	header := binary.LittleEndian.AppendUint64([]byte{}, transaction.Header.transactionId)
+	return binary.LittleEndian.AppendUint32(header, transaction.countField(true))
+}
+
+// seal encrypts serialized page changes, prefixing the random nonce
+func (WriteAheadLog *WriteAheadLog) seal(body []byte, header []byte) ([]byte, error) {
+	nonce := make([]byte, WriteAheadLog.cipher.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return WriteAheadLog.cipher.Seal(nonce, nonce, body, header), nil
+}
+
+// unseal decrypts the page changes of a transaction read from the log
+// and fills in its body
+func (WriteAheadLog *WriteAheadLog) unseal(transaction *Transaction) error {
+	if WriteAheadLog.cipher == nil {
+		return ErrWalEncrypted
+	}
+	nonceSize := WriteAheadLog.cipher.NonceSize()
+	if len(transaction.sealed) < nonceSize {
+		return ErrWalKey
+	}
+	header := sealedHeader(transaction)
+	body, err := WriteAheadLog.cipher.Open(nil, transaction.sealed[:nonceSize], transaction.sealed[nonceSize:], header)
+	if err != nil {
+		return ErrWalKey
+	}
+
+	reader := bytes.NewReader(body)
+	for range transaction.Header.pageCount {
+		entry, _, err := readPageEntry(reader, transaction.Header.typed)
+		if err != nil {
+			return err
+		}
+		transaction.Body = append(transaction.Body, entry)
+	}
+	return nil
+}
+
+// SetWalKey sets the key the WAL is encrypted with, see
+// WriteAheadLog.SetCipher. It must be called before Initialize when the log
+// may hold encrypted transactions, so recovery can decrypt them. Setting it
+// later encrypts the transactions logged from then on
+func (DatabaseManager *DatabaseManager) SetWalKey(key []byte) error {
+	DatabaseManager.lock.Lock()
+	defer DatabaseManager.lock.Unlock()
+	return DatabaseManager.wal.SetCipher(key)
+}
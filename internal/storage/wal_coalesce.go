@@ -0,0 +1,96 @@
+package storage
+
+import "fmt"
+
+// coalescedPage is the combined effect of the cached transactions of a
+// page up to and including transaction upTo
+type coalescedPage struct {
+	upTo  uint64
+	spans []coalescedSpan // Written regions in page order, never overlapping
+}
+
+// coalescedSpan is a region of a page and the bytes last written to it
+type coalescedSpan struct {
+	offset uint32
+	data   []byte
+}
+
+// coalesce combines the cached transactions of every page written by more
+// than one of them, so reading the page applies each written byte once
+// instead of replaying every transaction. Transactions added later are
+// applied on top as usual
+func (WriteAheadLog *WriteAheadLog) coalesce() {
+	for pageId, transactions := range WriteAheadLog.Cache {
+		if len(transactions) < 2 {
+			continue
+		}
+		size := 0
+		for _, transaction := range transactions {
+			for _, body := range transaction.Body {
+				if body.PageId == pageId {
+					size = max(size, int(body.Offset)+len(body.NewData))
+				}
+			}
+		}
+		image := make([]byte, size)
+		written := make([]bool, size)
+		for _, transaction := range transactions {
+			for _, body := range transaction.Body {
+				if body.PageId != pageId {
+					continue
+				}
+				copy(image[body.Offset:], body.NewData)
+				for i := range body.NewData {
+					written[int(body.Offset)+i] = true
+				}
+			}
+		}
+
+		page := &coalescedPage{upTo: transactions[len(transactions)-1].Header.transactionId}
+		for start := 0; start < size; {
+			if !written[start] {
+				start++
+				continue
+			}
+			end := start
+			for end < size && written[end] {
+				end++
+			}
+			page.spans = append(page.spans, coalescedSpan{uint32(start), image[start:end]})
+			start = end
+		}
+		WriteAheadLog.coalesced[pageId] = page
+	}
+}
+
+// applyPage applies the cached changes to a page read from the data file,
+// in commit order
+func (WriteAheadLog *WriteAheadLog) applyPage(pageId uint64, data PageData) error {
+	upTo := uint64(0)
+	page, ok := WriteAheadLog.coalesced[pageId]
+	if ok {
+		for _, span := range page.spans {
+			if int(span.offset)+len(span.data) > len(data) {
+				return fmt.Errorf("wal delta out of bounds on page %d", pageId)
+			}
+			copy(data[span.offset:], span.data)
+		}
+		upTo = page.upTo
+	}
+
+	for _, transaction := range WriteAheadLog.Cache[pageId] {
+		if ok && transaction.Header.transactionId <= upTo {
+			continue
+		}
+		for _, body := range transaction.Body {
+			if body.PageId != pageId {
+				continue
+			}
+			if int(body.Offset)+len(body.NewData) > len(data) {
+				return fmt.Errorf("wal delta out of bounds on page %d", pageId)
+			}
+			copy(data[body.Offset:], body.NewData)
+		}
+	}
+	return nil
+}
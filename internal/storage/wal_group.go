@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// groupCommit batches the fsyncs of transactions appended close together.
+// A batch is synced once it holds maxBatch transactions or maxDelay after
+// its first transaction, whichever comes first
+type groupCommit struct {
+	lock     sync.Mutex
+	maxBatch int            // transactions that trigger a sync, 0 when disabled
+	maxDelay time.Duration  // longest a transaction waits for its batch
+	current  *commitBatch   // batch new transactions join
+	closed   []*commitBatch // closed batches that may not be synced yet
+}
+
+// commitBatch is a set of appended transactions synced together
+type commitBatch struct {
+	size  int           // transactions in the batch
+	timer *time.Timer   // syncs the batch once maxDelay has passed
+	done  chan struct{} // closed once the batch is synced
+	err   error         // result of the sync, read after done is closed
+	once  sync.Once     // runs the sync of the batch once
+}
+
+// walSync is an appended transaction waiting for the sync of its batch
+type walSync struct {
+	WriteAheadLog *WriteAheadLog
+	batch         *commitBatch
+	full          bool // the transaction filled the batch and syncs it
+}
+
+// SetGroupCommit makes AppendTransaction return only once the transaction is
+// synced to disk, sharing one fsync between the transactions appended within
+// maxDelay of each other, up to maxBatch at a time. A maxBatch of 1 syncs
+// every transaction on its own, 0 disables syncing on append.
+// With group commit enabled AppendTransaction may be called from several
+// goroutines, batches only form when it is
+func (WriteAheadLog *WriteAheadLog) SetGroupCommit(maxBatch int, maxDelay time.Duration) {
+	WriteAheadLog.group.lock.Lock()
+	defer WriteAheadLog.group.lock.Unlock()
+	WriteAheadLog.group.maxBatch = maxBatch
+	WriteAheadLog.group.maxDelay = maxDelay
+}
+
+// appendGrouped writes a transaction and, with group commit enabled, adds
+// it to the current batch. The returned sync is nil when group commit is
+// disabled. Otherwise the caller must wait on it, even if it fails later,
+// as the transaction may have filled the batch
+func (WriteAheadLog *WriteAheadLog) appendGrouped(transaction Transaction) (error, uint64, *walSync) {
+	WriteAheadLog.group.lock.Lock()
+	defer WriteAheadLog.group.lock.Unlock()
+	err, id := WriteAheadLog.appendTransaction(transaction)
+	if err != nil || WriteAheadLog.group.maxBatch == 0 {
+		return err, id, nil
+	}
+	batch, full := WriteAheadLog.joinBatch()
+	return nil, id, &walSync{WriteAheadLog, batch, full}
+}
+
+// wait syncs the batch if the transaction filled it and blocks until the
+// batch is synced, returning the result of the sync
+func (walSync *walSync) wait() error {
+	if walSync == nil {
+		return nil
+	}
+	if walSync.full {
+		walSync.WriteAheadLog.syncBatch(walSync.batch)
+	}
+	<-walSync.batch.done
+	return walSync.batch.err
+}
+
+// joinBatch adds a written transaction to the current batch and returns it
+// with whether it is now full, in which case the caller must sync it after
+// releasing the group lock. Must be called with the group lock held
+func (WriteAheadLog *WriteAheadLog) joinBatch() (*commitBatch, bool) {
+	group := &WriteAheadLog.group
+	if group.current == nil {
+		group.current = &commitBatch{done: make(chan struct{})}
+	}
+	batch := group.current
+	batch.size++
+	if batch.size >= group.maxBatch {
+		WriteAheadLog.closeBatch(batch)
+		return batch, true
+	}
+	if batch.size == 1 {
+		batch.timer = time.AfterFunc(group.maxDelay, func() {
+			group.lock.Lock()
+			closed := WriteAheadLog.closeBatch(batch)
+			group.lock.Unlock()
+			if closed {
+				WriteAheadLog.syncBatch(batch)
+			}
+		})
+	}
+	return batch, false
+}
+
+// closeBatch stops new transactions from joining the batch, reporting
+// false if it was already closed. Must be called with the group lock held
+func (WriteAheadLog *WriteAheadLog) closeBatch(batch *commitBatch) bool {
+	if WriteAheadLog.group.current != batch {
+		return false
+	}
+	WriteAheadLog.group.current = nil
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	// batches synced since the last close are no longer tracked
+	WriteAheadLog.group.closed = slices.DeleteFunc(WriteAheadLog.group.closed, func(closed *commitBatch) bool {
+		select {
+		case <-closed.done:
+			return true
+		default:
+			return false
+		}
+	})
+	WriteAheadLog.group.closed = append(WriteAheadLog.group.closed, batch)
+	return true
+}
+
+// syncBatch syncs the log and releases the transactions waiting on a closed
+// batch. It runs without the group lock so the next batch can be written
+// meanwhile, the transactions of this one are already written. Only the
+// first call syncs, later ones return once it has finished
+func (WriteAheadLog *WriteAheadLog) syncBatch(batch *commitBatch) {
+	batch.once.Do(func() {
+		batch.err = WriteAheadLog.sync()
+		close(batch.done)
+	})
+}
+
+// flushBatches syncs the open batch and every closed batch not synced yet,
+// so the log file can be closed or replaced under them. A batch whose sync
+// is left to the transaction that filled it is synced here, as that
+// transaction may be the one closing the log
+func (WriteAheadLog *WriteAheadLog) flushBatches() {
+	group := &WriteAheadLog.group
+	group.lock.Lock()
+	if group.current != nil {
+		WriteAheadLog.closeBatch(group.current)
+	}
+	batches := group.closed
+	group.closed = nil
+	group.lock.Unlock()
+	for _, batch := range batches {
+		WriteAheadLog.syncBatch(batch)
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// WalInspector describes the contents of a WAL file opened for inspection
+type WalInspector struct {
+	Transactions        []TransactionInfo // Valid transactions in log order
+	CorruptTransactions int               // Complete records that failed their checksum
+	ValidBytes          uint64            // Offset just past the last valid transaction
+	TruncatedBytes      uint64            // Bytes of an incomplete record at the end of the log
+}
+
+// TransactionInfo summarizes a single transaction in the log
+type TransactionInfo struct {
+	TransactionId uint64   // Id stamped on the transaction
+	PageIds       []uint64 // Pages the transaction writes, empty if it is encrypted
+	Bytes         uint64   // Size of the record in the log
+	Sealed        bool     // Whether the page changes are encrypted
+}
+
+// InspectWal reads a WAL file without a DatabaseManager or data file.
+// Records are checked with the checksum algorithm the database was using
+// when they were written. The file is opened read only and never truncated
+// or replayed
+func InspectWal(path string, algorithm ChecksumAlgorithm) (*WalInspector, error) {
+	if !algorithm.valid() {
+		return nil, fmt.Errorf("unknown checksum algorithm %d", algorithm)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	inspector := &WalInspector{}
+	walReader := WalReader{}
+	walReader.initialize(&WriteAheadLog{Log: file, FileName: path, checksum: algorithm})
+	for {
+		offset := walReader.bytesRead
+		transaction, err := walReader.getTransaction()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				inspector.TruncatedBytes = uint64(info.Size()) - offset
+				return inspector, nil
+			}
+			return inspector, err
+		}
+		_, _, ok := transaction.checkSum(algorithm)
+		if !ok {
+			// A zeroed record is the unused tail of a pre-allocated segment
+			if transaction.isEmpty() {
+				return inspector, nil
+			}
+			inspector.CorruptTransactions++
+			continue
+		}
+
+		details := TransactionInfo{
+			TransactionId: transaction.Header.transactionId,
+			PageIds:       []uint64{},
+			Bytes:         walReader.bytesRead - offset,
+			Sealed:        transaction.sealed != nil,
+		}
+		for _, body := range transaction.Body {
+			details.PageIds = append(details.PageIds, body.PageId)
+		}
+		inspector.Transactions = append(inspector.Transactions, details)
+		inspector.ValidBytes = walReader.bytesRead
+	}
+}
+
+// TransactionCount returns the number of valid transactions in the log
+func (inspector *WalInspector) TransactionCount() int {
+	return len(inspector.Transactions)
+}
+
+// PageIds returns the sorted set of pages touched by valid transactions
+func (inspector *WalInspector) PageIds() []uint64 {
+	seen := make(map[uint64]bool)
+	response := []uint64{}
+	for _, transaction := range inspector.Transactions {
+		for _, pageId := range transaction.PageIds {
+			if !seen[pageId] {
+				seen[pageId] = true
+				response = append(response, pageId)
+			}
+		}
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i] < response[j] })
+	return response
+}
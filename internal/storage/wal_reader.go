@@ -3,7 +3,10 @@ package storage
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 )
 
 // WalReader handles reading transactions from the Write-Ahead Log.
@@ -28,6 +31,51 @@ func (WriteAheadLog *WriteAheadLog) Startup() error {
 	return nil
 }
 
+// OpenWalReader opens a WAL file read only, for tools walking its
+// transactions without recovering or truncating the log. Records are
+// checked with the given checksum algorithm
+func OpenWalReader(path string, algorithm ChecksumAlgorithm) (*WalReader, error) {
+	if !algorithm.valid() {
+		return nil, fmt.Errorf("unknown checksum algorithm %d", algorithm)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &WalReader{WriteAheadLog: &WriteAheadLog{Log: file, FileName: path, checksum: algorithm}}, nil
+}
+
+// Close closes the log file opened by OpenWalReader
+func (WalReader *WalReader) Close() error {
+	return WalReader.WriteAheadLog.Log.Close()
+}
+
+// ForEach calls fn for every valid transaction from the start of the log,
+// in log order. It stops at the first incomplete record or failed checksum,
+// as the rest of the log can't be trusted, and returns nil. An error from
+// fn stops the walk and is returned. Encrypted transactions are passed
+// with an empty body. The log is never modified
+func (WalReader *WalReader) ForEach(fn func(Transaction) error) error {
+	WalReader.initialize(WalReader.WriteAheadLog)
+	for {
+		transaction, err := WalReader.getTransaction()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		_, _, ok := transaction.checkSum(WalReader.WriteAheadLog.checksum)
+		if !ok {
+			return nil
+		}
+		err = fn(transaction)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // initialize sets up the WAL reader with a buffered reader and resets
 // the read position to the start of the file.
 func (WalReader *WalReader) initialize(WriteAheadLog *WriteAheadLog) {
@@ -45,9 +93,11 @@ func (WalReader *WalReader) initialize(WriteAheadLog *WriteAheadLog) {
 //   - Page ID (uint64)
 //   - Offset in page (uint32)
 //   - Length of change (uint32)
+//   - Page type before and after the change, for typed transactions (2 bytes)
 //   - Old data (byte array)
 //   - New data (byte array)
 //
+// - Or for encrypted transactions, ciphertext length (uint32) and ciphertext
 // - Transaction ID (repeated for validation)
 // - Checksum (uint32)
 func (WalReader *WalReader) getTransaction() (Transaction, error) {
@@ -67,44 +117,35 @@ func (WalReader *WalReader) getTransaction() (Transaction, error) {
 	}
 	WalReader.bytesRead += uint64(binary.Size(transaction.Header.pageCount))
 
-	// Read each page change in the transaction
-	for range transaction.Header.pageCount {
-		body := PageEntry{}
-
-		// Read page change metadata
-		err = binary.Read(WalReader.reader, binary.LittleEndian, &body.PageId)
-		if err != nil {
-			return transaction, err
-		}
-		WalReader.bytesRead += uint64(binary.Size(body.PageId))
-
-		err = binary.Read(WalReader.reader, binary.LittleEndian, &body.Offset)
-		if err != nil {
-			return transaction, err
-		}
-		WalReader.bytesRead += uint64(binary.Size(body.Offset))
+	transaction.Header.typed = transaction.Header.pageCount&walTypedFlag != 0
+	transaction.Header.pageCount &^= walTypedFlag
 
-		err = binary.Read(WalReader.reader, binary.LittleEndian, &body.Length)
+	// Encrypted transactions store their page changes as one sealed block
+	if transaction.Header.pageCount&walSealedFlag != 0 {
+		transaction.Header.pageCount &^= walSealedFlag
+		var length uint32
+		err = binary.Read(WalReader.reader, binary.LittleEndian, &length)
 		if err != nil {
 			return transaction, err
 		}
-		WalReader.bytesRead += uint64(binary.Size(body.Length))
+		WalReader.bytesRead += uint64(binary.Size(length))
 
-		// Read old and new data
-		body.OldData = make([]byte, body.Length)
-		err = binary.Read(WalReader.reader, binary.LittleEndian, body.OldData)
+		transaction.sealed = make([]byte, length)
+		_, err = io.ReadFull(WalReader.reader, transaction.sealed)
 		if err != nil {
 			return transaction, err
 		}
-		WalReader.bytesRead += uint64(body.Length)
-
-		body.NewData = make([]byte, body.Length)
-		err = binary.Read(WalReader.reader, binary.LittleEndian, body.NewData)
-		if err != nil {
-			return transaction, err
+		WalReader.bytesRead += uint64(length)
+	} else {
+		// Read each page change in the transaction
+		for range transaction.Header.pageCount {
+			body, bytesRead, err := readPageEntry(WalReader.reader, transaction.Header.typed)
+			WalReader.bytesRead += bytesRead
+			if err != nil {
+				return transaction, err
+			}
+			transaction.Body = append(transaction.Body, body)
 		}
-		WalReader.bytesRead += uint64(body.Length)
-		transaction.Body = append(transaction.Body, body)
 	}
 
 	// Read transaction footer (ID and checksum)
@@ -122,3 +163,56 @@ func (WalReader *WalReader) getTransaction() (Transaction, error) {
 
 	return transaction, nil
 }
+
+// readPageEntry reads a single page change and returns it along with
+// the number of bytes consumed. Typed changes carry their page types
+func readPageEntry(reader io.Reader, typed bool) (PageEntry, uint64, error) {
+	body := PageEntry{}
+	bytesRead := uint64(0)
+
+	// Read page change metadata
+	err := binary.Read(reader, binary.LittleEndian, &body.PageId)
+	if err != nil {
+		return body, bytesRead, err
+	}
+	bytesRead += uint64(binary.Size(body.PageId))
+
+	err = binary.Read(reader, binary.LittleEndian, &body.Offset)
+	if err != nil {
+		return body, bytesRead, err
+	}
+	bytesRead += uint64(binary.Size(body.Offset))
+
+	err = binary.Read(reader, binary.LittleEndian, &body.Length)
+	if err != nil {
+		return body, bytesRead, err
+	}
+	bytesRead += uint64(binary.Size(body.Length))
+
+	if typed {
+		types := make([]byte, 2)
+		_, err = io.ReadFull(reader, types)
+		if err != nil {
+			return body, bytesRead, err
+		}
+		bytesRead += uint64(len(types))
+		body.OldType, body.NewType = types[0], types[1]
+	}
+
+	// Read old and new data
+	body.OldData = make([]byte, body.Length)
+	err = binary.Read(reader, binary.LittleEndian, body.OldData)
+	if err != nil {
+		return body, bytesRead, err
+	}
+	bytesRead += uint64(body.Length)
+
+	body.NewData = make([]byte, body.Length)
+	err = binary.Read(reader, binary.LittleEndian, body.NewData)
+	if err != nil {
+		return body, bytesRead, err
+	}
+	bytesRead += uint64(body.Length)
+
+	return body, bytesRead, nil
+}
@@ -11,6 +11,7 @@ type Transaction struct {
 	Header TransactionHeader // Transaction metadata
 	Body   []PageEntry       // List of page changes
 	End    TransactionEnd    // Transaction footer with validation
+	sealed []byte            // Encrypted page changes as read from the log
 }
 
 // MakeTransaction initializes a new transaction with an empty page change list
@@ -19,40 +20,88 @@ func (Transaction *Transaction) MakeTransaction() *Transaction {
 	return Transaction
 }
 
+// Id returns the id the log stamped on the transaction
+func (transaction *Transaction) Id() uint64 {
+	return transaction.Header.transactionId
+}
+
+// walTypedFlag is set in the page count of a transaction whose page
+// changes carry the page type before and after the change
+const walTypedFlag = 1 << 30
+
+// countField returns the page count as stored in the log, with the flags
+// of the record format
+func (transaction *Transaction) countField(sealed bool) uint32 {
+	count := transaction.Header.pageCount
+	if transaction.Header.typed {
+		count |= walTypedFlag
+	}
+	if sealed {
+		count |= walSealedFlag
+	}
+	return count
+}
+
+// appendPageEntry serializes a page change, with its page types when typed
+func appendPageEntry(data []byte, page PageEntry, typed bool) []byte {
+	data = binary.LittleEndian.AppendUint64(data, page.PageId)
+	data = binary.LittleEndian.AppendUint32(data, page.Offset)
+	data = binary.LittleEndian.AppendUint32(data, page.Length)
+	if typed {
+		data = append(data, page.OldType, page.NewType)
+	}
+	data = append(data, page.OldData...)
+	return append(data, page.NewData...)
+}
+
 // checkSum calculates and verifies the transaction checksum.
 // The checksum covers:
 // - Transaction ID
 // - Number of page changes
-// - All page changes (ID, offset, length, old data, new data)
+// - All page changes (ID, offset, length, page types, old data, new data)
+// - Or for encrypted transactions, the ciphertext of the page changes
 // - Transaction ID (repeated)
 // Returns:
 // - Calculated checksum
 // - Stored checksum
 // - Whether they match
-func (transaction *Transaction) checkSum() (uint32, uint32, bool) {
+func (transaction *Transaction) checkSum(algorithm ChecksumAlgorithm) (uint32, uint32, bool) {
 	// Build data for checksum calculation
 	data := binary.LittleEndian.AppendUint64([]byte{}, transaction.Header.transactionId)
-	data = binary.LittleEndian.AppendUint32(data, transaction.Header.pageCount)
-
-	// Add all page changes
-	for _, page := range transaction.Body {
-		data = binary.LittleEndian.AppendUint64(data, page.PageId)
-		data = binary.LittleEndian.AppendUint32(data, page.Offset)
-		data = binary.LittleEndian.AppendUint32(data, page.Length)
-		data = append(data, page.OldData...)
-		data = append(data, page.NewData...)
+
+	if transaction.sealed != nil {
+		// Encrypted transactions are checked over the ciphertext
+		data = binary.LittleEndian.AppendUint32(data, transaction.countField(true))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(transaction.sealed)))
+		data = append(data, transaction.sealed...)
+	} else {
+		data = binary.LittleEndian.AppendUint32(data, transaction.countField(false))
+
+		// Add all page changes
+		for _, page := range transaction.Body {
+			data = appendPageEntry(data, page, transaction.Header.typed)
+		}
 	}
 
 	// Add transaction ID again for validation
 	data = binary.LittleEndian.AppendUint64(data, transaction.Header.transactionId)
-	checksum := getChecksumFromBytes(data)
+	checksum := getChecksumFromBytes(algorithm, data)
 	return checksum, transaction.End.Checksum, transaction.End.Checksum == checksum
 }
 
+// isEmpty reports whether the transaction was read from zeroed bytes
+func (transaction *Transaction) isEmpty() bool {
+	return transaction.Header.transactionId == 0 &&
+		transaction.Header.pageCount == 0 &&
+		transaction.End.TransactionId == 0 &&
+		transaction.End.Checksum == 0
+}
+
 // TransactionHeader contains metadata about a transaction
 type TransactionHeader struct {
 	transactionId uint64 // Unique identifier for the transaction
 	pageCount     uint32 // Number of pages modified in this transaction
+	typed         bool   // Whether page changes carry page types, records written before types were logged don't
 }
 
 // PageEntry represents a single change to a page in a transaction.
@@ -61,6 +110,8 @@ type PageEntry struct {
 	PageId  uint64 // ID of the modified page
 	Offset  uint32 // Starting offset in the page
 	Length  uint32 // Length of the change
+	OldType byte   // Page type before the change
+	NewType byte   // Page type after the change
 	OldData []byte // Original data before the change
 	NewData []byte // New data after the change
 }
@@ -69,10 +120,10 @@ type PageEntry struct {
 // The transaction ID is repeated here to detect truncation.
 type TransactionEnd struct {
 	TransactionId uint64 // Transaction ID (repeated for validation)
-	Checksum      uint32 // CRC32 checksum of the entire transaction
+	Checksum      uint32 // Checksum of the entire transaction
 }
 
-// getChecksumFromBytes calculates a CRC32 checksum for a byte slice
-func getChecksumFromBytes(data []byte) uint32 {
-	return crc32.ChecksumIEEE(data)
+// getChecksumFromBytes calculates the checksum of a byte slice
+func getChecksumFromBytes(algorithm ChecksumAlgorithm, data []byte) uint32 {
+	return crc32.Checksum(data, algorithm.table())
 }
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"os"
 	"reflect"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newWal(t *testing.T) *WriteAheadLog {
@@ -51,7 +56,7 @@ func TestAppendRead(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed to read transaction :", err, transaction, readTransaction)
 	}
-	checksum, checksumnew, ok := readTransaction.checkSum()
+	checksum, checksumnew, ok := readTransaction.checkSum(ChecksumCRC32)
 
 	if !ok {
 		t.Fatal("Failed checksum for transaction ", checksum, checksumnew)
@@ -101,7 +106,7 @@ func TestReadingAtStartup(t *testing.T) {
 	defer walNew.closeFile()
 
 	cacheTransaction := walNew.Cache[42][0]
-	checksum, checksumnew, ok := cacheTransaction.checkSum()
+	checksum, checksumnew, ok := cacheTransaction.checkSum(ChecksumCRC32)
 	if !ok {
 		t.Fatal("Failed checksum for transaction ", checksum, checksumnew)
 	}
@@ -184,3 +189,780 @@ func TestTruncate(t *testing.T) {
 	}
 
 }
+
+func TestPageStates(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer wal.closeFile()
+
+	// overlapping deltas on page 7 and a single delta on page 8
+	deltas := []PageEntry{
+		{PageId: 7, Offset: 0, Length: 4, OldData: []byte{0, 0, 0, 0}, NewData: []byte{1, 2, 3, 4}},
+		{PageId: 7, Offset: 2, Length: 3, OldData: []byte{3, 4, 0}, NewData: []byte{9, 9, 9}},
+		{PageId: 8, Offset: 10, Length: 2, OldData: []byte{0, 0}, NewData: []byte{5, 6}},
+	}
+	for _, delta := range deltas {
+		transaction := Transaction{}
+		transaction.MakeTransaction()
+		transaction.Header.pageCount = 1
+		transaction.Body = append(transaction.Body, delta)
+		err, _ := wal.AppendTransaction(transaction)
+		if err != nil {
+			t.Fatal("Failed to write transaction: ", err)
+		}
+	}
+
+	expected := map[uint64]PageData{7: MakePageData(), 8: MakePageData()}
+	copy(expected[7][:], []byte{1, 2, 9, 9, 9})
+	copy(expected[8][10:], []byte{5, 6})
+
+	states := wal.PageStates()
+	if len(states) != len(expected) {
+		t.Fatal("Expected", len(expected), "page states but got", len(states))
+	}
+	for id, data := range expected {
+		if string(states[id][:]) != string(data[:]) {
+			t.Error("Reconstructed state mismatch for page", id)
+		}
+	}
+
+	// the same state must be rebuilt from the log on disk
+	wal.Log.Sync()
+	wal.closeFile()
+	walNew := newWal(t)
+	defer walNew.closeFile()
+	states = walNew.PageStates()
+	for id, data := range expected {
+		if string(states[id][:]) != string(data[:]) {
+			t.Error("Recovered state mismatch for page", id)
+		}
+	}
+}
+
+func TestPreallocatedRecovery(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer wal.closeFile()
+	wal.SetPreallocation(1 << 16)
+
+	// --- Create a dummy transaction ---
+	transaction := Transaction{}
+	transaction.MakeTransaction()
+
+	transaction.Header.pageCount = 1
+	page := PageEntry{
+		PageId:  42,
+		Offset:  10,
+		Length:  4,
+		OldData: []byte{1, 2, 3, 4},
+		NewData: []byte{5, 6, 7, 8},
+	}
+	transaction.Body = append(transaction.Body, page)
+
+	for i := 0; i < 2; i++ {
+		err, _ := wal.AppendTransaction(transaction)
+		if err != nil {
+			t.Fatal("Failed to write transaction: ", err)
+		}
+	}
+	logicalEnd := wal.fileSize
+	wal.Log.Sync()
+	info, err := wal.Log.Stat()
+	if err != nil {
+		t.Fatal("Failed to get file size: ", err)
+	}
+	if info.Size() != 1<<16 {
+		t.Fatal("Expected a pre-allocated log of", 1<<16, "bytes, got", info.Size())
+	}
+	wal.closeFile()
+
+	// recovery stops at the zeroed tail without truncating it
+	walNew := newWal(t)
+	defer walNew.closeFile()
+	walNew.SetPreallocation(1 << 16)
+	if walNew.fileSize != logicalEnd {
+		t.Fatal("Expected logical end", logicalEnd, "after recovery, got", walNew.fileSize)
+	}
+	if len(walNew.Cache[42]) != 2 {
+		t.Fatal("Expected 2 recovered transactions, got", len(walNew.Cache[42]))
+	}
+	info, err = walNew.Log.Stat()
+	if err != nil {
+		t.Fatal("Failed to get file size: ", err)
+	}
+	if info.Size() != 1<<16 {
+		t.Error("Pre-allocated space was truncated during recovery, size", info.Size())
+	}
+
+	// appends continue from the logical end
+	err, id := walNew.AppendTransaction(transaction)
+	if err != nil {
+		t.Fatal("Failed to write transaction: ", err)
+	}
+	if id != 2 {
+		t.Error("Expected transaction id 2 after recovery, got", id)
+	}
+	walNew.Log.Sync()
+	walNew.closeFile()
+
+	walLast := newWal(t)
+	defer walLast.closeFile()
+	if len(walLast.Cache[42]) != 3 {
+		t.Error("Expected 3 recovered transactions, got", len(walLast.Cache[42]))
+	}
+}
+
+func TestShortZeroedTailRecovery(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	transaction := Transaction{}
+	transaction.MakeTransaction()
+	transaction.Header.pageCount = 1
+	transaction.Body = append(transaction.Body, PageEntry{
+		PageId:  42,
+		Offset:  0,
+		Length:  2,
+		OldData: []byte{0, 0},
+		NewData: []byte{1, 2},
+	})
+	err, _ := wal.AppendTransaction(transaction)
+	if err != nil {
+		t.Fatal("Failed to write transaction: ", err)
+	}
+	logicalEnd := wal.fileSize
+	wal.closeFile()
+
+	// a pre-allocated tail can end up shorter than a record header
+	err = os.Truncate("test.log", int64(logicalEnd)+5)
+	if err != nil {
+		t.Fatal("Failed to extend log: ", err)
+	}
+	walNew := newWal(t)
+	defer walNew.closeFile()
+	if walNew.fileSize != logicalEnd {
+		t.Error("Expected logical end", logicalEnd, "after recovery, got", walNew.fileSize)
+	}
+	if walNew.physicalSize != logicalEnd+5 {
+		t.Error("Expected the zeroed tail to be kept, physical size", walNew.physicalSize)
+	}
+	if len(walNew.Cache[42]) != 1 {
+		t.Error("Expected 1 recovered transaction, got", len(walNew.Cache[42]))
+	}
+}
+
+func TestEncryptedWal(t *testing.T) {
+	os.Remove("test.log")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wal := &WriteAheadLog{}
+	err := wal.SetCipher(key)
+	if err != nil {
+		t.Fatal("Failed to set cipher :", err)
+	}
+	err = wal.Initialize("test.log")
+	if err != nil {
+		t.Fatal("Failed to initialize wal :", err)
+	}
+	defer wal.closeFile()
+
+	// --- Create a dummy transaction ---
+	transaction := Transaction{}
+	transaction.MakeTransaction()
+
+	transaction.Header.pageCount = 1
+	page := PageEntry{
+		PageId:  42,
+		Offset:  10,
+		Length:  8,
+		OldData: []byte("oldvalue"),
+		NewData: []byte("newvalue"),
+	}
+	transaction.Body = append(transaction.Body, page)
+
+	err, _ = wal.AppendTransaction(transaction)
+	if err != nil {
+		t.Fatal("Failed to write transaction: ", err)
+	}
+	wal.Log.Sync()
+	wal.closeFile()
+
+	// the log on disk holds only ciphertext
+	raw, err := os.ReadFile("test.log")
+	if err != nil {
+		t.Fatal("Failed to read log :", err)
+	}
+	if bytes.Contains(raw, page.NewData) || bytes.Contains(raw, page.OldData) {
+		t.Fatal("Page data found in plaintext in the encrypted log")
+	}
+
+	// recovery with the right key rebuilds the transaction
+	walNew := &WriteAheadLog{}
+	walNew.SetCipher(key)
+	err = walNew.Initialize("test.log")
+	if err != nil {
+		t.Fatal("Failed to recover encrypted wal :", err)
+	}
+	cacheTransaction := walNew.Cache[42][0]
+	_, _, ok := cacheTransaction.checkSum(ChecksumCRC32)
+	if !ok {
+		t.Fatal("Failed checksum for recovered transaction")
+	}
+	if !reflect.DeepEqual(cacheTransaction.Body[0], page) {
+		t.Fatal("Value mismatch, recovered transaction is not equal to written transaction ")
+	}
+	walNew.closeFile()
+
+	// a wrong or missing key fails without truncating the log
+	walWrong := &WriteAheadLog{}
+	walWrong.SetCipher([]byte("fedcba9876543210fedcba9876543210"))
+	err = walWrong.Initialize("test.log")
+	walWrong.closeFile()
+	if !errors.Is(err, ErrWalKey) {
+		t.Error("Expected ErrWalKey for a wrong key, got", err)
+	}
+	walPlain := &WriteAheadLog{}
+	err = walPlain.Initialize("test.log")
+	walPlain.closeFile()
+	if !errors.Is(err, ErrWalEncrypted) {
+		t.Error("Expected ErrWalEncrypted without a key, got", err)
+	}
+	after, err := os.ReadFile("test.log")
+	if err != nil {
+		t.Fatal("Failed to read log :", err)
+	}
+	if !bytes.Equal(raw, after) {
+		t.Error("Failed recovery modified the log")
+	}
+
+	// the ciphertext is bound to its record, moving it to another
+	// transaction id fails even with a recomputed checksum
+	tampered := slices.Clone(raw)
+	binary.LittleEndian.PutUint64(tampered, 7)
+	binary.LittleEndian.PutUint64(tampered[len(tampered)-12:], 7)
+	binary.LittleEndian.PutUint32(tampered[len(tampered)-4:], getChecksumFromBytes(ChecksumCRC32, tampered[:len(tampered)-4]))
+	err = os.WriteFile("test.log", tampered, 0666)
+	if err != nil {
+		t.Fatal("Failed to write log :", err)
+	}
+	walMoved := &WriteAheadLog{}
+	walMoved.SetCipher(key)
+	err = walMoved.Initialize("test.log")
+	walMoved.closeFile()
+	if !errors.Is(err, ErrWalKey) {
+		t.Error("Expected ErrWalKey for ciphertext moved to another transaction, got", err)
+	}
+}
+
+func TestOrderedTransactions(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer wal.closeFile()
+
+	// transactions touching pages in an order unrelated to commit order
+	pageIds := []uint64{9, 3, 9, 1}
+	for _, pageId := range pageIds {
+		transaction := Transaction{}
+		transaction.MakeTransaction()
+		transaction.Header.pageCount = 1
+		transaction.Body = append(transaction.Body, PageEntry{
+			PageId:  pageId,
+			Offset:  0,
+			Length:  1,
+			OldData: []byte{0},
+			NewData: []byte{byte(pageId)},
+		})
+		err, _ := wal.AppendTransaction(transaction)
+		if err != nil {
+			t.Fatal("Failed to write transaction: ", err)
+		}
+	}
+
+	check := func(transactions []Transaction) {
+		if len(transactions) != len(pageIds) {
+			t.Fatal("Expected", len(pageIds), "transactions but got", len(transactions))
+		}
+		for i, transaction := range transactions {
+			if transaction.Header.transactionId != uint64(i) {
+				t.Error("Expected transaction", i, "but got", transaction.Header.transactionId)
+			}
+			if transaction.Body[0].PageId != pageIds[i] {
+				t.Error("Transaction", i, "expected page", pageIds[i], "but got", transaction.Body[0].PageId)
+			}
+		}
+	}
+	check(wal.OrderedTransactions())
+
+	// the order is rebuilt on recovery
+	wal.Log.Sync()
+	wal.closeFile()
+	walNew := newWal(t)
+	defer walNew.closeFile()
+	check(walNew.OrderedTransactions())
+}
+
+func TestMultiPageRecovery(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer wal.closeFile()
+
+	write := func(pageIds []uint64, value byte) {
+		transaction := Transaction{}
+		transaction.MakeTransaction()
+		transaction.Header.pageCount = uint32(len(pageIds))
+		for _, pageId := range pageIds {
+			transaction.Body = append(transaction.Body, PageEntry{
+				PageId:  pageId,
+				Offset:  0,
+				Length:  4,
+				OldData: []byte{0, 0, 0, 0},
+				NewData: []byte{value, value, value, value},
+			})
+		}
+		err, _ := wal.AppendTransaction(transaction)
+		if err != nil {
+			t.Fatal("Failed to write transaction: ", err)
+		}
+	}
+
+	write([]uint64{1}, 1)
+	if len(wal.Cache[1]) != 1 {
+		t.Fatal("Expected 1 cached transaction for page 1, got", len(wal.Cache[1]))
+	}
+
+	// corrupt the data of the last page in a multi-page transaction
+	start := wal.fileSize
+	write([]uint64{1, 2, 3}, 2)
+	for _, pageId := range []uint64{1, 2, 3} {
+		if len(wal.Cache[pageId]) == 0 || wal.Cache[pageId][len(wal.Cache[pageId])-1] != wal.ordered[1] {
+			t.Fatal("Expected page", pageId, "to share the cached transaction")
+		}
+	}
+	corruptAt := int64(wal.fileSize) - 12 - 1
+	_, err := wal.Log.WriteAt([]byte{0xff}, corruptAt)
+	if err != nil {
+		t.Fatal("Failed to corrupt transaction :", err)
+	}
+	if uint64(corruptAt) <= start {
+		t.Fatal("Corruption landed outside the transaction")
+	}
+
+	// a valid transaction after the corrupt one is still recovered
+	write([]uint64{4}, 4)
+	wal.Log.Sync()
+	wal.closeFile()
+
+	walNew := newWal(t)
+	defer walNew.closeFile()
+	if len(walNew.ordered) != 2 {
+		t.Fatal("Expected 2 recovered transactions, got", len(walNew.ordered))
+	}
+	if len(walNew.Cache[1]) != 1 {
+		t.Error("Expected page 1 to keep only its valid transaction, got", len(walNew.Cache[1]))
+	}
+	for _, pageId := range []uint64{2, 3} {
+		if _, ok := walNew.Cache[pageId]; ok {
+			t.Error("Page", pageId, "reflects a corrupt transaction")
+		}
+	}
+	states := walNew.PageStates()
+	if !bytes.Equal(states[1][:4], []byte{1, 1, 1, 1}) {
+		t.Error("Page 1 expected the first transaction's data but got", states[1][:4])
+	}
+	if !bytes.Equal(states[4][:4], []byte{4, 4, 4, 4}) {
+		t.Error("Page 4 expected its data but got", states[4][:4])
+	}
+}
+
+func TestInspectWal(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+
+	pageIds := []uint64{}
+	for i := 0; i < 3; i++ {
+		id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+		if err != nil {
+			t.Fatal("Page allocation failed:", err)
+		}
+		pageIds = append(pageIds, id)
+	}
+	_, err := DatabaseManager.WriteAt(pageIds[2], 0, []byte{1})
+	if err != nil {
+		t.Fatal("Write failed for page", pageIds[2], ":", err)
+	}
+	_, err = DatabaseManager.WritePages([]PageDelta{{pageIds[0], 0, []byte{2}}, {pageIds[2], 4, []byte{3}}})
+	if err != nil {
+		t.Fatal("Write failed :", err)
+	}
+	validBytes := DatabaseManager.wal.fileSize
+	DatabaseManager.Shutdown()
+
+	// leave an incomplete record at the end of the log
+	partial := binary.LittleEndian.AppendUint64([]byte{}, 2)
+	file, err := os.OpenFile("test.log", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal("Failed to open log :", err)
+	}
+	file.Write(partial)
+	file.Close()
+
+	inspector, err := InspectWal("test.log", ChecksumCRC32)
+	if err != nil {
+		t.Fatal("Failed to inspect wal :", err)
+	}
+	if inspector.TransactionCount() != 2 {
+		t.Fatal("Expected 2 transactions but got", inspector.TransactionCount())
+	}
+	if len(inspector.Transactions[1].PageIds) != 2 {
+		t.Error("Expected the second transaction to touch 2 pages, got", inspector.Transactions[1].PageIds)
+	}
+	if !reflect.DeepEqual(inspector.PageIds(), []uint64{pageIds[0], pageIds[2]}) {
+		t.Error("Expected pages", pageIds[0], pageIds[2], "but got", inspector.PageIds())
+	}
+	if inspector.ValidBytes != validBytes {
+		t.Error("Expected", validBytes, "valid bytes but got", inspector.ValidBytes)
+	}
+	if inspector.TruncatedBytes != uint64(len(partial)) {
+		t.Error("Expected", len(partial), "truncated bytes but got", inspector.TruncatedBytes)
+	}
+
+	// inspection leaves the log untouched
+	info, err := os.Stat("test.log")
+	if err != nil {
+		t.Fatal("Failed to stat log :", err)
+	}
+	if uint64(info.Size()) != validBytes+uint64(len(partial)) {
+		t.Error("Inspecting the log changed its size to", info.Size())
+	}
+
+	_, err = InspectWal("missing.log", ChecksumCRC32)
+	if err == nil {
+		t.Error("Expected error inspecting a missing log")
+	}
+}
+
+func TestTransactionsSince(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer func() { wal.closeFile() }()
+
+	appendTransactions := func(count int) {
+		for range count {
+			transaction := Transaction{}
+			transaction.MakeTransaction()
+			transaction.Header.pageCount = 1
+			transaction.Body = append(transaction.Body, PageEntry{
+				PageId:  1,
+				Offset:  0,
+				Length:  1,
+				OldData: []byte{0},
+				NewData: []byte{1},
+			})
+			err, _ := wal.AppendTransaction(transaction)
+			if err != nil {
+				t.Fatal("Failed to write transaction: ", err)
+			}
+		}
+	}
+	check := func(lsn uint64, expected ...uint64) {
+		transactions, err := wal.TransactionsSince(lsn)
+		if err != nil {
+			t.Fatal("Failed to read transactions since", lsn, ":", err)
+		}
+		ids := []uint64{}
+		for _, transaction := range transactions {
+			ids = append(ids, transaction.End.TransactionId)
+		}
+		if len(ids) != len(expected) || (len(ids) > 0 && !reflect.DeepEqual(ids, expected)) {
+			t.Error("Transactions since", lsn, "expected", expected, "but got", ids)
+		}
+	}
+
+	check(NoLSN)
+	appendTransactions(5)
+	check(NoLSN, 0, 1, 2, 3, 4)
+
+	// a consumer that has read up to 2 only sees newer transactions
+	check(2, 3, 4)
+	check(4)
+	appendTransactions(2)
+	check(4, 5, 6)
+
+	// transactions dropped by a checkpoint can't be polled anymore
+	err := wal.dropBefore(6)
+	if err != nil {
+		t.Fatal("Failed to drop transactions:", err)
+	}
+	_, err = wal.TransactionsSince(4)
+	if err == nil {
+		t.Error("Expected error polling transactions dropped from the log")
+	}
+	check(5, 6)
+
+	// an lsn the log hasn't reached is an error, not an empty poll
+	_, err = wal.TransactionsSince(7)
+	if err == nil {
+		t.Error("Expected error polling from a transaction not written yet")
+	}
+}
+
+func TestTransactionsSinceAfterReopen(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 32000)
+	id, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	lsn := uint64(0)
+	for i := range 5 {
+		lsn, err = DatabaseManager.WriteAt(id, 0, []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal("Write failed for page", id, ":", err)
+		}
+	}
+	err = DatabaseManager.SetCheckpointThreshold(0)
+	if err != nil {
+		t.Fatal("Failed to checkpoint :", err)
+	}
+	DatabaseManager.Shutdown()
+
+	// a consumer that read up to lsn sees the transactions of the next run
+	DatabaseManager = newDatabase(t, 1000000, 32000)
+	defer DatabaseManager.Shutdown()
+	written, err := DatabaseManager.WriteAt(id, 0, []byte{42})
+	if err != nil {
+		t.Fatal("Write failed for page", id, ":", err)
+	}
+	transactions, err := DatabaseManager.wal.TransactionsSince(lsn)
+	if err != nil {
+		t.Fatal("Failed to read transactions since", lsn, ":", err)
+	}
+	if len(transactions) != 1 || transactions[0].End.TransactionId != written {
+		t.Error("Expected transaction", written, "after", lsn, "got", len(transactions), "transactions")
+	}
+}
+
+func groupTransaction() Transaction {
+	transaction := Transaction{}
+	transaction.MakeTransaction()
+	transaction.Header.pageCount = 1
+	transaction.Body = append(transaction.Body, PageEntry{
+		PageId:  1,
+		Offset:  0,
+		Length:  64,
+		OldData: make([]byte, 64),
+		NewData: make([]byte, 64),
+	})
+	return transaction
+}
+
+func TestGroupCommit(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer wal.closeFile()
+	wal.SetGroupCommit(4, time.Hour)
+
+	// a full batch is synced without waiting for the delay
+	var group sync.WaitGroup
+	for range 8 {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			err, _ := wal.AppendTransaction(groupTransaction())
+			if err != nil {
+				t.Error("Failed to write transaction: ", err)
+			}
+		}()
+	}
+	group.Wait()
+	if len(wal.ordered) != 8 {
+		t.Fatal("Expected 8 transactions, got", len(wal.ordered))
+	}
+
+	// a lone transaction is synced once the delay passes
+	wal.SetGroupCommit(4, 10*time.Millisecond)
+	start := time.Now()
+	err, _ := wal.AppendTransaction(groupTransaction())
+	if err != nil {
+		t.Fatal("Failed to write transaction: ", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("Expected a partial batch to wait for the delay")
+	}
+
+	// every transaction written is recovered
+	wal.closeFile()
+	wal = newWal(t)
+	if len(wal.ordered) != 9 {
+		t.Error("Expected 9 transactions after recovery, got", len(wal.ordered))
+	}
+}
+
+func benchmarkCommit(b *testing.B, maxBatch int, maxDelay time.Duration) {
+	os.Remove("test.log")
+	wal := &WriteAheadLog{}
+	err := wal.Initialize("test.log")
+	if err != nil {
+		b.Fatal("Failed to initialize wal :", err)
+	}
+	defer wal.closeFile()
+	wal.SetGroupCommit(maxBatch, maxDelay)
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			err, _ := wal.AppendTransaction(groupTransaction())
+			if err != nil {
+				b.Error("Failed to write transaction: ", err)
+			}
+		}
+	})
+}
+
+func BenchmarkSyncEachCommit(b *testing.B) {
+	benchmarkCommit(b, 1, 0)
+}
+
+func BenchmarkGroupCommit(b *testing.B) {
+	benchmarkCommit(b, 16, time.Millisecond)
+}
+
+func TestWalReaderForEach(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	appended := []uint64{}
+	for range 5 {
+		err, id := wal.AppendTransaction(groupTransaction())
+		if err != nil {
+			t.Fatal("Failed to write transaction:", err)
+		}
+		appended = append(appended, id)
+	}
+	size := wal.fileSize
+	wal.closeFile()
+
+	// leave an incomplete record at the end of the log
+	file, err := os.OpenFile("test.log", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal("Failed to open log :", err)
+	}
+	file.Write(binary.LittleEndian.AppendUint64([]byte{}, 99))
+	file.Close()
+
+	walReader, err := OpenWalReader("test.log", ChecksumCRC32)
+	if err != nil {
+		t.Fatal("Failed to open wal reader:", err)
+	}
+	defer walReader.Close()
+	visited := []uint64{}
+	err = walReader.ForEach(func(transaction Transaction) error {
+		visited = append(visited, transaction.End.TransactionId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Failed to walk the log:", err)
+	}
+	if !slices.Equal(visited, appended) {
+		t.Error("Expected transactions", appended, "but visited", visited)
+	}
+
+	// an error from the callback stops the walk
+	stop := errors.New("stop")
+	count := 0
+	err = walReader.ForEach(func(transaction Transaction) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Error("Expected the walk to stop at the first error, got", err, count)
+	}
+
+	info, err := os.Stat("test.log")
+	if err != nil || uint64(info.Size()) != size+8 {
+		t.Error("Walking the log changed its size to", info.Size(), err)
+	}
+}
+
+func TestWalReaderChecksumAlgorithm(t *testing.T) {
+	os.Remove("test.log")
+	os.Remove("test.db")
+	DatabaseManager := newDatabase(t, 1000000, 10)
+	err := DatabaseManager.SetChecksumAlgorithm(ChecksumCRC32C)
+	if err != nil {
+		t.Fatal("Failed to switch to CRC32C:", err)
+	}
+	pageId, err := DatabaseManager.AllocatePage(PagetypeUserdata)
+	if err != nil {
+		t.Fatal("Page allocation failed:", err)
+	}
+	for i := range 2 {
+		_, err = DatabaseManager.WriteAt(pageId, uint32(i), []byte{1})
+		if err != nil {
+			t.Fatal("Write failed for page", pageId, ":", err)
+		}
+	}
+	DatabaseManager.Shutdown()
+
+	inspector, err := InspectWal("test.log", ChecksumCRC32C)
+	if err != nil {
+		t.Fatal("Failed to inspect wal :", err)
+	}
+	if inspector.TransactionCount() != 2 || inspector.CorruptTransactions != 0 {
+		t.Error("Expected 2 valid CRC32C transactions, got", inspector.TransactionCount(), "valid and", inspector.CorruptTransactions, "corrupt")
+	}
+	inspector, err = InspectWal("test.log", ChecksumCRC32)
+	if err != nil || inspector.CorruptTransactions != 2 {
+		t.Error("Expected CRC32C records to fail CRC32 checks, got", inspector.CorruptTransactions, err)
+	}
+	_, err = InspectWal("test.log", ChecksumAlgorithm(99))
+	if err == nil {
+		t.Error("Expected error inspecting with an unknown algorithm")
+	}
+
+	walReader, err := OpenWalReader("test.log", ChecksumCRC32C)
+	if err != nil {
+		t.Fatal("Failed to open wal reader:", err)
+	}
+	defer walReader.Close()
+	count := 0
+	err = walReader.ForEach(func(transaction Transaction) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Error("Expected to visit 2 CRC32C transactions, got", count, err)
+	}
+	_, err = OpenWalReader("test.log", ChecksumAlgorithm(99))
+	if err == nil {
+		t.Error("Expected error opening a reader with an unknown algorithm")
+	}
+}
+
+func TestAppendCachesOnce(t *testing.T) {
+	os.Remove("test.log")
+	wal := newWal(t)
+	defer wal.closeFile()
+
+	transaction := Transaction{}
+	transaction.MakeTransaction()
+	transaction.Header.pageCount = 3
+	for pageId := uint64(1); pageId <= 3; pageId++ {
+		transaction.Body = append(transaction.Body, PageEntry{
+			PageId:  pageId,
+			Length:  4,
+			OldData: make([]byte, 4),
+			NewData: []byte{1, 2, 3, 4},
+		})
+	}
+	err, _ := wal.AppendTransaction(transaction)
+	if err != nil {
+		t.Fatal("Failed to write transaction:", err)
+	}
+	for pageId := uint64(1); pageId <= 3; pageId++ {
+		if len(wal.Cache[pageId]) != 1 {
+			t.Error("Expected page", pageId, "to cache the transaction once, got", len(wal.Cache[pageId]))
+		}
+	}
+	if len(wal.ordered) != 1 {
+		t.Error("Expected one ordered transaction, got", len(wal.ordered))
+	}
+}
@@ -0,0 +1,173 @@
+package table
+
+import (
+	"encoding/binary"
+
+	s "relationalDatabase/internal/storage"
+)
+
+// Slotted page layout. A header is followed by the slot directory growing
+// forward, while record bytes grow backward from the end of the page
+const (
+	slotCountOffset   = 0 // Number of slots in the directory
+	recordStartOffset = 4 // Offset of the lowest record byte, 0 for the end of the page
+	slottedHeaderSize = 8
+	slotSize          = 8 // Offset and length of a record
+)
+
+// SlottedPage stores variable length records in a page. Each record is
+// reached through its slot, so records can move within the page, as
+// compaction does, without changing the slot number callers hold.
+// A zeroed page is a valid empty slotted page
+type SlottedPage struct {
+	data s.PageData
+}
+
+// NewSlottedPage reads and writes the slotted page in data
+func NewSlottedPage(data s.PageData) *SlottedPage {
+	return &SlottedPage{data}
+}
+
+// InsertRecord stores a record and returns its slot. Slots of deleted
+// records are reused and the page is compacted if the record only fits in
+// the space freed by deletes. Returns false if the page can't hold it
+func (page *SlottedPage) InsertRecord(record []byte) (int, bool) {
+	slot := page.freeSlot()
+	needed := len(record)
+	if slot == page.slotCount() {
+		needed += slotSize
+	}
+	if needed > page.FreeSpace() {
+		if needed > page.FreeSpace()+page.reclaimable() {
+			return 0, false
+		}
+		page.Compact()
+	}
+
+	if slot == page.slotCount() {
+		page.setSlotCount(slot + 1)
+	}
+	start := page.recordStart() - len(record)
+	copy(page.data[start:], record)
+	page.setRecordStart(start)
+	page.setSlot(slot, start, len(record))
+	return slot, true
+}
+
+// GetRecord returns the record in a slot, or nil if the slot is empty.
+// The record shares memory with the page and is only valid until the
+// page changes
+func (page *SlottedPage) GetRecord(slot int) []byte {
+	if slot < 0 || slot >= page.slotCount() {
+		return nil
+	}
+	offset, length := page.slot(slot)
+	if offset == 0 {
+		return nil
+	}
+	return page.data[offset : offset+length]
+}
+
+// DeleteRecord empties a slot. Its bytes stay in place until the page is
+// compacted
+func (page *SlottedPage) DeleteRecord(slot int) {
+	if slot < 0 || slot >= page.slotCount() {
+		return
+	}
+	page.setSlot(slot, 0, 0)
+	// trailing empty slots are dropped from the directory
+	count := page.slotCount()
+	for count > 0 {
+		offset, _ := page.slot(count - 1)
+		if offset != 0 {
+			break
+		}
+		count--
+	}
+	page.setSlotCount(count)
+}
+
+// Compact moves the records to the end of the page back to back, turning
+// the space of deleted records into free space. Slot numbers don't change
+func (page *SlottedPage) Compact() {
+	records := make([][]byte, page.slotCount())
+	for slot := range records {
+		record := page.GetRecord(slot)
+		if record != nil {
+			records[slot] = append([]byte{}, record...)
+		}
+	}
+	start := len(page.data)
+	for slot, record := range records {
+		if record == nil {
+			continue
+		}
+		start -= len(record)
+		copy(page.data[start:], record)
+		page.setSlot(slot, start, len(record))
+	}
+	page.setRecordStart(start)
+}
+
+// FreeSpace returns the bytes between the slot directory and the records
+func (page *SlottedPage) FreeSpace() int {
+	return page.recordStart() - slottedHeaderSize - page.slotCount()*slotSize
+}
+
+// Slots returns the number of slots in the directory, including empty ones
+func (page *SlottedPage) Slots() int {
+	return page.slotCount()
+}
+
+// reclaimable returns the bytes of deleted records compaction would free
+func (page *SlottedPage) reclaimable() int {
+	used := 0
+	for slot := range page.slotCount() {
+		_, length := page.slot(slot)
+		used += length
+	}
+	return len(page.data) - page.recordStart() - used
+}
+
+// freeSlot returns the first empty slot, or the slot count if there is none
+func (page *SlottedPage) freeSlot() int {
+	for slot := range page.slotCount() {
+		offset, _ := page.slot(slot)
+		if offset == 0 {
+			return slot
+		}
+	}
+	return page.slotCount()
+}
+
+func (page *SlottedPage) slotCount() int {
+	return int(binary.LittleEndian.Uint32(page.data[slotCountOffset:]))
+}
+
+func (page *SlottedPage) setSlotCount(count int) {
+	binary.LittleEndian.PutUint32(page.data[slotCountOffset:], uint32(count))
+}
+
+func (page *SlottedPage) recordStart() int {
+	start := int(binary.LittleEndian.Uint32(page.data[recordStartOffset:]))
+	if start == 0 {
+		return len(page.data)
+	}
+	return start
+}
+
+func (page *SlottedPage) setRecordStart(start int) {
+	binary.LittleEndian.PutUint32(page.data[recordStartOffset:], uint32(start))
+}
+
+// slot returns the offset and length of a slot, an offset of 0 marks it empty
+func (page *SlottedPage) slot(slot int) (int, int) {
+	position := slottedHeaderSize + slot*slotSize
+	return int(binary.LittleEndian.Uint32(page.data[position:])), int(binary.LittleEndian.Uint32(page.data[position+4:]))
+}
+
+func (page *SlottedPage) setSlot(slot int, offset int, length int) {
+	position := slottedHeaderSize + slot*slotSize
+	binary.LittleEndian.PutUint32(page.data[position:], uint32(offset))
+	binary.LittleEndian.PutUint32(page.data[position+4:], uint32(length))
+}
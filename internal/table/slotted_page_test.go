@@ -0,0 +1,111 @@
+package table
+
+import (
+	"bytes"
+	"testing"
+
+	s "relationalDatabase/internal/storage"
+)
+
+func TestSlottedPageFull(t *testing.T) {
+	page := NewSlottedPage(s.MakePageData())
+	record := bytes.Repeat([]byte{7}, 100)
+	inserted := 0
+	for {
+		slot, ok := page.InsertRecord(record)
+		if !ok {
+			break
+		}
+		if slot != inserted {
+			t.Fatal("Expected slot", inserted, "got", slot)
+		}
+		inserted++
+	}
+	// every record costs its bytes and a slot
+	expected := (len(s.MakePageData()) - slottedHeaderSize) / (len(record) + slotSize)
+	if inserted != expected {
+		t.Fatal("Expected", expected, "records to fit, got", inserted)
+	}
+	if page.FreeSpace() >= len(record)+slotSize {
+		t.Error("Insert failed with", page.FreeSpace(), "bytes free")
+	}
+	for slot := range inserted {
+		if !bytes.Equal(page.GetRecord(slot), record) {
+			t.Fatal("Record mismatch in slot", slot)
+		}
+	}
+	if page.GetRecord(inserted) != nil || page.GetRecord(-1) != nil {
+		t.Error("Expected no record outside the slot directory")
+	}
+}
+
+func TestSlottedPageDelete(t *testing.T) {
+	page := NewSlottedPage(s.MakePageData())
+	records := [][]byte{[]byte("alice"), []byte("bob"), {}, []byte("carol")}
+	for i, record := range records {
+		slot, ok := page.InsertRecord(record)
+		if !ok || slot != i {
+			t.Fatal("Failed to insert record", i, "got slot", slot, ok)
+		}
+	}
+
+	page.DeleteRecord(1)
+	if page.GetRecord(1) != nil {
+		t.Error("Expected deleted slot 1 to be empty")
+	}
+	if !bytes.Equal(page.GetRecord(3), []byte("carol")) || page.GetRecord(2) == nil {
+		t.Error("Expected other records to be untouched by the delete")
+	}
+
+	// the empty slot is reused before the directory grows
+	slot, ok := page.InsertRecord([]byte("dave"))
+	if !ok || slot != 1 {
+		t.Error("Expected slot 1 to be reused, got", slot, ok)
+	}
+
+	// trailing empty slots leave the directory
+	page.DeleteRecord(3)
+	page.DeleteRecord(2)
+	if page.Slots() != 2 {
+		t.Error("Expected 2 slots after deleting the last records, got", page.Slots())
+	}
+}
+
+func TestSlottedPageCompaction(t *testing.T) {
+	page := NewSlottedPage(s.MakePageData())
+	small := bytes.Repeat([]byte{1}, 500)
+	for i := 0; ; i++ {
+		record := append([]byte{byte(i)}, small...)
+		_, ok := page.InsertRecord(record)
+		if !ok {
+			break
+		}
+	}
+	slots := page.Slots()
+	for slot := 0; slot < slots; slot += 2 {
+		page.DeleteRecord(slot)
+	}
+
+	// the freed records are scattered, a record larger than any of them
+	// only fits once the page is compacted
+	large := bytes.Repeat([]byte{2}, 3*len(small))
+	if page.FreeSpace() >= len(large) {
+		t.Fatal("Expected the large record not to fit without compaction")
+	}
+	slot, ok := page.InsertRecord(large)
+	if !ok {
+		t.Fatal("Expected the large record to fit after compaction")
+	}
+	if slot != 0 {
+		t.Error("Expected the first empty slot to be reused, got", slot)
+	}
+	if !bytes.Equal(page.GetRecord(slot), large) {
+		t.Error("Large record mismatch")
+	}
+	for i := 1; i < slots; i += 2 {
+		record := page.GetRecord(i)
+		if len(record) != len(small)+1 || record[0] != byte(i) {
+			t.Error("Record in slot", i, "changed by compaction")
+		}
+	}
+}